@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/agent"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/tedge"
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run as a thin-edge.io operation handler for flow deploy and remove commands",
+	Long: `Run as a thin-edge.io operation handler for flow deploy and remove commands.
+
+The agent registers the flow_deploy and flow_remove operations of the device and
+subscribes to their commands (e.g. te/device/main///cmd/flow_deploy/+). Each command
+is executed with the same logic as "flows instances deploy" and "flows instances remove",
+and its status is updated to executing, then successful or failed (with a reason).
+
+Command payloads:
+  flow_deploy: {"status":"init","name":"counter1","image":"ghcr.io/thin-edge/connectivity-counter:1.0","topics":["te/device/main///m/+"]}
+  flow_remove: {"status":"init","name":"counter1"}
+
+The prefix of the operation names can be changed with --namespace (or agent.namespace
+in the config), and the broker and device topic are read the same way as for
+"status publish".`,
+	Example: `# Handle flow_deploy and flow_remove commands
+$ tedge-oscar agent
+
+# Handle myflows_deploy and myflows_remove commands instead
+$ tedge-oscar agent --namespace myflows`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		settings, err := tedge.LoadMQTTSettings(cfg)
+		if err != nil {
+			return err
+		}
+		timeout, err := cfg.GetLockTimeout()
+		if err != nil {
+			return err
+		}
+		if cmd.Flags().Changed("lock-timeout") {
+			timeout = lockTimeout
+		}
+		namespace := cfg.Agent.Namespace
+		if cmd.Flags().Changed("namespace") {
+			namespace, _ = cmd.Flags().GetString("namespace")
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		a := agent.New(cfg, settings, agent.Options{
+			Namespace:   namespace,
+			LockTimeout: timeout,
+			Log:         cmd.ErrOrStderr(),
+		})
+		return a.Run(ctx)
+	},
+}
+
+func init() {
+	agentCmd.Flags().String("namespace", agent.DefaultNamespace, "Prefix of the operation names, e.g. flow for flow_deploy and flow_remove")
+	rootCmd.AddCommand(agentCmd)
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/apply"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+)
+
+const manifestExample = `images:
+  - ghcr.io/thin-edge/connectivity-counter:1.0
+
+instances:
+  - name: counter
+    image: ghcr.io/thin-edge/connectivity-counter:1.0
+    topics:
+      - te/device/main///m/+
+    interval: 10s
+    params:
+      threshold: 5`
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Converge images and instances to a desired state manifest",
+	Long: `Converge images and instances to a desired state manifest.
+
+The manifest lists the images to pull and the instances to deploy:
+
+` + manifestExample + `
+
+Instances created by apply are marked as managed, so they can be removed
+with --prune once they are no longer declared in the manifest.`,
+	Example: `# Preview and apply the changes
+$ tedge-oscar apply -f flows.yaml
+
+# Also remove managed instances which are no longer declared
+$ tedge-oscar apply -f flows.yaml --prune`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runPlan(cmd, true)
+	},
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Preview the changes apply would make for a desired state manifest",
+	Example: `# Preview the changes
+$ tedge-oscar plan -f flows.yaml --prune`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runPlan(cmd, false)
+	},
+}
+
+func runPlan(cmd *cobra.Command, execute bool) error {
+	registryauth.SetDebugHTTP(logLevel)
+	cfgPath := configPath
+	if cfgPath == "" {
+		cfgPath = config.DefaultConfigPath()
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	manifestPath, _ := cmd.Flags().GetString("file")
+	prune, _ := cmd.Flags().GetBool("prune")
+	manifest, err := apply.LoadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	mode := filelock.Shared
+	if execute {
+		mode = filelock.Exclusive
+	}
+	unlock, err := lockDirs(cmd, cfg, mode, cfg.ImageDir, cfg.GetDeployDir())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	plan, err := apply.ComputePlan(cfg, manifest, apply.Options{Prune: prune})
+	if err != nil {
+		return err
+	}
+	plan.Print(cmd.OutOrStdout())
+	if !execute || len(plan.Actions) == 0 {
+		return nil
+	}
+	if err := apply.Execute(cfg, plan, cmd.ErrOrStderr()); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Applied %d change(s)\n", len(plan.Actions))
+	autoPublishStatus(cmd, cfg)
+	return nil
+}
+
+func init() {
+	for _, c := range []*cobra.Command{applyCmd, planCmd} {
+		c.Flags().StringP("file", "f", "", "Path to the desired state manifest (YAML or JSON), or - for stdin")
+		c.Flags().Bool("prune", false, "Remove managed instances which are no longer declared in the manifest")
+		_ = c.MarkFlagRequired("file")
+		_ = c.MarkFlagFilename("file", "yaml", "yml", "json")
+		rootCmd.AddCommand(c)
+	}
+}
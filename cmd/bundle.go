@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/bundle"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export all flow instances and their image references to a bundle",
+	Long: `Export all flow instances and their image references to a bundle.
+
+The bundle is a tar.gz file containing every instance file (enabled and disabled)
+and the references of the images they use. Use --include-images to also embed the
+image contents, so the bundle can be imported on a device without registry access.`,
+	Example: `# Export the flow setup of a device
+$ tedge-oscar export -o bundle.tar.gz
+
+# Export including the image contents
+$ tedge-oscar export -o bundle.tar.gz --include-images`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		output, _ := cmd.Flags().GetString("output")
+		includeImages, _ := cmd.Flags().GetBool("include-images")
+		if output == "" {
+			return fmt.Errorf("--output is required")
+		}
+		unlock, err := lockDirs(cmd, cfg, filelock.Shared, cfg.ImageDir, cfg.GetDeployDir())
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		opts := bundle.ExportOptions{IncludeImages: includeImages}
+		var index *bundle.Index
+		if output == "-" {
+			index, err = bundle.Export(cfg, cmd.OutOrStdout(), opts)
+		} else {
+			err = fsutil.WriteFileAtomic(output, 0644, func(w io.Writer) error {
+				var exportErr error
+				index, exportErr = bundle.Export(cfg, w, opts)
+				return exportErr
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to export bundle: %w", err)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Exported %d instance(s) and %d image reference(s) to %s\n", len(index.Instances), len(index.Images), output)
+		return nil
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [bundle]",
+	Short: "Import flow instances and images from a bundle created by export",
+	Long: `Import flow instances and images from a bundle created by export.
+
+Absolute paths in the instance files which point to the image_dir or deploy_dir of
+the exporting device are rewritten to the image_dir and deploy_dir of this device.
+Images which are not embedded in the bundle are pulled if they are missing.`,
+	Example: `# Restore the flow setup on a new device
+$ tedge-oscar import bundle.tar.gz`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		noPull, _ := cmd.Flags().GetBool("no-pull")
+		overwrite, _ := cmd.Flags().GetBool("overwrite-images")
+
+		var r io.Reader
+		if args[0] == "-" {
+			r = cmd.InOrStdin()
+		} else {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to open bundle: %w", err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		unlock, err := lockDirs(cmd, cfg, filelock.Exclusive, cfg.ImageDir, cfg.GetDeployDir())
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		index, err := bundle.Import(cfg, r, bundle.ImportOptions{
+			Pull:            !noPull,
+			OverwriteImages: overwrite,
+		}, cmd.ErrOrStderr())
+		if err != nil {
+			return fmt.Errorf("failed to import bundle: %w", err)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Imported %d instance(s) and %d image reference(s)\n", len(index.Instances), len(index.Images))
+		autoPublishStatus(cmd, cfg)
+		return nil
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringP("output", "o", "", "Path to the output bundle (e.g. bundle.tar.gz), or - for stdout")
+	exportCmd.Flags().Bool("include-images", false, "Embed the contents of the referenced images in the bundle")
+	importCmd.Flags().Bool("no-pull", false, "Don't pull missing images which are not embedded in the bundle")
+	importCmd.Flags().Bool("overwrite-images", false, "Replace existing local images with the images embedded in the bundle")
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+}
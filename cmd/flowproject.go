@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/flowproject"
+	"github.com/thin-edge/tedge-oscar/internal/imagepush"
+)
+
+var flowInitCmd = &cobra.Command{
+	Use:   "init [name]",
+	Short: "Create a new flow project",
+	Long: `Create a new flow project.
+
+The project contains a flow definition (flow.toml), the flow script (src/main.mjs),
+a package.json to bundle the script into dist/main.mjs, a README and an example
+test case in tests/.`,
+	Example: `# Create a flow project in ./my-flow
+$ tedge-oscar flows init my-flow
+
+# Create a flow project in the current directory
+$ tedge-oscar flows init my-flow --dir .`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		dir, _ := cmd.Flags().GetString("dir")
+		force, _ := cmd.Flags().GetBool("force")
+		if dir == "" {
+			dir = name
+		}
+		created, err := flowproject.Init(dir, name, force)
+		if err != nil {
+			return err
+		}
+		for _, f := range created {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Created %s\n", filepath.Join(dir, f))
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Flow project %s created in %s\n", name, dir)
+		return nil
+	},
+}
+
+var flowBuildCmd = &cobra.Command{
+	Use:   "build [dir]",
+	Short: "Validate a flow project and collect the files of its image",
+	Long: `Validate a flow project and collect the files of its image.
+
+The project must contain a flow definition (flow.toml or pipeline.toml) with at least
+one step, and the bundled entrypoint dist/main.mjs, which must export an onMessage,
+onInterval or process function. The image contains the flow definition, README.md,
+dist/ and tests/.
+
+With --format dir (default) the files are copied to the output folder, which can be
+pushed with "images push --dir". With --format oci an OCI image layout is created,
+which can be pushed with "images push --oci-layout". The output folder is replaced by
+each build, so an existing folder with other files is refused unless --force is given.`,
+	Example: `# Build the flow project in the current directory into ./build
+$ tedge-oscar flows build
+$ tedge-oscar flows images push ghcr.io/user/my-flow:1.0 --dir build
+
+# Build an OCI image layout
+$ tedge-oscar flows build ./my-flow --format oci -o my-flow.oci
+$ tedge-oscar flows images push ghcr.io/user/my-flow:1.0 --oci-layout my-flow.oci`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		output, _ := cmd.Flags().GetString("output")
+		format, _ := cmd.Flags().GetString("format")
+		tag, _ := cmd.Flags().GetString("tag")
+		ociType, _ := cmd.Flags().GetString("type")
+		force, _ := cmd.Flags().GetBool("force")
+		if output == "" {
+			output = filepath.Join(dir, flowproject.DefaultBuildDir)
+		}
+
+		project, err := flowproject.Load(dir)
+		if err != nil {
+			return err
+		}
+		switch format {
+		case "dir":
+			if err := project.Build(output, force); err != nil {
+				return err
+			}
+		case "oci":
+			desc, err := project.BuildOCILayout(output, ociType, tag, force)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s (%s) written to the OCI layout\n", tag, desc.Digest)
+		default:
+			return fmt.Errorf("invalid format %q, expected dir or oci", format)
+		}
+		for _, f := range project.RelFiles() {
+			fmt.Fprintf(cmd.ErrOrStderr(), "  %s\n", f)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Flow %s built to %s (%d files)\n", flowproject.ProjectName(dir), output, len(project.Files))
+		return nil
+	},
+}
+
+func init() {
+	flowInitCmd.Flags().String("dir", "", "Directory to create the project in (default: ./<name>)")
+	flowInitCmd.Flags().Bool("force", false, "Overwrite existing files")
+	flowBuildCmd.Flags().StringP("output", "o", "", "Output directory (default: <dir>/"+flowproject.DefaultBuildDir+")")
+	flowBuildCmd.Flags().String("format", "dir", "Output format: dir|oci")
+	flowBuildCmd.Flags().String("tag", "latest", "Tag of the image in the OCI layout (--format oci)")
+	flowBuildCmd.Flags().String("type", imagepush.DefaultArtifactType, "OCI artifact type (--format oci)")
+	flowBuildCmd.Flags().Bool("force", false, "Replace an existing output directory which is not the output of a build")
+	_ = flowBuildCmd.RegisterFlagCompletionFunc("format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"dir", "oci"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	flowsCmd.AddCommand(flowInitCmd)
+	flowsCmd.AddCommand(flowBuildCmd)
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/flowtest"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+)
+
+var flowTestCmd = &cobra.Command{
+	Use:   "test [image|dir]",
+	Short: "Run sample messages through a flow and check its output",
+	Long: `Run sample messages through a flow and check its output.
+
+The flow is rendered in the same way as "instances deploy" into a temporary flows
+directory, and each test case is run in a separate runner process with the temporary
+directory as its working directory. By default the tedge flows runtime is used:
+
+  ` + flowtest.DefaultRunner + `
+
+Another runner (e.g. a JS runner) can be set with --runner or test.runner in the
+config. It gets the messages on stdin and must print the output messages on stdout,
+both as "[topic] payload" lines. The {flow}, {flows_dir} and {script} placeholders
+are replaced with the paths of the rendered flow, its folder and dist/main.mjs.
+
+Test cases are read from the tests/ directory of the image or flow project:
+tests/<name>.input.jsonl and tests/<name>.expected.jsonl, where each line is a
+message such as {"topic": "te/device/main///m/env", "payload": {"temperature": 23.5}}.
+Use --input to run a single input file instead.`,
+	Example: `# Run the test cases of a flow project
+$ tedge-oscar flows test ./my-flow
+
+# Run the test cases of a pulled image and write a JUnit report
+$ tedge-oscar flows test ghcr.io/thin-edge/connectivity-counter:1.0 --report junit --report-file report.xml
+
+# Feed a custom list of messages to the flow
+$ tedge-oscar flows test ./my-flow --input messages.jsonl`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		inputPath, _ := cmd.Flags().GetString("input")
+		expectedPath, _ := cmd.Flags().GetString("expected")
+		reportFormat, _ := cmd.Flags().GetString("report")
+		reportFile, _ := cmd.Flags().GetString("report-file")
+
+		runner := flowtest.Runner{
+			Command: cfg.Test.Runner,
+			Timeout: flowtest.DefaultTimeout,
+			Log:     cmd.ErrOrStderr(),
+		}
+		if cfg.Test.Timeout != "" {
+			if runner.Timeout, err = time.ParseDuration(cfg.Test.Timeout); err != nil {
+				return fmt.Errorf("invalid test.timeout: %w", err)
+			}
+		}
+		if cmd.Flags().Changed("runner") {
+			runner.Command, _ = cmd.Flags().GetString("runner")
+		}
+		if cmd.Flags().Changed("timeout") {
+			runner.Timeout, _ = cmd.Flags().GetDuration("timeout")
+		}
+
+		// A local folder is used as is, otherwise the argument is an image in the image_dir
+		flowDir := args[0]
+		if info, err := os.Stat(flowDir); err != nil || !info.IsDir() {
+			if flowDir, err = instance.ImagePath(cfg, args[0]); err != nil {
+				return err
+			}
+			if _, err := os.Stat(flowDir); err != nil {
+				return fmt.Errorf("image %s not found locally, pull it first: %w", args[0], err)
+			}
+			unlock, err := lockDirs(cmd, cfg, filelock.Shared, cfg.ImageDir)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+		}
+
+		var cases []flowtest.Case
+		if inputPath != "" {
+			c, err := flowtest.LoadCase(inputPath)
+			if err != nil {
+				return err
+			}
+			if expectedPath != "" {
+				if c.Expected, err = flowtest.ReadMessages(expectedPath); err != nil {
+					return err
+				}
+			}
+			cases = append(cases, c)
+		} else {
+			if cases, err = flowtest.LoadCases(flowDir); err != nil {
+				return err
+			}
+			if len(cases) == 0 {
+				return fmt.Errorf("no test cases found in %s, use --input to run a message file", filepath.Join(flowDir, flowtest.TestsDir))
+			}
+		}
+
+		results, err := runner.Run(flowDir, cases)
+		if err != nil {
+			return err
+		}
+		suite := filepath.Base(filepath.Clean(flowDir))
+		if reportFile != "" {
+			err = fsutil.WriteFileAtomic(reportFile, 0644, func(w io.Writer) error {
+				return flowtest.WriteReport(w, reportFormat, suite, results)
+			})
+		} else {
+			err = flowtest.WriteReport(cmd.OutOrStdout(), reportFormat, suite, results)
+		}
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, r := range results {
+			if !r.Passed() {
+				failed++
+			}
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "%d passed, %d failed\n", len(results)-failed, failed)
+		if failed > 0 {
+			return fmt.Errorf("%d of %d test case(s) failed", failed, len(results))
+		}
+		return nil
+	},
+}
+
+func init() {
+	flowTestCmd.Flags().String("input", "", "JSON lines file with the messages to feed to the flow (default: all test cases in tests/)")
+	flowTestCmd.Flags().String("expected", "", "JSON lines file with the expected output of --input (default: tests/<name>.expected.jsonl next to it)")
+	flowTestCmd.Flags().String("runner", flowtest.DefaultRunner, "Command which runs the flow (overrides test.runner in config)")
+	flowTestCmd.Flags().Duration("timeout", flowtest.DefaultTimeout, "Maximum duration of each test case (overrides test.timeout in config)")
+	flowTestCmd.Flags().String("report", flowtest.FormatTAP, "Report format: tap|junit")
+	flowTestCmd.Flags().String("report-file", "", "Write the report to a file instead of stdout")
+	_ = flowTestCmd.RegisterFlagCompletionFunc("report", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{flowtest.FormatTAP, flowtest.FormatJUnit}, cobra.ShellCompDirectiveNoFileComp
+	})
+	flowsCmd.AddCommand(flowTestCmd)
+}
@@ -4,14 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 
-	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/images"
 	"github.com/thin-edge/tedge-oscar/internal/util"
 )
 
@@ -34,7 +34,11 @@ var listImagesCmd = &cobra.Command{
 	Use:     "list",
 	Short:   "List flow images in the image_dir",
 	Aliases: []string{"ls"},
-	Example: `tedge-oscar flows images list`,
+	Example: `# List all images
+tedge-oscar flows images list
+
+# Show the annotations set on push
+tedge-oscar flows images list --select image,version,created,revision,source`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		selectCols, err := cmd.Flags().GetString("select")
 		if err != nil {
@@ -66,50 +70,31 @@ var listImagesCmd = &cobra.Command{
 		if imageDir == "" {
 			return fmt.Errorf("image_dir not set in config")
 		}
+		unlock, err := lockDirs(cmd, cfg, filelock.Shared, imageDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		// Don't fail if directory does not exist
-		entries, err := os.ReadDir(imageDir)
+		items, err := images.List(imageDir)
 		if err != nil {
-			if !os.IsNotExist(err) {
-				return fmt.Errorf("failed to read image_dir. Check the permissions of the folder. %w", err)
-			}
+			return fmt.Errorf("failed to read image_dir. Check the permissions of the folder. %w", err)
 		}
 		rows := [][]string{}
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			imageDir := filepath.Join(imageDir, entry.Name())
-			manifestPath := filepath.Join(imageDir, "manifest.json")
-			version := "<unknown>"
-			digest := "<unknown>"
-			if f, err := os.Open(manifestPath); err == nil {
-				var manifest map[string]interface{}
-				if err := json.NewDecoder(f).Decode(&manifest); err == nil {
-					if ann, ok := manifest["annotations"].(map[string]interface{}); ok {
-						if v, ok := ann["org.opencontainers.image.version"].(string); ok {
-							version = v
-						}
-					}
-					if d, ok := manifest["config"].(map[string]interface{}); ok {
-						if dgst, ok := d["digest"].(string); ok {
-							digest = dgst
-						}
-					}
-					if d, ok := manifest["digest"].(string); ok && d != "" {
-						digest = d
-					}
-				}
-				f.Close()
-			}
+		for _, item := range items {
 			rowMap := map[string]string{
-				"image":    artifact.TrimVersion(entry.Name()),
-				"version":  version,
-				"digest":   digest,
-				"imageDir": imageDir,
+				"image":    item.Name,
+				"version":  item.Version,
+				"digest":   item.Digest,
+				"imageDir": item.Path,
 			}
 			row := make([]string, len(colNames))
 			for i, col := range colNames {
-				row[i] = rowMap[col]
+				if value, ok := rowMap[col]; ok {
+					row[i] = value
+				} else {
+					row[i] = item.Annotation(col)
+				}
 			}
 			rows = append(rows, row)
 		}
@@ -189,7 +174,7 @@ func init() {
 		defaultOutput = "table"
 	}
 	listImagesCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|jsonl|tsv")
-	listImagesCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. image,version,digest)")
+	listImagesCmd.Flags().String("select", "", "Comma separated list of columns to display: image, version, digest, imageDir, created, source, revision, description, licenses, authors, vendor, url or an annotation key")
 	_ = listImagesCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"table", "jsonl", "tsv"}, cobra.ShellCompDirectiveNoFileComp
 	})
@@ -8,6 +8,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
 )
 
 var removeImageCmd = &cobra.Command{
@@ -35,7 +36,7 @@ var removeImageCmd = &cobra.Command{
 		}
 		var completions []string
 		for _, entry := range entries {
-			if !entry.IsDir() {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
 				continue
 			}
 			name := entry.Name()
@@ -58,6 +59,11 @@ var removeImageCmd = &cobra.Command{
 		if imageDir == "" {
 			return fmt.Errorf("image_dir not set in config")
 		}
+		unlock, err := lockDirs(cmd, cfg, filelock.Exclusive, imageDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		folderName := args[0]
 		fullPath := filepath.Join(imageDir, folderName)
 		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
@@ -12,9 +12,11 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
-	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/reload"
 	"github.com/thin-edge/tedge-oscar/internal/util"
-	"github.com/thin-edge/tedge-oscar/pkg/maputil"
+	"github.com/thin-edge/tedge-oscar/internal/watch"
 	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
 	"golang.org/x/term"
 )
@@ -53,7 +55,7 @@ $ tedge-oscar flows instances list`,
 		if selectCols != "" {
 			colNames = strings.Split(selectCols, ",")
 		} else {
-			colNames = []string{"name", "path", "topics", "image", "imageVersion"}
+			colNames = []string{"name", "status", "path", "topics", "image", "imageVersion"}
 		}
 
 		cfgPath := configPath
@@ -64,14 +66,13 @@ $ tedge-oscar flows instances list`,
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
-		deployDir := cfg.DeployDir
-		if deployDir == "" {
-			deployDir = os.Getenv("DEPLOY_DIR")
-		}
-		if deployDir == "" {
-			deployDir = filepath.Join(filepath.Dir(cfg.ImageDir), "deployments")
+		deployDir := cfg.GetDeployDir()
+		unlock, err := lockDirs(cmd, cfg, filelock.Shared, cfg.ImageDir, deployDir)
+		if err != nil {
+			return err
 		}
-		files, err := os.ReadDir(deployDir)
+		defer unlock()
+		entries, err := instance.List(deployDir)
 		if err != nil {
 			return fmt.Errorf("failed to read deploy dir: %w", err)
 		}
@@ -87,17 +88,14 @@ $ tedge-oscar flows instances list`,
 		}
 		// Prepare all rows first
 		rows := [][]string{}
-		for _, file := range files {
-			if file.IsDir() || !strings.HasSuffix(file.Name(), ".toml") {
-				continue
-			}
-			name := strings.TrimSuffix(file.Name(), ".toml")
-			path := filepath.Join(unexpandedDeployDir, file.Name())
+		for _, entry := range entries {
+			name := entry.Name
+			path := filepath.Join(unexpandedDeployDir, filepath.Base(entry.Path))
 			var data flows.InstanceFile
 			topics := ""
 			image := "<invalid>"
 			imageVersion := "<unknown>"
-			if _, err := toml.DecodeFile(filepath.Join(deployDir, file.Name()), &data); err == nil && len(data.Steps) > 0 {
+			if _, err := toml.DecodeFile(entry.Path, &data); err == nil && len(data.Steps) > 0 {
 				topics = strings.Join(data.Input.MQTT.Topics, ", ")
 				// If the image path starts with the expanded imageDir, replace with unexpanded
 				imgPath := data.Steps[0].Script
@@ -141,6 +139,7 @@ $ tedge-oscar flows instances list`,
 			// Build row based on selected columns
 			rowMap := map[string]string{
 				"name":         name,
+				"status":       entry.Status(),
 				"path":         path,
 				"topics":       topics,
 				"image":        imageName,
@@ -227,7 +226,13 @@ var deployCmd = &cobra.Command{
 	Short:   "Deploy a flow instance",
 	Aliases: []string{"run"},
 	Example: `# Deploy a new instance using a specific image and topic
-$ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0 --topics te/device/main///m/+`,
+$ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0 --topics te/device/main///m/+
+
+# Deploy the latest 1.x version, which "instances upgrade --to-latest" keeps up to date
+$ tedge-oscar flows instances deploy myinstance 'ghcr.io/thin-edge/connectivity-counter:^1.0'
+
+# Let "tedge-oscar watch" roll out the patch releases automatically
+$ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0.0 --update-policy patch`,
 	Args:         cobra.ExactArgs(2),
 	SilenceUsage: true, // Do not show help on runtime errors
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -253,7 +258,7 @@ $ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-c
 		}
 		var completions []string
 		for _, entry := range entries {
-			if !entry.IsDir() {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
 				continue
 			}
 			name := entry.Name()
@@ -283,128 +288,34 @@ $ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-c
 		if cmd.Flags().Changed("interval") {
 			interval, _ = cmd.Flags().GetString("interval")
 		}
-		deployDir := cfg.DeployDir
-		if deployDir == "" {
-			deployDir = os.Getenv("DEPLOY_DIR")
-		}
-		if deployDir == "" {
-			deployDir = filepath.Join(filepath.Dir(cfg.ImageDir), "deployments")
+		updatePolicy, _ := cmd.Flags().GetString("update-policy")
+		if err := watch.ValidatePolicy(updatePolicy); err != nil {
+			return err
 		}
+		deployDir := cfg.GetDeployDir()
 		if err := os.MkdirAll(deployDir, 0755); err != nil {
 			return err
 		}
-
-		// Extract repository part from image reference (remove tag/digest)
-		name, err := artifact.ParseName(imageRef, false)
+		// The image may need to be pulled, so lock both directories (always image_dir first)
+		unlock, err := lockDirs(cmd, cfg, filelock.Exclusive, cfg.ImageDir, deployDir)
 		if err != nil {
 			return err
 		}
+		defer unlock()
 
-		imagePath := filepath.Join(cfg.ImageDir, name)
-		scriptPath := filepath.Join(imagePath, "dist/main.mjs")
-		fmt.Fprintf(cmd.ErrOrStderr(), "script path: %s\n", scriptPath)
-
-		if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s not found locally. Pulling...\n", imageRef)
-			if err := imagepull.PullImage(cfg, imageRef, cfg.ImageDir, "", false); err != nil {
-				return fmt.Errorf("failed to pull image: %w", err)
-			}
-		}
-
-		if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s does not contain the expected entrypoint. path=%s\n", imageRef, scriptPath)
+		tomlPath, err := instance.Deploy(cfg, instance.DeployOptions{
+			Name:         instanceName,
+			Image:        imageRef,
+			Topics:       topics,
+			Interval:     interval,
+			UpdatePolicy: updatePolicy,
+		}, cmd.ErrOrStderr())
+		if err != nil {
 			return err
 		}
-
-		tomlPath := filepath.Join(deployDir, instanceName+".toml")
-		// Look for the first existing TOML config file in priority order
-		var imageFlowDefinitionPath string
-		for _, candidate := range []string{"flow.toml", "pipeline.toml"} {
-			candidatePath := filepath.Join(imagePath, candidate)
-			if _, err := os.Stat(candidatePath); err == nil {
-				imageFlowDefinitionPath = candidatePath
-				break
-			}
-		}
-		if _, err := os.Stat(imageFlowDefinitionPath); err == nil {
-			// Load flow definition as a map to preserve all fields
-			var m map[string]interface{}
-			if _, err := toml.DecodeFile(imageFlowDefinitionPath, &m); err != nil {
-				return fmt.Errorf("failed to parse %s: %w", imageFlowDefinitionPath, err)
-			}
-			// Always update topics from CLI using a helper to set nested keys
-			if len(topics) > 0 {
-				if err := maputil.SetNestedMapValue(m, []string{"input", "mqtt", "topics"}, topics); err != nil {
-					return fmt.Errorf("failed to set input.mqtt.topics: %w", err)
-				}
-			}
-			// If interval is set, update all steps with the interval value
-			if stepsRaw, ok := m["steps"]; ok {
-				var newSteps []map[string]interface{}
-				switch steps := stepsRaw.(type) {
-				case []map[string]interface{}:
-					newSteps = make([]map[string]interface{}, len(steps))
-					for i, stepMap := range steps {
-						stepMap["script"] = scriptPath
-						if interval != "" {
-							stepMap["interval"] = interval
-						}
-						newSteps[i] = stepMap
-					}
-				case []interface{}:
-					newSteps = make([]map[string]interface{}, len(steps))
-					for i, s := range steps {
-						if stageMap, ok := s.(map[string]interface{}); ok {
-							stageMap["script"] = scriptPath
-							if interval != "" {
-								stageMap["interval"] = interval
-							}
-							newSteps[i] = stageMap
-						}
-					}
-				}
-				m["steps"] = newSteps
-			}
-			f, err := os.Create(tomlPath)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			if err := toml.NewEncoder(f).Encode(m); err != nil {
-				return err
-			}
-			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s deployed at %s\n", instanceName, tomlPath)
-			return nil
-		} else {
-			// Fallback: create minimal config
-			var intervalPtr *string
-			if interval != "" {
-				intervalPtr = &interval
-			}
-			data := map[string]interface{}{
-				"steps": []map[string]interface{}{
-					{
-						"script":   scriptPath,
-						"interval": intervalPtr,
-					},
-				},
-			}
-			if len(topics) > 0 {
-				if err := maputil.SetNestedMapValue(data, []string{"input", "mqtt", "topics"}, topics); err != nil {
-					return fmt.Errorf("failed to set input.mqtt.topics: %w", err)
-				}
-			}
-			f, err := os.Create(tomlPath)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			if err := toml.NewEncoder(f).Encode(data); err != nil {
-				return err
-			}
-			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s deployed at %s\n", instanceName, tomlPath)
-			return nil
-		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s deployed at %s\n", instanceName, tomlPath)
+		autoPublishStatus(cmd, cfg)
+		return reloadRuntime(cmd, cfg, reload.Change{Action: reload.ActionDeploy, Name: instanceName, Path: tomlPath})
 	},
 }
 
@@ -425,14 +336,9 @@ $ tedge-oscar flows instances remove myinstance`,
 		if err != nil {
 			return nil, cobra.ShellCompDirectiveNoFileComp
 		}
-		deployDir := cfg.DeployDir
-		if deployDir == "" {
-			deployDir = os.Getenv("DEPLOY_DIR")
-		}
-		if deployDir == "" {
-			deployDir = filepath.Join(filepath.Dir(cfg.ImageDir), "deployments")
-		}
-		entries, err := os.ReadDir(deployDir)
+		deployDir := cfg.GetDeployDir()
+		// Include disabled instances as they can also be removed
+		entries, err := instance.List(deployDir)
 		if err != nil {
 			return nil, cobra.ShellCompDirectiveNoFileComp
 		}
@@ -442,10 +348,7 @@ $ tedge-oscar flows instances remove myinstance`,
 			provided[arg] = struct{}{}
 		}
 		for _, entry := range entries {
-			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".toml") {
-				continue
-			}
-			name := strings.TrimSuffix(entry.Name(), ".toml")
+			name := entry.Name
 			if _, already := provided[name]; already {
 				continue
 			}
@@ -464,38 +367,27 @@ $ tedge-oscar flows instances remove myinstance`,
 		if err != nil {
 			return err
 		}
-		deployDir := cfg.DeployDir
-		if deployDir == "" {
-			deployDir = os.Getenv("DEPLOY_DIR")
-		}
-		if deployDir == "" {
-			deployDir = filepath.Join(filepath.Dir(cfg.ImageDir), "deployments")
+		deployDir := cfg.GetDeployDir()
+		unlock, err := lockDirs(cmd, cfg, filelock.Exclusive, deployDir)
+		if err != nil {
+			return err
 		}
+		defer unlock()
 		instanceName := args[0]
-		// Find the matching file by instance name (basename without .toml)
-		var matchFile string
-		entries, err := os.ReadDir(deployDir)
-		if err != nil {
-			return fmt.Errorf("failed to read deploy dir: %w", err)
+		// Remove the instance whether it is enabled or disabled
+		removed, err := instance.Remove(deployDir, instanceName)
+		for _, matchFile := range removed {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s removed (%s)\n", instanceName, matchFile)
 		}
-		for _, entry := range entries {
-			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".toml") {
-				continue
-			}
-			if strings.TrimSuffix(entry.Name(), ".toml") == instanceName {
-				matchFile = filepath.Join(deployDir, entry.Name())
-				break
-			}
+		if err != nil {
+			return err
 		}
-		if matchFile == "" {
+		if len(removed) == 0 {
 			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s does not exist, skipping removal.\n", instanceName)
 			return nil
 		}
-		if err := os.Remove(matchFile); err != nil {
-			return fmt.Errorf("failed to remove instance file: %w", err)
-		}
-		fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s removed (%s)\n", instanceName, matchFile)
-		return nil
+		autoPublishStatus(cmd, cfg)
+		return reloadRuntime(cmd, cfg, reload.Change{Action: reload.ActionRemove, Name: instanceName, Path: removed[0]})
 	},
 }
 
@@ -512,9 +404,16 @@ func init() {
 	instancesCmd.AddCommand(listInstancesCmd)
 	instancesCmd.AddCommand(deployCmd)
 	instancesCmd.AddCommand(removeInstanceCmd)
+	for _, c := range []*cobra.Command{deployCmd, removeInstanceCmd} {
+		c.Flags().Bool("no-reload", false, "Don't run the reload hook of the flows runtime")
+	}
 
 	deployCmd.Flags().String("interval", "", "Interval in seconds (optional)")
 	deployCmd.Flags().StringArray("topics", nil, "Input topics (repeatable, optional)")
+	deployCmd.Flags().String("update-policy", "", "How \"tedge-oscar watch\" updates the instance: none, patch, minor or digest")
+	_ = deployCmd.RegisterFlagCompletionFunc("update-policy", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return watch.Policies, cobra.ShellCompDirectiveNoFileComp
+	})
 	_ = deployCmd.RegisterFlagCompletionFunc("topics", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		// Common thin-edge.io MQTT topics
 		commonTopics := []string{
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/reload"
+)
+
+var enableInstanceCmd = &cobra.Command{
+	Use:   "enable [instance_name]",
+	Short: "Enable a disabled flow instance",
+	Example: `# Enable a previously disabled instance
+$ tedge-oscar flows instances enable myinstance`,
+	Args:              cobra.ExactArgs(1),
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstancesByStatus(instance.StatusDisabled),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setInstanceEnabled(cmd, args[0], true)
+	},
+}
+
+var disableInstanceCmd = &cobra.Command{
+	Use:   "disable [instance_name]",
+	Short: "Disable a flow instance without removing its configuration",
+	Long: `Disable a flow instance without removing its configuration.
+
+The instance file is renamed so that it is no longer loaded by tedge-flows,
+but it is still shown by "instances list" and can be enabled again later.`,
+	Example: `# Temporarily pause an instance
+$ tedge-oscar flows instances disable myinstance`,
+	Args:              cobra.ExactArgs(1),
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstancesByStatus(instance.StatusEnabled),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setInstanceEnabled(cmd, args[0], false)
+	},
+}
+
+func setInstanceEnabled(cmd *cobra.Command, instanceName string, enabled bool) error {
+	cfgPath := configPath
+	if cfgPath == "" {
+		cfgPath = config.DefaultConfigPath()
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		return err
+	}
+	deployDir := cfg.GetDeployDir()
+	unlock, err := lockDirs(cmd, cfg, filelock.Exclusive, deployDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status := instance.StatusDisabled
+	if enabled {
+		status = instance.StatusEnabled
+	}
+	changed, err := instance.SetEnabled(deployDir, instanceName, enabled)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s is already %s.\n", instanceName, status)
+		return nil
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s %s\n", instanceName, status)
+	autoPublishStatus(cmd, cfg)
+	action := reload.ActionDisable
+	if enabled {
+		action = reload.ActionEnable
+	}
+	return reloadRuntime(cmd, cfg, reload.Change{
+		Action: action,
+		Name:   instanceName,
+		Path:   filepath.Join(deployDir, instance.FileName(instanceName, enabled)),
+	})
+}
+
+// completeInstancesByStatus completes the names of instances with the given status, or of
+// all instances if status is empty
+func completeInstancesByStatus(status string) func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) != 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		entries, err := instance.List(cfg.GetDeployDir())
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var completions []string
+		for _, entry := range entries {
+			if (status == "" || entry.Status() == status) && strings.HasPrefix(entry.Name, toComplete) {
+				completions = append(completions, entry.Name)
+			}
+		}
+		return completions, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+func init() {
+	instancesCmd.AddCommand(enableInstanceCmd)
+	instancesCmd.AddCommand(disableInstanceCmd)
+	for _, c := range []*cobra.Command{enableInstanceCmd, disableInstanceCmd} {
+		c.Flags().Bool("no-reload", false, "Don't run the reload hook of the flows runtime")
+	}
+}
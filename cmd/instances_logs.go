@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/logs"
+)
+
+var instanceLogsCmd = &cobra.Command{
+	Use:     "logs [instance_name]",
+	Aliases: []string{"tail"},
+	Short:   "Show the log lines of the flows runtime for an instance",
+	Long: `Show the log lines of the flows runtime for an instance.
+
+Lines are selected if they mention the instance file (e.g. counter1.toml) in the
+deploy_dir. The logs are read from the source configured in the [logs] section of the
+config, which can be overridden with --source:
+
+  journald  journalctl of the systemd unit logs.unit (default: tedge-flows)
+  file      the log file logs.file
+  mqtt      debug messages published on the topic filter logs.topic. Messages are
+            only received while subscribed, so this source always follows.`,
+	Example: `# Show the logs of an instance from the last 10 minutes
+$ tedge-oscar flows instances logs myinstance --since 10m
+
+# Follow the logs as JSON lines
+$ tedge-oscar flows instances logs myinstance -f -o json`,
+	Args:              cobra.ExactArgs(1),
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstancesByStatus(""),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		instanceName := args[0]
+		if err := instance.ValidateName(instanceName); err != nil {
+			return err
+		}
+		follow, _ := cmd.Flags().GetBool("follow")
+		output, _ := cmd.Flags().GetString("output")
+		sourceKind, _ := cmd.Flags().GetString("source")
+		if output != "text" && output != "json" {
+			return fmt.Errorf("invalid output format %q, expected text or json", output)
+		}
+		opts := logs.Options{
+			Instance: instanceName,
+			Match:    logs.Matcher(filepath.Join(cfg.GetDeployDir(), instance.FileName(instanceName, true))),
+			Follow:   follow,
+		}
+		if since, _ := cmd.Flags().GetString("since"); since != "" {
+			if opts.Since, err = logs.ParseSince(since, time.Now()); err != nil {
+				return err
+			}
+		}
+		source, err := logs.NewSource(cfg, sourceKind)
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		out := cmd.OutOrStdout()
+		enc := json.NewEncoder(out)
+		return source.Read(ctx, opts, func(entry logs.Entry) error {
+			if output == "json" {
+				return enc.Encode(entry)
+			}
+			_, err := fmt.Fprintln(out, entry.String())
+			return err
+		})
+	},
+}
+
+func init() {
+	instanceLogsCmd.Flags().BoolP("follow", "f", false, "Keep printing new log lines")
+	instanceLogsCmd.Flags().String("since", "", "Only show lines newer than a duration (e.g. 10m) or a timestamp (e.g. 2025-01-02T15:04:05Z)")
+	instanceLogsCmd.Flags().StringP("output", "o", "text", "Output format: text|json (one object per line)")
+	instanceLogsCmd.Flags().String("source", "", "Log source: journald|file|mqtt (overrides logs.source in config)")
+	_ = instanceLogsCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"text", "json"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	_ = instanceLogsCmd.RegisterFlagCompletionFunc("source", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{logs.SourceJournald, logs.SourceFile, logs.SourceMQTT}, cobra.ShellCompDirectiveNoFileComp
+	})
+	instancesCmd.AddCommand(instanceLogsCmd)
+}
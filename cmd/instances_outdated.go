@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+)
+
+var outdatedInstancesCmd = &cobra.Command{
+	Use:   "outdated [instance_name...]",
+	Short: "Show the flow instances for which newer images are available",
+	Long: `Show the flow instances for which newer images are available.
+
+The tags of the image repositories are queried once per repository, and the current version
+of each instance is compared with the latest version and the latest version within its
+allowed range (see "instances upgrade --to-latest"). An instance is also outdated if its tag
+now points to another digest than the pulled one, e.g. for a moving tag like "latest".
+
+Registries which can't be reached are reported per instance without failing the report.`,
+	Example: `# Show the outdated instances
+$ tedge-oscar flows instances outdated
+
+# Show all instances, as JSON lines for monitoring
+$ tedge-oscar flows instances outdated --all -o jsonl`,
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstancesByStatus(""),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Set debugHTTP based on logLevel
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		outputFormat, _ := cmd.Flags().GetString("output")
+		all, _ := cmd.Flags().GetBool("all")
+
+		deployDir := cfg.GetDeployDir()
+		unlock, err := lockDirs(cmd, cfg, filelock.Shared, cfg.ImageDir, deployDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		var entries []instance.Entry
+		if len(args) == 0 {
+			if entries, err = instance.List(deployDir); err != nil {
+				return fmt.Errorf("failed to read deploy dir: %w", err)
+			}
+		}
+		for _, name := range args {
+			entry, err := instance.Find(deployDir, name)
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				return fmt.Errorf("instance %s not found", name)
+			}
+			entries = append(entries, *entry)
+		}
+		updates, err := instance.CheckUpdates(cfg, entries)
+		if err != nil {
+			return err
+		}
+
+		var rows []instance.Update
+		for _, u := range updates {
+			if u.Error != "" {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Could not check instance %s: %s\n", u.Instance, u.Error)
+			}
+			if all || u.Outdated || u.Error != "" {
+				rows = append(rows, u)
+			}
+		}
+		if outputFormat == "jsonl" || outputFormat == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetEscapeHTML(false)
+			for _, u := range rows {
+				_ = enc.Encode(u)
+			}
+			return nil
+		}
+		if len(rows) == 0 {
+			fmt.Fprintln(cmd.ErrOrStderr(), "All flow instances are up to date.")
+			return nil
+		}
+		table := tablewriter.NewTable(cmd.OutOrStdout())
+		table.Header("instance", "repository", "current", "latestInRange", "latest", "range", "digestChanged")
+		for _, u := range rows {
+			latestInRange, latest := u.LatestInRange, u.Latest
+			if u.Error != "" {
+				latestInRange, latest = "<error>", "<error>"
+			}
+			_ = table.Append([]string{u.Instance, u.Repository, u.Current, latestInRange, latest, u.Range, strconv.FormatBool(u.DigestChanged)})
+		}
+		table.Render()
+		return nil
+	},
+}
+
+func init() {
+	defaultOutput := "jsonl"
+	if util.Isatty(os.Stdout.Fd()) {
+		defaultOutput = "table"
+	}
+	outdatedInstancesCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|jsonl")
+	outdatedInstancesCmd.Flags().Bool("all", false, "Show all instances deployed from an image, not only the outdated ones")
+	_ = outdatedInstancesCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"table", "jsonl"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	instancesCmd.AddCommand(outdatedInstancesCmd)
+}
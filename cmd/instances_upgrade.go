@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/reload"
+)
+
+var upgradeInstanceCmd = &cobra.Command{
+	Use:   "upgrade [instance_name...]",
+	Short: "Upgrade flow instances to a newer image",
+	Long: `Upgrade flow instances to a newer image.
+
+With --to-latest, the tags of the image repository are listed and an instance is upgraded to
+the highest version within its allowed range: the version range it was deployed with (e.g.
+"instances deploy myinstance 'ghcr.io/thin-edge/counter:^1.2'"), or else the patch releases
+of its current version. The range can be changed with --range, which is then recorded for
+later upgrades. Without instance names, all instances are upgraded.
+
+The topics, interval and step config of an instance are kept, as well as its status.`,
+	Example: `# Roll out the patch releases (or the releases within the deployed version range)
+$ tedge-oscar flows instances upgrade --to-latest
+
+# Show which instances would be upgraded
+$ tedge-oscar flows instances upgrade --to-latest --dry-run
+
+# Allow an upgrade to the next minor versions
+$ tedge-oscar flows instances upgrade myinstance --to-latest --range '^1.2'
+
+# Upgrade to a specific image
+$ tedge-oscar flows instances upgrade myinstance --image ghcr.io/thin-edge/connectivity-counter:2.0`,
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstancesByStatus(""),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Set debugHTTP based on logLevel
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		toLatest, _ := cmd.Flags().GetBool("to-latest")
+		image, _ := cmd.Flags().GetString("image")
+		versionRange, _ := cmd.Flags().GetString("range")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if toLatest == (image != "") {
+			return fmt.Errorf("either --to-latest or --image must be specified")
+		}
+		if image != "" && len(args) == 0 {
+			return fmt.Errorf("the instances to upgrade must be specified with --image")
+		}
+
+		deployDir := cfg.GetDeployDir()
+		mode := filelock.Exclusive
+		if dryRun {
+			mode = filelock.Shared
+		}
+		// The image may need to be pulled, so lock both directories (always image_dir first)
+		unlock, err := lockDirs(cmd, cfg, mode, cfg.ImageDir, deployDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		var entries []instance.Entry
+		if len(args) == 0 {
+			if entries, err = instance.List(deployDir); err != nil {
+				return fmt.Errorf("failed to list instances: %w", err)
+			}
+		}
+		for _, name := range args {
+			entry, err := instance.Find(deployDir, name)
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				return fmt.Errorf("instance %s not found", name)
+			}
+			entries = append(entries, *entry)
+		}
+
+		var reloads []reload.Change
+		upgraded, failed := 0, 0
+		for _, entry := range entries {
+			current, err := instance.Read(entry.Path)
+			if err != nil {
+				return fmt.Errorf("failed to read instance %s: %w", entry.Name, err)
+			}
+			metadata := current.Metadata
+			if metadata.Image == "" {
+				if len(args) > 0 {
+					return fmt.Errorf("instance %s was not deployed from an image", entry.Name)
+				}
+				continue
+			}
+			target := image
+			// Keep the recorded range, unless another one is given or a specific image is deployed
+			keepRange := versionRange
+			if toLatest {
+				allowed := versionRange
+				if allowed == "" {
+					if allowed, err = instance.AllowedRange(metadata); err != nil {
+						fmt.Fprintf(cmd.ErrOrStderr(), "Skipping instance %s: %v\n", entry.Name, err)
+						failed++
+						continue
+					}
+					keepRange = metadata.VersionRange
+				}
+				resolved, upgrade, err := instance.LatestImage(cfg, metadata.Image, allowed)
+				if err != nil {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Skipping instance %s: %v\n", entry.Name, err)
+					failed++
+					continue
+				}
+				if !upgrade {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s is up to date (%s, allowed range %s)\n", entry.Name, metadata.Image, allowed)
+					continue
+				}
+				target = resolved.ImageRef
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Upgrading instance %s from %s to %s\n", entry.Name, metadata.Image, target)
+			if dryRun {
+				continue
+			}
+			tomlPath, err := instance.Upgrade(cfg, entry, target, keepRange, cmd.ErrOrStderr())
+			if err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Failed to upgrade instance %s: %v\n", entry.Name, err)
+				failed++
+				continue
+			}
+			upgraded++
+			if entry.Enabled {
+				reloads = append(reloads, reload.Change{Action: reload.ActionDeploy, Name: entry.Name, Path: tomlPath})
+			}
+		}
+
+		if upgraded > 0 {
+			autoPublishStatus(cmd, cfg)
+		}
+		for _, change := range reloads {
+			if err := reloadRuntime(cmd, cfg, change); err != nil {
+				return err
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d instances could not be upgraded", failed, len(entries))
+		}
+		return nil
+	},
+}
+
+func init() {
+	upgradeInstanceCmd.Flags().Bool("to-latest", false, "Upgrade to the highest version within the allowed version range")
+	upgradeInstanceCmd.Flags().String("image", "", "Upgrade to a specific image (or version range)")
+	upgradeInstanceCmd.Flags().String("range", "", "Version range to upgrade within, e.g. '^1.2' (default: the recorded range, or the patch releases of the current version)")
+	upgradeInstanceCmd.Flags().Bool("dry-run", false, "Only show which instances would be upgraded")
+	upgradeInstanceCmd.Flags().Bool("no-reload", false, "Don't run the reload hook of the flows runtime")
+	instancesCmd.AddCommand(upgradeInstanceCmd)
+}
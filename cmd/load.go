@@ -2,12 +2,12 @@ package cmd
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
 	"github.com/thin-edge/tedge-oscar/internal/imagepull"
 )
 
@@ -17,27 +17,29 @@ var loadCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		source := args[0]
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		unlock, err := lockDirs(cmd, cfg, filelock.Exclusive, cfg.ImageDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		outputDir, _ := cmd.Flags().GetString("output-dir")
 		if outputDir == "" {
-			cfgPath := configPath
-			if cfgPath == "" {
-				cfgPath = config.DefaultConfigPath()
-			}
-			cfg, err := config.LoadConfig(cfgPath)
-			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
-			}
 			name, err := artifact.ParseName(source, false)
 			if err != nil {
 				return err
 			}
 			outputDir = filepath.Join(cfg.ImageDir, name)
 		}
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return fmt.Errorf("failed to create output dir: %w", err)
-		}
 		fmt.Fprintf(cmd.ErrOrStderr(), "Loading image from %s to %s\n", source, outputDir)
-		if err := imagepull.LoadTarballImage(source, outputDir); err != nil {
+		if err := imagepull.LoadTarballImage(cfg, source, outputDir); err != nil {
 			return fmt.Errorf("failed to load image: %w", err)
 		}
 		fmt.Fprintf(cmd.OutOrStdout(), "Image loaded to %s\n", outputDir)
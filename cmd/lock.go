@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+)
+
+// lockDirs takes an advisory lock on each directory (in the given order) so that concurrent
+// invocations (SM plugins, cron jobs, operators) don't modify the same folders at once.
+// The returned function releases all of the locks.
+func lockDirs(cmd *cobra.Command, cfg *config.Config, mode filelock.Mode, dirs ...string) (func(), error) {
+	timeout, err := cfg.GetLockTimeout()
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Flags().Changed("lock-timeout") {
+		timeout = lockTimeout
+	}
+	return filelock.AcquireAll(dirs, mode, timeout, cmd.ErrOrStderr())
+}
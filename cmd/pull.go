@@ -1,21 +1,50 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
 	"github.com/thin-edge/tedge-oscar/internal/imagepull"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/util"
 )
 
 var pullCmd = &cobra.Command{
-	Use:     "pull [image]",
-	Short:   "Pull a flow image from an OCI registry",
-	Example: `tedge-oscar flows images pull ghcr.io/thin-edge/connectivity-counter:1.0`,
-	Args:    cobra.ExactArgs(1),
+	Use:   "pull [image]",
+	Short: "Pull a flow image from an OCI registry",
+	Long: `Pull a flow image from an OCI registry.
+
+Instead of a tag, the image can have a version range (^1.2, ~1.2, ">=1.0 <2", ...), in which
+case the highest tag of the repository which matches the range is pulled. The resolved tag
+is the version of the pulled image.
+
+The layers are downloaded to a hidden folder in the image_dir first. A failed download is
+retried with an exponential backoff, and resumed where it stopped if the registry supports
+range requests, also by the next pull if all retries failed. The progress of each layer is
+shown as a progress bar on a terminal, and as JSON lines otherwise.
+
+Images which are larger than max_image_size (the sum of the layers in the manifest) are
+refused before anything is downloaded, unless --force is used. The transfer rate can be
+capped with --limit-rate or limit_rate, e.g. on metered links.`,
+	Example: `# Pull a tag
+tedge-oscar flows images pull ghcr.io/thin-edge/connectivity-counter:1.0
+
+# Pull the latest 1.x version from 1.2 on
+tedge-oscar flows images pull 'ghcr.io/thin-edge/connectivity-counter:^1.2'
+
+# Pull over a flaky link, giving up after 10 minutes
+tedge-oscar flows images pull ghcr.io/thin-edge/connectivity-counter:1.0 --retries 10 --timeout 10m
+
+# Pull at most 200 KiB per second, even if the image is larger than max_image_size
+tedge-oscar flows images pull ghcr.io/thin-edge/connectivity-counter:1.0 --limit-rate 200k --force`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Enable debug HTTP if logLevel is debug
 		registryauth.SetDebugHTTP(logLevel)
@@ -27,7 +56,19 @@ var pullCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
-		imageRef := args[0]
+		unlock, err := lockDirs(cmd, cfg, filelock.Exclusive, cfg.ImageDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		resolved, err := imagepull.ResolveImageRef(cfg, args[0])
+		if err != nil {
+			return err
+		}
+		imageRef := resolved.ImageRef
+		if resolved.Range != "" {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Version range %s resolved to %s (%s)\n", resolved.Range, resolved.Tag, resolved.Digest)
+		}
 		outputDir, _ := cmd.Flags().GetString("output-dir")
 		if outputDir == "" {
 			name, err := artifact.ParseName(imageRef, false)
@@ -36,7 +77,35 @@ var pullCmd = &cobra.Command{
 			}
 			outputDir = filepath.Join(cfg.ImageDir, name)
 		}
-		if err := imagepull.PullImage(cfg, imageRef, outputDir, "", false); err != nil {
+		opts := imagepull.Options{}
+		opts.Retries, _ = cmd.Flags().GetInt("retries")
+		if opts.Retries == 0 {
+			// 0 means the default for imagepull.Options
+			opts.Retries = -1
+		}
+		opts.Backoff, _ = cmd.Flags().GetDuration("retry-backoff")
+		opts.Timeout, _ = cmd.Flags().GetDuration("timeout")
+		progress, _ := cmd.Flags().GetString("progress")
+		switch progress {
+		case "auto":
+			if util.Isatty(os.Stderr.Fd()) {
+				opts.Progress = imagepull.NewBarProgress(cmd.ErrOrStderr())
+			} else {
+				opts.Progress = imagepull.NewJSONProgress(cmd.ErrOrStderr())
+			}
+		case "bar":
+			opts.Progress = imagepull.NewBarProgress(cmd.ErrOrStderr())
+		case "json":
+			opts.Progress = imagepull.NewJSONProgress(cmd.ErrOrStderr())
+		case "none":
+		default:
+			return fmt.Errorf("invalid --progress %q, expected one of: auto, bar, json, none", progress)
+		}
+		opts.Force, _ = cmd.Flags().GetBool("force")
+		if err := imagepull.PullImage(cfg, imageRef, outputDir, opts); err != nil {
+			if errors.Is(err, imagepull.ErrImageTooLarge) {
+				return fmt.Errorf("%w (use --force to pull it anyway)", err)
+			}
 			return err
 		}
 		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pulled to %s\n", imageRef, outputDir)
@@ -46,5 +115,13 @@ var pullCmd = &cobra.Command{
 
 func init() {
 	pullCmd.Flags().String("output-dir", "", "Directory to download the artifact contents to (default: config image_dir)")
+	pullCmd.Flags().Int("retries", imagepull.DefaultRetries, "How often a failed download of a layer is retried")
+	pullCmd.Flags().Duration("retry-backoff", imagepull.DefaultBackoff, "Delay before the first retry, doubled with each retry")
+	pullCmd.Flags().Duration("timeout", 0, "Maximum duration of the pull, e.g. 10m (default: no timeout)")
+	pullCmd.Flags().String("progress", "auto", "Progress output: auto (a bar on a terminal, JSON lines otherwise), bar, json or none")
+	pullCmd.Flags().Bool("force", false, "Pull the image even if it is larger than max_image_size")
+	_ = pullCmd.RegisterFlagCompletionFunc("progress", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"auto", "bar", "json", "none"}, cobra.ShellCompDirectiveNoFileComp
+	})
 	imagesCmd.AddCommand(pullCmd)
 }
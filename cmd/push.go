@@ -2,18 +2,56 @@ package cmd
 
 import (
 	"fmt"
+	"maps"
 
 	"github.com/spf13/cobra"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/fileset"
 	"github.com/thin-edge/tedge-oscar/internal/imagepush"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/variant"
 )
 
 var pushCmd = &cobra.Command{
-	Use:     "push [image]",
-	Short:   "Push a flow image to an OCI registry",
-	Example: `tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --file flow.json --file README.md`,
-	Args:    cobra.ExactArgs(1),
+	Use:   "push [image]",
+	Short: "Push a flow image to an OCI registry",
+	Long: `Push a flow image to an OCI registry.
+
+The image is built deterministically: the layers are sorted by path and the creation
+time is taken from the SOURCE_DATE_EPOCH environment variable if it is set, so pushing
+the same files twice results in the same digest. The digest of the pushed image is
+printed on stdout.
+
+The standard OCI annotations are set automatically: the version (from the tag), the
+creation time, the source and revision (from git), and the description and licenses
+(from the description and license fields of flow.toml, or the first paragraph of
+README.md). They can be overridden with --annotation-file and --annotation.
+
+With --variant, an OCI image index is pushed with one manifest per variant directory. Each
+variant is annotated with its requirements: io.thin-edge.flow.runtime is a version constraint
+on the thin-edge.io version, other io.thin-edge.flow.<label> annotations must be equal to the
+platform labels of the config. A pull selects the variant which matches the device.`,
+	Example: `# Push individual files
+tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --file flow.json --file README.md
+
+# Push a directory, skipping the files listed in its .flowignore
+tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --file flow.toml --file dist --exclude '*.map'
+
+# Push the output of "flows build"
+tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --dir build
+
+# Push an OCI image layout created by "flows build --format oci"
+tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --oci-layout counter.oci
+
+# Push a multi-variant image, pulled according to the tedge version of the device
+tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --variant 'build/current:runtime=>=1.5' --variant 'build/legacy:runtime=<1.5'
+
+# Add custom annotations
+tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --dir build --annotation org.opencontainers.image.vendor=thin-edge.io
+
+# Check that the image is reproducible
+SOURCE_DATE_EPOCH=$(git log -1 --format=%ct) tedge-oscar flows images push ghcr.io/thin-edge/connectivity-counter:1.0 --dir build --check-reproducible`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Set debugHTTP based on logLevel
 		registryauth.SetDebugHTTP(logLevel)
@@ -28,27 +66,129 @@ var pushCmd = &cobra.Command{
 		imageRef := args[0]
 		ociType, _ := cmd.Flags().GetString("type")
 		if ociType == "" {
-			ociType = "application/vnd.tedge.flow.v1"
+			ociType = imagepush.DefaultArtifactType
 		}
 		files, _ := cmd.Flags().GetStringArray("file")
-		if len(files) == 0 {
-			return fmt.Errorf("at least one --file must be specified to include in the artifact")
+		dir, _ := cmd.Flags().GetString("dir")
+		layoutDir, _ := cmd.Flags().GetString("oci-layout")
+		if layoutDir != "" {
+			if len(files) > 0 || dir != "" || cmd.Flags().Changed("variant") || cmd.Flags().Changed("annotation") || cmd.Flags().Changed("annotation-file") {
+				return fmt.Errorf("--oci-layout cannot be combined with --file, --dir, --variant or annotations")
+			}
+			layoutTag, _ := cmd.Flags().GetString("layout-tag")
+			if err := imagepush.PushLayout(cfg, imageRef, layoutDir, layoutTag); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pushed to registry from OCI layout %s (%s)\n", imageRef, layoutDir, layoutTag)
+			return nil
 		}
 		rootDir, _ := cmd.Flags().GetString("root")
 		if rootDir == "" {
 			rootDir = "."
 		}
-		if err := imagepush.PushImage(cfg, imageRef, ociType, files, rootDir); err != nil {
+		include, _ := cmd.Flags().GetStringArray("include")
+		exclude, _ := cmd.Flags().GetStringArray("exclude")
+		filesetOpts := fileset.Options{Include: include, Exclude: exclude}
+		variantSpecs, _ := cmd.Flags().GetStringArray("variant")
+		var variants []imagepush.Variant
+		if len(variantSpecs) > 0 {
+			if len(files) > 0 || dir != "" {
+				return fmt.Errorf("--variant cannot be combined with --file or --dir")
+			}
+			for _, spec := range variantSpecs {
+				variantDir, requirements, err := variant.ParseSpec(spec)
+				if err != nil {
+					return err
+				}
+				variantFiles, err := fileset.Expand(variantDir, []string{variantDir}, filesetOpts)
+				if err != nil {
+					return err
+				}
+				if len(variantFiles) == 0 {
+					return fmt.Errorf("no files to include in variant %s", variantDir)
+				}
+				variants = append(variants, imagepush.Variant{Files: variantFiles, RootDir: variantDir, Annotations: requirements})
+			}
+			// The default annotations (description, license) are read from the first variant
+			rootDir = variants[0].RootDir
+		} else {
+			if dir != "" {
+				if len(files) > 0 {
+					return fmt.Errorf("--dir cannot be combined with --file")
+				}
+				files = []string{dir}
+				rootDir = dir
+			}
+			if len(files) == 0 {
+				return fmt.Errorf("at least one --file must be specified to include in the artifact")
+			}
+			if files, err = fileset.Expand(rootDir, files, filesetOpts); err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return fmt.Errorf("no files to include in the artifact, check the --include/--exclude globs and %s", fileset.IgnoreFile)
+			}
+		}
+		annotations := imagepush.DefaultAnnotations(imageRef, rootDir)
+		if annotationFile, _ := cmd.Flags().GetString("annotation-file"); annotationFile != "" {
+			fromFile, err := imagepush.ReadAnnotationFile(annotationFile)
+			if err != nil {
+				return err
+			}
+			maps.Copy(annotations, fromFile)
+		}
+		annotationValues, _ := cmd.Flags().GetStringArray("annotation")
+		fromFlags, err := imagepush.ParseAnnotations(annotationValues)
+		if err != nil {
+			return err
+		}
+		maps.Copy(annotations, fromFlags)
+		archive, _ := cmd.Flags().GetBool("archive")
+		opts := imagepush.PackOptions{ArtifactType: ociType, Archive: archive, Annotations: annotations}
+		if len(variants) > 0 {
+			if cmd.Flags().Changed("check-reproducible") {
+				return fmt.Errorf("--check-reproducible cannot be combined with --variant")
+			}
+			desc, err := imagepush.PushIndex(cfg, imageRef, variants, opts)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pushed to registry as type %s with %d variants\n", imageRef, ociType, len(variants))
+			fmt.Fprintln(cmd.OutOrStdout(), desc.Digest)
+			return nil
+		}
+		if checkReproducible, _ := cmd.Flags().GetBool("check-reproducible"); checkReproducible {
+			desc, err := imagepush.CheckReproducible(imageRef, files, rootDir, opts)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s is reproducible\n", imageRef)
+			fmt.Fprintln(cmd.OutOrStdout(), desc.Digest)
+			return nil
+		}
+		desc, err := imagepush.PushImage(cfg, imageRef, files, rootDir, opts)
+		if err != nil {
 			return err
 		}
 		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pushed to registry as type %s with files: %v (root: %s)\n", imageRef, ociType, files, rootDir)
+		fmt.Fprintln(cmd.OutOrStdout(), desc.Digest)
 		return nil
 	},
 }
 
 func init() {
 	pushCmd.Flags().String("type", "", "OCI artifact type (default: application/vnd.tedge.flow.v1)")
-	pushCmd.Flags().StringArray("file", nil, "File(s) to include in the artifact (repeatable)")
+	pushCmd.Flags().StringArray("file", nil, "File(s) or directories to include in the artifact (repeatable)")
 	pushCmd.Flags().String("root", ".", "Root directory for path preservation inside the artifact (default: current working directory)")
+	pushCmd.Flags().String("dir", "", "Push all files of a directory, e.g. the output of \"flows build\" (replaces --file and --root)")
+	pushCmd.Flags().String("oci-layout", "", "Push an image from an OCI image layout, e.g. created by \"flows build --format oci\"")
+	pushCmd.Flags().String("layout-tag", "latest", "Tag of the image in the OCI layout")
+	pushCmd.Flags().StringArray("include", nil, "Only include files matching the glob (repeatable)")
+	pushCmd.Flags().StringArray("exclude", nil, "Exclude files and directories matching the glob (repeatable)")
+	pushCmd.Flags().StringArray("variant", nil, "Push a multi-variant image, with a variant as dir[:name=value;...], e.g. 'build:runtime=>=1.5;device-class=gateway' (repeatable)")
+	pushCmd.Flags().Bool("archive", false, "Pack all files into a single tar+gzip layer, which is unpacked on pull")
+	pushCmd.Flags().StringArray("annotation", nil, "Manifest annotation as key=value, an empty value removes a default annotation (repeatable)")
+	pushCmd.Flags().String("annotation-file", "", "JSON file with manifest annotations")
+	pushCmd.Flags().Bool("check-reproducible", false, "Build the image twice and compare the manifest digests instead of pushing it")
 	imagesCmd.AddCommand(pushCmd)
 }
@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagepush"
+	"github.com/thin-edge/tedge-oscar/internal/referrers"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+	"github.com/thin-edge/tedge-oscar/internal/variant"
+)
+
+var attachCmd = &cobra.Command{
+	Use:   "attach [image]",
+	Short: "Attach an artifact (SBOM, changelog, README, ...) to a flow image in an OCI registry",
+	Long: `Attach an artifact (SBOM, changelog, README, test results, ...) to a flow image in an OCI registry.
+
+The artifact is pushed as an OCI referrer of the image manifest, so the image itself is not
+modified and the artifact can be listed with "images referrers". Changelogs are recognized by
+the artifact type ` + referrers.ChangelogArtifactType + ` or a file named CHANGELOG*, SBOMs
+by the artifact types of SPDX, CycloneDX and Syft.`,
+	Example: `# Attach an SPDX SBOM
+$ tedge-oscar flows images attach ghcr.io/thin-edge/connectivity-counter:1.0 --artifact-type application/spdx+json --file sbom.json
+
+# Attach a changelog
+$ tedge-oscar flows images attach ghcr.io/thin-edge/connectivity-counter:1.0 --artifact-type ` + referrers.ChangelogArtifactType + ` --file CHANGELOG.md`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		artifactType, _ := cmd.Flags().GetString("artifact-type")
+		files, _ := cmd.Flags().GetStringArray("file")
+		annotationValues, _ := cmd.Flags().GetStringArray("annotation")
+		annotations, err := imagepush.ParseAnnotations(annotationValues)
+		if err != nil {
+			return err
+		}
+		repoRef, ref, err := registryauth.SplitRef(args[0])
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		repo, err := registryauth.NewRepository(cfg, repoRef, true)
+		if err != nil {
+			return err
+		}
+		desc, err := repo.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", args[0], err)
+		}
+		artifactDesc, err := referrers.Attach(ctx, repo, desc, artifactType, files, annotations)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Attached %s to %s (%s)\n", artifactType, args[0], desc.Digest)
+		fmt.Fprintln(cmd.OutOrStdout(), artifactDesc.Digest)
+		return nil
+	},
+}
+
+var referrersCmd = &cobra.Command{
+	Use:   "referrers [image]",
+	Short: "List or pull the artifacts attached to a flow image in an OCI registry",
+	Example: `# List the artifacts attached to an image
+$ tedge-oscar flows images referrers ghcr.io/thin-edge/connectivity-counter:1.0
+
+# Pull the SBOMs of an image, each into a folder named after its digest
+$ tedge-oscar flows images referrers ghcr.io/thin-edge/connectivity-counter:1.0 --artifact-type application/spdx+json --pull ./sbom`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		artifactType, _ := cmd.Flags().GetString("artifact-type")
+		pullDir, _ := cmd.Flags().GetString("pull")
+		outputFormat, _ := cmd.Flags().GetString("output")
+		repoRef, ref, err := registryauth.SplitRef(args[0])
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		repo, err := registryauth.NewRepository(cfg, repoRef, false)
+		if err != nil {
+			return err
+		}
+		desc, err := repo.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", args[0], err)
+		}
+		artifacts, err := referrers.List(ctx, repo, desc, artifactType)
+		if err != nil {
+			return err
+		}
+		if len(artifacts) == 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "No artifacts attached to %s (%s).\n", args[0], desc.Digest)
+			return nil
+		}
+		if pullDir != "" {
+			for _, a := range artifacts {
+				if a.Kind == referrers.KindSignature {
+					continue // signatures are checked with verify-signature
+				}
+				dir := filepath.Join(pullDir, a.Digest.Encoded()[:12])
+				if err := referrers.Pull(ctx, repo, a, dir); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "Pulled %s (%s) to %s\n", a.Digest, a.ArtifactType, dir)
+			}
+			return nil
+		}
+		if outputFormat == "jsonl" || outputFormat == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetEscapeHTML(false)
+			for _, a := range artifacts {
+				if err := enc.Encode(a); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		table := tablewriter.NewTable(cmd.OutOrStdout())
+		table.Header("digest", "kind", "artifactType", "created", "files")
+		for _, a := range artifacts {
+			_ = table.Append([]string{a.Digest.String(), a.Kind, a.ArtifactType, a.Created, fileNames(a.Files)})
+		}
+		table.Render()
+		return nil
+	},
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [image]",
+	Short: "Show the details of a flow image in an OCI registry, with its SBOM and changelog",
+	Example: `# Show the files, annotations and attached artifacts of an image
+$ tedge-oscar flows images inspect ghcr.io/thin-edge/connectivity-counter:1.0
+
+# Show which variant of a multi-variant image a device running tedge 1.4 would pull
+$ tedge-oscar flows images inspect ghcr.io/thin-edge/connectivity-counter:1.0 --tedge-version 1.4.0
+
+# Output the details as JSON
+$ tedge-oscar flows images inspect ghcr.io/thin-edge/connectivity-counter:1.0 -o json`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		outputFormat, _ := cmd.Flags().GetString("output")
+		if tedgeVersion, _ := cmd.Flags().GetString("tedge-version"); tedgeVersion != "" {
+			cfg.Platform.TedgeVersion = tedgeVersion
+		}
+		repoRef, ref, err := registryauth.SplitRef(args[0])
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		repo, err := registryauth.NewRepository(cfg, repoRef, false)
+		if err != nil {
+			return err
+		}
+		desc, err := repo.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", args[0], err)
+		}
+		img, err := referrers.Inspect(ctx, repo, args[0], desc)
+		if err != nil {
+			return err
+		}
+		if outputFormat == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			return enc.Encode(img)
+		}
+		printImage(cmd.OutOrStdout(), img, variant.LocalFacts(cfg))
+		return nil
+	},
+}
+
+// printImage writes the human readable details of an image. The variant which would be
+// pulled on a device with the facts is marked.
+func printImage(w io.Writer, img *referrers.Image, facts variant.Facts) {
+	fmt.Fprintf(w, "Image:         %s\n", img.Reference)
+	fmt.Fprintf(w, "Digest:        %s\n", img.Digest)
+	fmt.Fprintf(w, "Media type:    %s\n", img.MediaType)
+	if img.ArtifactType != "" {
+		fmt.Fprintf(w, "Artifact type: %s\n", img.ArtifactType)
+	}
+	if len(img.Annotations) > 0 {
+		fmt.Fprintln(w, "Annotations:")
+		keys := make([]string, 0, len(img.Annotations))
+		for k := range img.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s: %s\n", k, img.Annotations[k])
+		}
+	}
+	if len(img.Variants) > 0 {
+		index := ocispec.Index{}
+		for _, v := range img.Variants {
+			index.Manifests = append(index.Manifests, ocispec.Descriptor{Digest: v.Digest, Annotations: v.Annotations})
+		}
+		selected, _ := variant.Select(index, facts)
+		fmt.Fprintln(w, "Variants:")
+		for _, v := range img.Variants {
+			marker := ""
+			if v.Digest == selected.Digest {
+				marker = " (selected for this device)"
+			}
+			fmt.Fprintf(w, "  %s [%s]%s\n", v.Digest, variant.Describe(v.Annotations), marker)
+			printFiles(w, "    ", v.Files)
+		}
+	} else {
+		fmt.Fprintln(w, "Files:")
+		printFiles(w, "  ", img.Files)
+	}
+	fmt.Fprintf(w, "Signatures:    %d\n", len(img.Artifacts(referrers.KindSignature)))
+	printArtifacts(w, "SBOM", img.Artifacts(referrers.KindSBOM))
+	printArtifacts(w, "Other artifacts", img.Artifacts(referrers.KindOther))
+	if img.Changelog != "" {
+		fmt.Fprintln(w, "Changelog:")
+		for _, line := range strings.Split(strings.TrimRight(img.Changelog, "\n"), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	} else {
+		fmt.Fprintln(w, "Changelog:     none")
+	}
+}
+
+func printFiles(w io.Writer, indent string, files []referrers.File) {
+	for _, f := range files {
+		name := f.Name
+		if name == "" {
+			name = "(archive)"
+		}
+		fmt.Fprintf(w, "%s%s (%s, %d bytes)\n", indent, name, f.MediaType, f.Size)
+	}
+}
+
+func printArtifacts(w io.Writer, title string, artifacts []referrers.Artifact) {
+	if len(artifacts) == 0 {
+		fmt.Fprintf(w, "%s: none\n", title)
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, a := range artifacts {
+		fmt.Fprintf(w, "  %s %s %s\n", a.Digest, a.ArtifactType, fileNames(a.Files))
+	}
+}
+
+// fileNames returns the comma separated names of the files
+func fileNames(files []referrers.File) string {
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func init() {
+	attachCmd.Flags().String("artifact-type", "", "Artifact type, e.g. application/spdx+json")
+	attachCmd.Flags().StringArray("file", nil, "File to attach (repeatable)")
+	attachCmd.Flags().StringArray("annotation", nil, "Annotation key=value to add to the artifact manifest (repeatable)")
+	_ = attachCmd.MarkFlagRequired("artifact-type")
+	_ = attachCmd.MarkFlagRequired("file")
+
+	defaultOutput := "jsonl"
+	if util.Isatty(os.Stdout.Fd()) {
+		defaultOutput = "table"
+	}
+	referrersCmd.Flags().String("artifact-type", "", "Only list artifacts of this type")
+	referrersCmd.Flags().String("pull", "", "Pull the files of the artifacts into this directory, one folder per artifact")
+	referrersCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|jsonl")
+	inspectCmd.Flags().StringP("output", "o", "text", "Output format: text|json")
+	inspectCmd.Flags().String("tedge-version", "", "thin-edge.io version used to select the variant (default: the version of this device)")
+
+	imagesCmd.AddCommand(attachCmd)
+	imagesCmd.AddCommand(referrersCmd)
+	imagesCmd.AddCommand(inspectCmd)
+}
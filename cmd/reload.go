@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/reload"
+)
+
+// reloadRuntime runs the configured reload hook after an instance was changed. The change
+// has already been written, so a failure only means the runtime did not (yet) pick it up.
+func reloadRuntime(cmd *cobra.Command, cfg *config.Config, change reload.Change) error {
+	if noReload, _ := cmd.Flags().GetBool("no-reload"); noReload {
+		return nil
+	}
+	if err := reload.Run(cfg, change, cmd.ErrOrStderr()); err != nil {
+		return fmt.Errorf("instance %s was written to the deploy_dir (%s), but the flows runtime reload failed: %w", change.Name, change.Action, err)
+	}
+	return nil
+}
@@ -1,13 +1,21 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
 )
 
 var configPath string
 var logLevel string
+var lockTimeout time.Duration
+var limitRate string
 
 var rootCmd = &cobra.Command{
 	Use:   "tedge-oscar",
@@ -21,10 +29,42 @@ $ tedge-oscar images pull ghcr.io/thin-edge/connectivity-counter:1.0
 # Deploy a flow instance
 $ tedge-oscar instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0 --topics te/device/main///m/+
 `,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("limit-rate") {
+			rate, err := config.ParseSize(limitRate)
+			if err != nil {
+				return fmt.Errorf("invalid --limit-rate: %w", err)
+			}
+			registryauth.SetLimitRate(rate)
+		}
+		return nil
+	},
+}
+
+// exitCodeError is returned by commands which need to exit with a specific code
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
 }
 
 func Execute() {
+	// Support being called via a symlink named after a thin-edge.io sm-plugin
+	if kind, ok := smPluginNames[filepath.Base(os.Args[0])]; ok {
+		rootCmd.SetArgs(append([]string{"sm-plugin", kind}, os.Args[1:]...))
+	}
 	if err := rootCmd.Execute(); err != nil {
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
 		os.Exit(1)
 	}
 }
@@ -32,6 +72,8 @@ func Execute() {
 func init() {
 	rootCmd.AddCommand(flowsCmd)
 	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to config file (overrides default)")
+	rootCmd.PersistentFlags().DurationVar(&lockTimeout, "lock-timeout", config.DefaultLockTimeout, "Maximum time to wait for other tedge-oscar processes to release the image_dir/deploy_dir locks (overrides lock_timeout in config)")
+	rootCmd.PersistentFlags().StringVar(&limitRate, "limit-rate", "", "Maximum transfer rate to and from registries, e.g. 500k or 1M bytes per second, 0 for unlimited (overrides limit_rate in config)")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Set the log level (debug, info, warn, error)")
 	_ = rootCmd.RegisterFlagCompletionFunc("log-level", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"debug", "info", "warn", "error"}, cobra.ShellCompDirectiveNoFileComp
@@ -38,7 +38,7 @@ var saveCmd = &cobra.Command{
 			return fmt.Errorf("failed to create temp dir: %w", err)
 		}
 		defer os.RemoveAll(tmpDir)
-		if err := imagepull.PullImage(cfg, imageRef, tmpDir, saveTarballPath, saveCompress); err != nil {
+		if err := imagepull.PullImage(cfg, imageRef, tmpDir, imagepull.Options{TarballPath: saveTarballPath, Compress: saveCompress}); err != nil {
 			return err
 		}
 		fmt.Printf("Image saved to %s\n", saveTarballPath)
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/signature"
+)
+
+var signCmd = &cobra.Command{
+	Use:   "sign [image]",
+	Short: "Sign a flow image in an OCI registry",
+	Long: `Sign a flow image in an OCI registry.
+
+The signature is pushed as an OCI referrer of the image manifest, in the format used by
+cosign, so it can also be verified with "cosign verify --key". The private key must be
+an unencrypted PEM key (ECDSA, RSA or Ed25519), e.g. created with:
+
+  openssl ecparam -name prime256v1 -genkey -noout | openssl pkcs8 -topk8 -nocrypt -out flows.key
+  openssl pkey -in flows.key -pubout -out flows.pub`,
+	Example: `# Sign an image
+$ tedge-oscar flows images sign ghcr.io/thin-edge/connectivity-counter:1.0 --key flows.key`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		keyPath, _ := cmd.Flags().GetString("key")
+		key, err := signature.LoadPrivateKey(keyPath)
+		if err != nil {
+			return err
+		}
+		repoRef, ref, err := registryauth.SplitRef(args[0])
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		repo, err := registryauth.NewRepository(cfg, repoRef, true)
+		if err != nil {
+			return err
+		}
+		desc, err := repo.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", args[0], err)
+		}
+		payload, err := signature.NewPayload(repoRef, desc.Digest)
+		if err != nil {
+			return err
+		}
+		sig, err := signature.Sign(key, payload)
+		if err != nil {
+			return err
+		}
+		sigDesc, err := signature.Push(ctx, repo, desc, sig)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s (%s) signed, signature %s\n", args[0], desc.Digest, sigDesc.Digest)
+		return nil
+	},
+}
+
+var verifySignatureCmd = &cobra.Command{
+	Use:   "verify-signature [image]",
+	Short: "Verify the signature of a flow image in an OCI registry",
+	Long: `Verify the signature of a flow image in an OCI registry.
+
+The image must be signed by one of the keys given with --key, or by default by one of
+the keys of the trust policy ([trust] section of the config) which covers the image.`,
+	Example: `# Verify an image against the trust policy
+$ tedge-oscar flows images verify-signature ghcr.io/thin-edge/connectivity-counter:1.0
+
+# Verify an image with a public key
+$ tedge-oscar flows images verify-signature ghcr.io/thin-edge/connectivity-counter:1.0 --key flows.pub`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		repoRef, ref, err := registryauth.SplitRef(args[0])
+		if err != nil {
+			return err
+		}
+		keyPaths, _ := cmd.Flags().GetStringArray("key")
+		keys, err := signature.LoadPublicKeys(keyPaths)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			if keys, err = signature.TrustedKeys(cfg, repoRef); err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				return fmt.Errorf("no trusted keys configured for %s, use --key", repoRef)
+			}
+		}
+		ctx := context.Background()
+		repo, err := registryauth.NewRepository(cfg, repoRef, false)
+		if err != nil {
+			return err
+		}
+		desc, err := repo.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", args[0], err)
+		}
+		sigs, err := signature.Fetch(ctx, repo, desc)
+		if err != nil {
+			return err
+		}
+		if _, err := signature.Verify(sigs, keys, desc.Digest); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s (%s) is signed by a trusted key\n", args[0], desc.Digest)
+		return nil
+	},
+}
+
+func init() {
+	signCmd.Flags().String("key", "", "Private key (PEM) used to sign the image")
+	_ = signCmd.MarkFlagRequired("key")
+	verifySignatureCmd.Flags().StringArray("key", nil, "Trusted public key or certificate (PEM), instead of the trust policy (repeatable)")
+	imagesCmd.AddCommand(signCmd)
+	imagesCmd.AddCommand(verifySignatureCmd)
+}
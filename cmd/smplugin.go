@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/smplugin"
+)
+
+// smPluginNames maps the names of the thin-edge.io sm-plugins to the plugin type, so the
+// binary can be symlinked to /etc/tedge/sm-plugins/<name>
+var smPluginNames = map[string]string{
+	"tedge-flow-image": "images",
+	"tedge-flows":      "instances",
+}
+
+var smPluginCmd = &cobra.Command{
+	Use:   "sm-plugin",
+	Short: "thin-edge.io software management plugins for flow images and instances",
+	Long: `thin-edge.io software management plugins for flow images and instances.
+
+The commands implement the thin-edge.io software management plugin contract,
+including the exit codes (0=ok, 1=usage, 2=failure, 3=retry) and the list format.
+They can be called from a wrapper script, or the tedge-oscar binary can be
+symlinked as /etc/tedge/sm-plugins/tedge-flow-image (images) or
+/etc/tedge/sm-plugins/tedge-flows (instances).`,
+	Example: `# Install a flow image
+$ tedge-oscar sm-plugin images install ghcr.io/thin-edge/connectivity-counter --module-version 1.0
+
+# Deploy a flow instance
+$ tedge-oscar sm-plugin instances install myinstance --module-version ghcr.io/thin-edge/connectivity-counter:1.0`,
+}
+
+func newSMPluginCmd(kind string, short string) *cobra.Command {
+	pluginCmd := &cobra.Command{
+		Use:   kind,
+		Short: short,
+	}
+	pluginCmd.AddCommand(&cobra.Command{
+		Use:          "list",
+		Short:        "List the installed modules",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSMPlugin(cmd, kind, filelock.Shared, func(p smplugin.Plugin) error {
+				return p.List(cmd.OutOrStdout())
+			})
+		},
+	})
+	for _, action := range []string{"prepare", "finalize"} {
+		pluginCmd.AddCommand(&cobra.Command{
+			Use:          action,
+			Short:        "No-op, required by the plugin contract",
+			Args:         cobra.NoArgs,
+			SilenceUsage: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return nil
+			},
+		})
+	}
+
+	installCmd := &cobra.Command{
+		Use:          "install [module_name]",
+		Short:        "Install a module",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			module := smPluginModule(cmd, args[0])
+			return runSMPlugin(cmd, kind, filelock.Exclusive, func(p smplugin.Plugin) error {
+				return p.Install(module)
+			})
+		},
+	}
+	installCmd.Flags().String("module-version", "", "Module version")
+	installCmd.Flags().String("file", "", "Path to a local file (tarball) to install the module from")
+	pluginCmd.AddCommand(installCmd)
+
+	removeCmd := &cobra.Command{
+		Use:          "remove [module_name]",
+		Short:        "Remove a module",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			module := smPluginModule(cmd, args[0])
+			return runSMPlugin(cmd, kind, filelock.Exclusive, func(p smplugin.Plugin) error {
+				return p.Remove(module)
+			})
+		},
+	}
+	removeCmd.Flags().String("module-version", "", "Module version")
+	pluginCmd.AddCommand(removeCmd)
+
+	pluginCmd.AddCommand(&cobra.Command{
+		Use:   "update-list",
+		Short: "Install and remove a list of modules (read from stdin) as one batch",
+		Long: `Install and remove a list of modules (read from stdin) as one batch.
+
+Each line contains the tab separated fields: action (install|remove), module name,
+version and file path. Plugins which don't support batches exit with code 1, so
+thin-edge.io falls back to calling install and remove for each module.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSMPlugin(cmd, kind, filelock.Exclusive, func(p smplugin.Plugin) error {
+				batch, ok := p.(smplugin.BatchPlugin)
+				if !ok {
+					return &exitCodeError{code: smplugin.ExitUsage, err: fmt.Errorf("update-list is not supported, use install and remove instead")}
+				}
+				// Exit code 1 would make thin-edge.io fall back to separate installs and removes,
+				// so a malformed list fails the batch instead
+				actions, err := smplugin.ParseUpdateList(cmd.InOrStdin())
+				if err != nil {
+					return &exitCodeError{code: smplugin.ExitFailure, err: err}
+				}
+				return batch.UpdateList(actions)
+			})
+		},
+	})
+	return pluginCmd
+}
+
+func smPluginModule(cmd *cobra.Command, name string) smplugin.Module {
+	module := smplugin.Module{Name: name}
+	module.Version, _ = cmd.Flags().GetString("module-version")
+	if cmd.Flags().Lookup("file") != nil {
+		module.File, _ = cmd.Flags().GetString("file")
+	}
+	return module
+}
+
+// runSMPlugin locks the plugin's directories and runs the action, mapping any error to
+// the exit codes of the plugin contract
+func runSMPlugin(cmd *cobra.Command, kind string, mode filelock.Mode, action func(p smplugin.Plugin) error) error {
+	registryauth.SetDebugHTTP(logLevel)
+	cfgPath := configPath
+	if cfgPath == "" {
+		cfgPath = config.DefaultConfigPath()
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		return &exitCodeError{code: smplugin.ExitFailure, err: fmt.Errorf("failed to load config: %w", err)}
+	}
+	plugin, err := smplugin.New(kind, cfg, cmd.ErrOrStderr())
+	if err != nil {
+		return &exitCodeError{code: smplugin.ExitUsage, err: err}
+	}
+	unlock, err := lockDirs(cmd, cfg, mode, plugin.Dirs()...)
+	if err != nil {
+		return &exitCodeError{code: smplugin.ExitCode(err), err: err}
+	}
+	defer unlock()
+	if err := action(plugin); err != nil {
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			return err
+		}
+		return &exitCodeError{code: smplugin.ExitCode(err), err: err}
+	}
+	if mode == filelock.Exclusive {
+		autoPublishStatus(cmd, cfg)
+	}
+	return nil
+}
+
+func init() {
+	smPluginCmd.AddCommand(newSMPluginCmd("images", "Manage flow images (tedge-flow-image)"))
+	smPluginCmd.AddCommand(newSMPluginCmd("instances", "Manage flow instances (tedge-flows)"))
+	rootCmd.AddCommand(smPluginCmd)
+}
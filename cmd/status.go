@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/status"
+	"github.com/thin-edge/tedge-oscar/internal/tedge"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show or publish the state of the flow instances and images",
+}
+
+var statusShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the flow status which is published to the device twin",
+	Example: `# Print the status of all flow instances and images as JSON
+$ tedge-oscar status show`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		unlock, err := lockDirs(cmd, cfg, filelock.Shared, cfg.ImageDir, cfg.GetDeployDir())
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		s, err := status.Collect(cfg)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	},
+}
+
+var statusPublishCmd = &cobra.Command{
+	Use:   "publish",
+	Short: "Publish the flow status to the thin-edge.io MQTT broker",
+	Long: `Publish the flow status to the thin-edge.io MQTT broker.
+
+The instances and images (with their versions and digests) are published as a
+retained message to the "flows" twin fragment of the device, e.g.
+te/device/main///twin/flows, so the cloud can see which flows run on the device.
+
+The broker is read from tedge.toml in the tedge config dir (TEDGE_CONFIG_DIR), and
+can be overridden in the [mqtt] section of the tedge-oscar config. Set
+mqtt.auto_publish = true to publish the status after every change.`,
+	Example: `# Publish the flow status
+$ tedge-oscar status publish`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		unlock, err := lockDirs(cmd, cfg, filelock.Shared, cfg.ImageDir, cfg.GetDeployDir())
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		topic, err := publishStatus(cfg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Flow status published to %s\n", topic)
+		return nil
+	},
+}
+
+// publishStatus collects the flow status and publishes it to the device twin. It returns
+// the topic the status was published to.
+func publishStatus(cfg *config.Config) (string, error) {
+	s, err := status.Collect(cfg)
+	if err != nil {
+		return "", err
+	}
+	settings, err := tedge.LoadMQTTSettings(cfg)
+	if err != nil {
+		return "", err
+	}
+	client, err := settings.Connect(fmt.Sprintf("tedge-oscar-%d", os.Getpid()))
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	topic := settings.Topic("twin", status.TwinFragment)
+	if err := status.Publish(client, topic, s); err != nil {
+		return "", err
+	}
+	return topic, nil
+}
+
+// autoPublishStatus publishes the flow status if mqtt.auto_publish is enabled. The change
+// has already been made, so failures are only reported as a warning.
+func autoPublishStatus(cmd *cobra.Command, cfg *config.Config) {
+	if !cfg.MQTT.AutoPublish {
+		return
+	}
+	if _, err := publishStatus(cfg); err != nil {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Warning: failed to publish flow status: %s\n", err)
+	}
+}
+
+func init() {
+	statusCmd.AddCommand(statusShowCmd)
+	statusCmd.AddCommand(statusPublishCmd)
+	rootCmd.AddCommand(statusCmd)
+}
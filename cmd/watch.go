@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/watch"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Periodically update the flow instances according to their update policy",
+	Long: `Periodically update the flow instances according to their update policy.
+
+The registries of the images referenced by the instances are polled, and each instance is
+updated according to the update policy it was deployed with ("instances deploy --update-policy"):
+  none:   never updated (default)
+  patch:  latest patch release of the current minor version, e.g. 1.2.3 to 1.2.7
+  minor:  latest minor or patch release of the current major version, e.g. 1.2.3 to 1.4.0
+  digest: pulled again when its tag points to another digest, for a moving tag like "latest".
+          All instances deployed from the same tag are updated together.
+
+The new image is pulled in the background and the instance is then replaced atomically. If
+a reload hook is configured and the flows runtime does not confirm the update (see
+reload.confirm_topic), the previous version is restored and not retried until the watcher
+is restarted.
+
+The checks are moved randomly by up to --jitter (a fraction of the interval), so a fleet of
+devices doesn't poll the registries at the same time.`,
+	Example: `# Check for updates every hour (or watch.interval in the config)
+$ tedge-oscar watch
+
+# Check for updates once, e.g. from a timer
+$ tedge-oscar watch --once`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		timeout, err := cfg.GetLockTimeout()
+		if err != nil {
+			return err
+		}
+		if cmd.Flags().Changed("lock-timeout") {
+			timeout = lockTimeout
+		}
+		interval := watch.DefaultInterval
+		if cfg.Watch.Interval != "" {
+			if interval, err = time.ParseDuration(cfg.Watch.Interval); err != nil {
+				return fmt.Errorf("invalid watch.interval: %w", err)
+			}
+		}
+		if cmd.Flags().Changed("interval") {
+			interval, _ = cmd.Flags().GetDuration("interval")
+		}
+		jitter := cfg.Watch.Jitter
+		if jitter == 0 {
+			jitter = watch.DefaultJitter
+		}
+		if cmd.Flags().Changed("jitter") {
+			jitter, _ = cmd.Flags().GetFloat64("jitter")
+		}
+		if jitter < 0 || jitter > 1 {
+			return fmt.Errorf("the jitter must be between 0 and 1, got %v", jitter)
+		}
+
+		w := watch.New(cfg, watch.Options{
+			Interval:    interval,
+			Jitter:      jitter,
+			LockTimeout: timeout,
+			Changed:     func() { autoPublishStatus(cmd, cfg) },
+			Log:         cmd.ErrOrStderr(),
+		})
+		if once, _ := cmd.Flags().GetBool("once"); once {
+			return w.Check()
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return w.Run(ctx)
+	},
+}
+
+func init() {
+	watchCmd.Flags().Duration("interval", watch.DefaultInterval, "Time between two checks (default: watch.interval in the config, or 1h)")
+	watchCmd.Flags().Float64("jitter", watch.DefaultJitter, "Fraction of the interval by which each check is randomly moved")
+	watchCmd.Flags().Bool("once", false, "Check for updates once and exit")
+	rootCmd.AddCommand(watchCmd)
+}
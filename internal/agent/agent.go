@@ -0,0 +1,326 @@
+// Package agent implements a thin-edge.io operation handler which deploys and removes flow
+// instances when it receives a command over MQTT.
+//
+// See https://thin-edge.github.io/thin-edge.io/references/mqtt-api/#commands
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+	"github.com/thin-edge/tedge-oscar/internal/reload"
+	"github.com/thin-edge/tedge-oscar/internal/status"
+	"github.com/thin-edge/tedge-oscar/internal/tedge"
+)
+
+// DefaultNamespace is the default prefix of the operation names (flow_deploy and flow_remove)
+const DefaultNamespace = "flow"
+
+// Statuses of a command, as defined by the thin-edge.io MQTT API
+const (
+	StatusInit       = "init"
+	StatusExecuting  = "executing"
+	StatusSuccessful = "successful"
+	StatusFailed     = "failed"
+)
+
+// DeployRequest is the payload of a <namespace>_deploy command
+type DeployRequest struct {
+	Name     string         `json:"name"`
+	Image    string         `json:"image"`
+	Topics   []string       `json:"topics,omitempty"`
+	Interval string         `json:"interval,omitempty"`
+	Params   map[string]any `json:"params,omitempty"`
+}
+
+// RemoveRequest is the payload of a <namespace>_remove command
+type RemoveRequest struct {
+	Name string `json:"name"`
+}
+
+// Options configures the agent
+type Options struct {
+	// Namespace is the prefix of the operation names, defaults to DefaultNamespace
+	Namespace   string
+	LockTimeout time.Duration
+	// Log receives progress messages
+	Log io.Writer
+}
+
+// Agent handles the flow operations of a device
+type Agent struct {
+	cfg      *config.Config
+	settings tedge.MQTTSettings
+	opts     Options
+	client   *mqtt.Client
+	queue    chan command
+	// connects counts the connections to the broker, which redelivers the retained commands
+	// after every reconnect
+	connects atomic.Int64
+	// handled are the topics of the commands which were executed (or are executing) by this
+	// process, until the command is cleared
+	handled map[string]struct{}
+}
+
+// command is a message received on a command topic
+type command struct {
+	mqtt.Message
+	// firstConnect is set for the messages received on the first connection of the process
+	firstConnect bool
+}
+
+// New creates an agent which uses settings to connect to the broker
+func New(cfg *config.Config, settings tedge.MQTTSettings, opts Options) *Agent {
+	if opts.Namespace == "" {
+		opts.Namespace = DefaultNamespace
+	}
+	if opts.Log == nil {
+		opts.Log = io.Discard
+	}
+	return &Agent{
+		cfg:      cfg,
+		settings: settings,
+		opts:     opts,
+		queue:    make(chan command, 100),
+		handled:  map[string]struct{}{},
+	}
+}
+
+func (a *Agent) deployOperation() string {
+	return a.opts.Namespace + "_deploy"
+}
+
+func (a *Agent) removeOperation() string {
+	return a.opts.Namespace + "_remove"
+}
+
+// Operations returns the names of the operations handled by the agent
+func (a *Agent) Operations() []string {
+	return []string{a.deployOperation(), a.removeOperation()}
+}
+
+// Run connects to the broker, registers the operations and handles commands until the
+// context is cancelled. Commands are executed one at a time.
+func (a *Agent) Run(ctx context.Context) error {
+	clientOpts, err := a.settings.ClientOptions(fmt.Sprintf("tedge-oscar-agent-%d", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	// Subscriptions are not persisted by the broker (clean session), so restore them
+	// after every reconnect
+	clientOpts.OnConnect = func(c *mqtt.Client) {
+		if err := a.subscribe(c, a.connects.Add(1) == 1); err != nil {
+			fmt.Fprintf(a.opts.Log, "Failed to subscribe to commands: %s\n", err)
+		}
+	}
+	client, err := mqtt.Connect(clientOpts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	a.client = client
+	fmt.Fprintf(a.opts.Log, "Handling operations: %s\n", strings.Join(a.Operations(), ", "))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-a.queue:
+			a.handle(msg)
+		}
+	}
+}
+
+// subscribe subscribes to the commands and then registers the operations, so a command
+// can't be sent before the agent is listening
+func (a *Agent) subscribe(c *mqtt.Client, firstConnect bool) error {
+	for _, op := range a.Operations() {
+		err := c.Subscribe(a.settings.Topic("cmd", op, "+"), func(msg mqtt.Message) {
+			a.queue <- command{Message: msg, firstConnect: firstConnect}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, op := range a.Operations() {
+		if err := c.Publish(a.settings.Topic("cmd", op), []byte("{}"), true); err != nil {
+			return fmt.Errorf("failed to register operation %s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+func (a *Agent) handle(msg command) {
+	// A cleared (empty) retained message means the command has been completed
+	if len(msg.Payload) == 0 {
+		delete(a.handled, msg.Topic)
+		return
+	}
+	// The broker redelivers the retained commands after a reconnect, including the ones
+	// which are queued or were executed by this process
+	if _, ok := a.handled[msg.Topic]; ok {
+		return
+	}
+	op, id, ok := a.parseTopic(msg.Topic)
+	if !ok {
+		return
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		fmt.Fprintf(a.opts.Log, "Ignoring invalid command on %s: %s\n", msg.Topic, err)
+		return
+	}
+	switch payload["status"] {
+	case StatusInit:
+	case StatusExecuting:
+		// A retained command which is still executing when the process starts was
+		// interrupted, e.g. by a restart
+		if msg.Retained && msg.firstConnect {
+			a.update(msg.Topic, payload, StatusFailed, "interrupted: tedge-oscar agent was restarted")
+		}
+		return
+	default:
+		// Our own state updates, or commands which are already done
+		return
+	}
+
+	a.handled[msg.Topic] = struct{}{}
+	fmt.Fprintf(a.opts.Log, "Executing %s command. id=%s\n", op, id)
+	a.update(msg.Topic, payload, StatusExecuting, "")
+	var err error
+	switch op {
+	case a.deployOperation():
+		err = a.deploy(msg.Payload)
+	case a.removeOperation():
+		err = a.remove(msg.Payload)
+	}
+	if err != nil {
+		fmt.Fprintf(a.opts.Log, "Command %s failed. id=%s, reason=%s\n", op, id, err)
+		a.update(msg.Topic, payload, StatusFailed, err.Error())
+		return
+	}
+	fmt.Fprintf(a.opts.Log, "Command %s successful. id=%s\n", op, id)
+	a.update(msg.Topic, payload, StatusSuccessful, "")
+}
+
+// parseTopic returns the operation and command id of a command topic
+func (a *Agent) parseTopic(topic string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(topic, a.settings.Topic("cmd")+"/")
+	if !ok {
+		return "", "", false
+	}
+	op, id, ok := strings.Cut(rest, "/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", "", false
+	}
+	return op, id, true
+}
+
+// update publishes the new status of a command, keeping all other fields of the payload
+func (a *Agent) update(topic string, payload map[string]any, newStatus string, reason string) {
+	payload["status"] = newStatus
+	if reason != "" {
+		payload["reason"] = reason
+	} else {
+		delete(payload, "reason")
+	}
+	data, err := json.Marshal(payload)
+	if err == nil {
+		err = a.client.Publish(topic, data, true)
+	}
+	if err != nil {
+		fmt.Fprintf(a.opts.Log, "Failed to update the command status: %s\n", err)
+	}
+}
+
+func (a *Agent) deploy(data []byte) error {
+	var req DeployRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return fmt.Errorf("invalid %s command: %w", a.deployOperation(), err)
+	}
+	if err := instance.ValidateName(req.Name); err != nil {
+		return fmt.Errorf("invalid %s command: %w", a.deployOperation(), err)
+	}
+	if req.Image == "" {
+		return fmt.Errorf("invalid %s command: image is required", a.deployOperation())
+	}
+	var tomlPath string
+	// The image may need to be pulled, so lock both directories (always image_dir first)
+	err := a.withLock([]string{a.cfg.ImageDir, a.cfg.GetDeployDir()}, func() error {
+		var err error
+		tomlPath, err = instance.Deploy(a.cfg, instance.DeployOptions{
+			Name:     req.Name,
+			Image:    req.Image,
+			Topics:   req.Topics,
+			Interval: req.Interval,
+			Params:   req.Params,
+		}, a.opts.Log)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return reload.Run(a.cfg, reload.Change{Action: reload.ActionDeploy, Name: req.Name, Path: tomlPath}, a.opts.Log)
+}
+
+func (a *Agent) remove(data []byte) error {
+	var req RemoveRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return fmt.Errorf("invalid %s command: %w", a.removeOperation(), err)
+	}
+	if err := instance.ValidateName(req.Name); err != nil {
+		return fmt.Errorf("invalid %s command: %w", a.removeOperation(), err)
+	}
+	var removed []string
+	err := a.withLock([]string{a.cfg.GetDeployDir()}, func() error {
+		var err error
+		removed, err = instance.Remove(a.cfg.GetDeployDir(), req.Name)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		fmt.Fprintf(a.opts.Log, "Instance %s does not exist, skipping removal.\n", req.Name)
+		return nil
+	}
+	return reload.Run(a.cfg, reload.Change{Action: reload.ActionRemove, Name: req.Name, Path: removed[0]}, a.opts.Log)
+}
+
+// withLock runs fn while holding an exclusive lock on the directories and publishes the
+// flow status afterwards if mqtt.auto_publish is enabled
+func (a *Agent) withLock(dirs []string, fn func() error) error {
+	unlock, err := filelock.AcquireAll(dirs, filelock.Exclusive, a.opts.LockTimeout, a.opts.Log)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := fn(); err != nil {
+		return err
+	}
+	if a.cfg.MQTT.AutoPublish {
+		s, err := status.Collect(a.cfg)
+		if err == nil {
+			err = status.Publish(a.client, a.settings.Topic("twin", status.TwinFragment), s)
+		}
+		if err != nil {
+			fmt.Fprintf(a.opts.Log, "Warning: failed to publish flow status: %s\n", err)
+		}
+	}
+	return nil
+}
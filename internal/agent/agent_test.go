@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt/mqtttest"
+	"github.com/thin-edge/tedge-oscar/internal/tedge"
+)
+
+// waitForStatus waits until the retained command on topic reaches a final status
+func waitForStatus(t *testing.T, broker *mqtttest.Broker, topic string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if payload, ok := broker.Retained(topic); ok {
+			var cmd map[string]any
+			if err := json.Unmarshal(payload, &cmd); err != nil {
+				t.Fatal(err)
+			}
+			if cmd["status"] == StatusSuccessful || cmd["status"] == StatusFailed {
+				return cmd
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("command %s did not complete", topic)
+	return nil
+}
+
+func TestAgent(t *testing.T) {
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.ImageDir, "counter:1.0", "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.ImageDir, "counter:1.0", "dist", "main.mjs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	broker, err := mqtttest.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	host, port := broker.Addr()
+	settings := tedge.MQTTSettings{Host: host, Port: port, TopicRoot: "te", DeviceTopicID: "device/main//"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- New(cfg, settings, Options{Log: io.Discard}).Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The operations are registered after subscribing
+	for _, op := range []string{"flow_deploy", "flow_remove"} {
+		if _, ok := broker.WaitFor("te/device/main///cmd/"+op, 5*time.Second); !ok {
+			t.Fatalf("operation %s was not registered", op)
+		}
+	}
+
+	deployTopic := "te/device/main///cmd/flow_deploy/c8y-1"
+	broker.Publish(deployTopic, []byte(`{"status":"init","name":"counter1","image":"ghcr.io/thin-edge/counter:1.0"}`), true)
+	if cmd := waitForStatus(t, broker, deployTopic); cmd["status"] != StatusSuccessful {
+		t.Fatalf("deploy failed: %v", cmd["reason"])
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DeployDir, "counter1.toml")); err != nil {
+		t.Fatalf("instance was not deployed: %s", err)
+	}
+
+	invalidTopic := "te/device/main///cmd/flow_deploy/c8y-2"
+	broker.Publish(invalidTopic, []byte(`{"status":"init","name":"../counter2","image":"ghcr.io/thin-edge/counter:1.0"}`), true)
+	if cmd := waitForStatus(t, broker, invalidTopic); cmd["status"] != StatusFailed || cmd["reason"] == "" {
+		t.Fatalf("expected the deploy to fail with a reason, got %v", cmd)
+	}
+
+	removeTopic := "te/device/main///cmd/flow_remove/c8y-3"
+	broker.Publish(removeTopic, []byte(`{"status":"init","name":"counter1"}`), true)
+	if cmd := waitForStatus(t, broker, removeTopic); cmd["status"] != StatusSuccessful {
+		t.Fatalf("remove failed: %v", cmd["reason"])
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DeployDir, "counter1.toml")); !os.IsNotExist(err) {
+		t.Fatalf("instance was not removed")
+	}
+}
+
+func TestAgentReconnect(t *testing.T) {
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+		// Keep the command executing while the agent reconnects
+		Reload: config.ReloadConfig{Type: "command", Command: "sleep 3"},
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.ImageDir, "counter:1.0", "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.ImageDir, "counter:1.0", "dist", "main.mjs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	broker, err := mqtttest.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	host, port := broker.Addr()
+	settings := tedge.MQTTSettings{Host: host, Port: port, TopicRoot: "te", DeviceTopicID: "device/main//"}
+
+	// A command interrupted by a restart of the agent
+	interruptedTopic := "te/device/main///cmd/flow_deploy/c8y-0"
+	broker.Publish(interruptedTopic, []byte(`{"status":"executing","name":"counter0","image":"ghcr.io/thin-edge/counter:1.0"}`), true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- New(cfg, settings, Options{Log: io.Discard}).Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	if cmd := waitForStatus(t, broker, interruptedTopic); cmd["status"] != StatusFailed {
+		t.Fatalf("expected the interrupted command to fail, got %v", cmd)
+	}
+
+	deployTopic := "te/device/main///cmd/flow_deploy/c8y-1"
+	broker.Publish(deployTopic, []byte(`{"status":"init","name":"counter1","image":"ghcr.io/thin-edge/counter:1.0"}`), true)
+	if _, ok := broker.WaitFor("te/device/main///cmd/flow_deploy/c8y-1", 5*time.Second); !ok {
+		t.Fatal("command was not received")
+	}
+	time.Sleep(500 * time.Millisecond)
+	// The broker redelivers the retained "executing" status of the running command
+	broker.Disconnect()
+
+	if cmd := waitForStatus(t, broker, deployTopic); cmd["status"] != StatusSuccessful {
+		t.Fatalf("deploy failed: %v", cmd["reason"])
+	}
+	// Wait for the redelivered messages to be handled
+	time.Sleep(2 * time.Second)
+	payload, _ := broker.Retained(deployTopic)
+	var cmd map[string]any
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if cmd["status"] != StatusSuccessful {
+		t.Fatalf("the command was changed after the reconnect: %v", cmd)
+	}
+	var executions int
+	for _, msg := range broker.Published() {
+		if msg.Topic == deployTopic && strings.Contains(string(msg.Payload), `"executing"`) {
+			executions++
+		}
+	}
+	if executions != 1 {
+		t.Errorf("expected the command to be executed once, got %d", executions)
+	}
+}
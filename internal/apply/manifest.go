@@ -0,0 +1,85 @@
+package apply
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest describes the desired images and instances of a device
+type Manifest struct {
+	Images    []string       `yaml:"images" json:"images"`
+	Instances []InstanceSpec `yaml:"instances" json:"instances"`
+}
+
+// InstanceSpec is the desired state of a single flow instance
+type InstanceSpec struct {
+	Name     string         `yaml:"name" json:"name"`
+	Image    string         `yaml:"image" json:"image"`
+	Topics   []string       `yaml:"topics" json:"topics"`
+	Interval string         `yaml:"interval" json:"interval"`
+	Params   map[string]any `yaml:"params" json:"params"`
+}
+
+// LoadManifest reads a manifest from a YAML (or JSON) file. Use "-" to read from stdin.
+func LoadManifest(path string) (*Manifest, error) {
+	var r io.Reader
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open manifest: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	var m Manifest
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Validate checks that all instances have a unique name and images include a tag or digest
+func (m *Manifest) Validate() error {
+	for _, image := range m.Images {
+		if err := validateImageRef(image); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]struct{}, len(m.Instances))
+	for i, spec := range m.Instances {
+		if err := instance.ValidateName(spec.Name); err != nil {
+			return fmt.Errorf("instances[%d]: %w", i, err)
+		}
+		if _, exists := names[spec.Name]; exists {
+			return fmt.Errorf("instances[%d]: duplicate name %q", i, spec.Name)
+		}
+		names[spec.Name] = struct{}{}
+		if err := validateImageRef(spec.Image); err != nil {
+			return fmt.Errorf("instances[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateImageRef(imageRef string) error {
+	if imageRef == "" {
+		return fmt.Errorf("image is required")
+	}
+	slash := strings.LastIndex(imageRef, "/")
+	if strings.LastIndex(imageRef, ":") <= slash && strings.LastIndex(imageRef, "@") <= slash {
+		return fmt.Errorf("image reference %q must include a tag or digest", imageRef)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package apply
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
+)
+
+// ManagedBy marks instances which are owned by a manifest, so they can be pruned
+const ManagedBy = "apply"
+
+type ActionType string
+
+const (
+	ActionPull    ActionType = "pull"
+	ActionDeploy  ActionType = "deploy"
+	ActionUpgrade ActionType = "upgrade"
+	ActionUpdate  ActionType = "update"
+	ActionRemove  ActionType = "remove"
+)
+
+// Action is a single step required to converge the device to the manifest
+type Action struct {
+	Type ActionType `json:"action"`
+	// Name is the instance name (empty for pulls)
+	Name          string `json:"name,omitempty"`
+	Image         string `json:"image,omitempty"`
+	PreviousImage string `json:"previousImage,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+
+	spec *InstanceSpec
+	// versionRange is the range the image of the instance was resolved from, if any
+	versionRange string
+}
+
+// Plan is the ordered list of actions: pulls first, then instance changes and finally removals
+type Plan struct {
+	Actions   []Action `json:"actions"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// Options controls how the plan is computed
+type Options struct {
+	// Prune removes managed instances which are no longer declared in the manifest
+	Prune bool
+}
+
+// ComputePlan compares the manifest with the images and instances on the device. Version
+// ranges are resolved to the highest matching tag, except for instances which were deployed
+// with the same range, as they are kept on their version (see "tedge-oscar watch").
+func ComputePlan(cfg *config.Config, m *Manifest, opts Options) (*Plan, error) {
+	plan := &Plan{Actions: []Action{}, Unchanged: []string{}}
+
+	deployDir := cfg.GetDeployDir()
+	existing := map[string]instance.Entry{}
+	entries, err := instance.List(deployDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read deploy dir: %w", err)
+	}
+	for _, entry := range entries {
+		existing[entry.Name] = entry
+	}
+
+	// Resolve the version ranges once per reference
+	resolved := map[string]imagepull.Resolved{}
+	resolve := func(image string) (imagepull.Resolved, error) {
+		if r, ok := resolved[image]; ok {
+			return r, nil
+		}
+		r, err := imagepull.ResolveImageRef(cfg, image)
+		if err != nil {
+			return r, err
+		}
+		resolved[image] = r
+		return r, nil
+	}
+
+	// Decide the exact image of each declared instance
+	targets := make([]imagepull.Resolved, len(m.Instances))
+	currents := make([]*flows.InstanceFile, len(m.Instances))
+	for i, spec := range m.Instances {
+		if entry, ok := existing[spec.Name]; ok {
+			currents[i], _ = instance.Read(entry.Path)
+		}
+		if current := currents[i]; current != nil && sameRange(current.Metadata, spec.Image) {
+			targets[i] = imagepull.Resolved{ImageRef: current.Metadata.Image, Range: current.Metadata.VersionRange}
+			continue
+		}
+		if targets[i], err = resolve(spec.Image); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", spec.Name, err)
+		}
+	}
+
+	// Pull any declared or referenced image which is not available locally
+	seen := map[string]struct{}{}
+	var images []string
+	for _, image := range m.Images {
+		r, err := resolve(image)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, r.ImageRef)
+	}
+	for _, target := range targets {
+		images = append(images, target.ImageRef)
+	}
+	for _, image := range images {
+		if _, ok := seen[image]; ok {
+			continue
+		}
+		seen[image] = struct{}{}
+		imagePath, err := instance.ImagePath(cfg, image)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+			plan.Actions = append(plan.Actions, Action{Type: ActionPull, Image: image})
+		}
+	}
+
+	declared := map[string]struct{}{}
+	for i := range m.Instances {
+		spec := &m.Instances[i]
+		target := targets[i]
+		declared[spec.Name] = struct{}{}
+		entry, ok := existing[spec.Name]
+		if !ok {
+			plan.Actions = append(plan.Actions, Action{Type: ActionDeploy, Name: spec.Name, Image: target.ImageRef, spec: spec, versionRange: target.Range})
+			continue
+		}
+		current := currents[i]
+		if current == nil {
+			plan.Actions = append(plan.Actions, Action{Type: ActionUpdate, Name: spec.Name, Image: target.ImageRef, Reason: "existing instance file is invalid", spec: spec, versionRange: target.Range})
+			continue
+		}
+		previousImage := current.Metadata.Image
+		if previousImage == "" && len(current.Steps) > 0 {
+			// Instances deployed by older versions don't record the image, so compare the image
+			// folder of their script with the one of the declared image
+			previousImage, err = legacyImage(cfg, target.ImageRef, current.Steps[0].Script)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if previousImage != target.ImageRef {
+			plan.Actions = append(plan.Actions, Action{Type: ActionUpgrade, Name: spec.Name, Image: target.ImageRef, PreviousImage: previousImage, spec: spec, versionRange: target.Range})
+			continue
+		}
+		reason, err := updateReason(cfg, spec, target, entry, current.Metadata.ManagedBy)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			plan.Actions = append(plan.Actions, Action{Type: ActionUpdate, Name: spec.Name, Image: target.ImageRef, Reason: reason, spec: spec, versionRange: target.Range})
+			continue
+		}
+		plan.Unchanged = append(plan.Unchanged, spec.Name)
+	}
+
+	if opts.Prune {
+		for _, entry := range entries {
+			if _, ok := declared[entry.Name]; ok {
+				continue
+			}
+			current, err := instance.Read(entry.Path)
+			if err != nil || current.Metadata.ManagedBy != ManagedBy {
+				continue
+			}
+			plan.Actions = append(plan.Actions, Action{Type: ActionRemove, Name: entry.Name, Image: current.Metadata.Image, Reason: "no longer declared"})
+		}
+	}
+	return plan, nil
+}
+
+// sameRange reports whether the instance was deployed from the repository and version range
+// of image
+func sameRange(metadata flows.InstanceMetadata, image string) bool {
+	if metadata.VersionRange == "" || !imagepull.IsVersionRange(image) {
+		return false
+	}
+	repo, versionRange, err := registryauth.SplitRef(image)
+	if err != nil {
+		return false
+	}
+	currentRepo, _, err := registryauth.SplitRef(metadata.Image)
+	return err == nil && currentRepo == repo && metadata.VersionRange == versionRange
+}
+
+// legacyImage returns image if script is in its image folder, and the name of the image
+// folder of script otherwise
+func legacyImage(cfg *config.Config, image, script string) (string, error) {
+	imagePath, err := instance.ImagePath(cfg, image)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(imagePath, script); err == nil && filepath.IsLocal(rel) {
+		return image, nil
+	}
+	return filepath.Base(filepath.Dir(filepath.Dir(script))), nil
+}
+
+// updateReason returns why an existing instance with the same image needs to be rewritten,
+// or an empty string if it already matches the manifest
+func updateReason(cfg *config.Config, spec *InstanceSpec, target imagepull.Resolved, entry instance.Entry, managedBy string) (string, error) {
+	if !entry.Enabled {
+		return "instance is disabled", nil
+	}
+	imagePath, err := instance.ImagePath(cfg, target.ImageRef)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		return "image is not available locally", nil
+	}
+	desired, err := instance.Render(cfg, deployOptions(spec, target.ImageRef, target.Range))
+	if err != nil {
+		return "", err
+	}
+	changed, err := differs(desired, entry.Path)
+	if err != nil {
+		return "", err
+	}
+	if !changed {
+		return "", nil
+	}
+	if managedBy != ManagedBy {
+		return "take over unmanaged instance", nil
+	}
+	return "configuration changed", nil
+}
+
+// differs compares the rendered instance with the existing file after normalizing both through TOML
+func differs(desired map[string]interface{}, path string) (bool, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(desired); err != nil {
+		return false, err
+	}
+	var want, got map[string]interface{}
+	if _, err := toml.Decode(buf.String(), &want); err != nil {
+		return false, err
+	}
+	if _, err := toml.DecodeFile(path, &got); err != nil {
+		return true, nil
+	}
+	return !reflect.DeepEqual(want, got), nil
+}
+
+// deployOptions returns the options to deploy the instance with the resolved image and the
+// version range it was resolved from, if any
+func deployOptions(spec *InstanceSpec, image string, versionRange string) instance.DeployOptions {
+	return instance.DeployOptions{
+		Name:         spec.Name,
+		Image:        image,
+		Topics:       spec.Topics,
+		Interval:     spec.Interval,
+		Params:       spec.Params,
+		ManagedBy:    ManagedBy,
+		VersionRange: versionRange,
+	}
+}
+
+// Counts returns the number of actions of each type
+func (p *Plan) Counts() map[ActionType]int {
+	counts := map[ActionType]int{}
+	for _, action := range p.Actions {
+		counts[action.Type]++
+	}
+	return counts
+}
+
+// Print writes a human readable summary of the plan
+func (p *Plan) Print(w io.Writer) {
+	counts := p.Counts()
+	fmt.Fprintf(w, "Plan: %d to pull, %d to deploy, %d to upgrade, %d to update, %d to remove (%d unchanged)\n",
+		counts[ActionPull], counts[ActionDeploy], counts[ActionUpgrade], counts[ActionUpdate], counts[ActionRemove], len(p.Unchanged))
+	for _, action := range p.Actions {
+		fmt.Fprintf(w, "  %s\n", action)
+	}
+}
+
+func (a Action) String() string {
+	switch a.Type {
+	case ActionPull:
+		return fmt.Sprintf("+ pull     %s", a.Image)
+	case ActionDeploy:
+		return fmt.Sprintf("+ deploy   %s (%s)", a.Name, a.Image)
+	case ActionUpgrade:
+		return fmt.Sprintf("~ upgrade  %s (%s -> %s)", a.Name, a.PreviousImage, a.Image)
+	case ActionUpdate:
+		return fmt.Sprintf("~ update   %s (%s)", a.Name, a.Reason)
+	case ActionRemove:
+		return fmt.Sprintf("- remove   %s (%s)", a.Name, a.Reason)
+	}
+	return string(a.Type)
+}
+
+// Execute runs the actions of the plan in order, stopping at the first failure.
+// The caller is responsible for locking the image_dir and deploy_dir.
+func Execute(cfg *config.Config, plan *Plan, w io.Writer) error {
+	for i, action := range plan.Actions {
+		fmt.Fprintf(w, "[%d/%d] %s\n", i+1, len(plan.Actions), action)
+		switch action.Type {
+		case ActionPull:
+			imagePath, err := instance.ImagePath(cfg, action.Image)
+			if err != nil {
+				return err
+			}
+			if err := imagepull.PullImage(cfg, action.Image, imagePath, imagepull.Options{}); err != nil {
+				return fmt.Errorf("failed to pull image %s: %w", action.Image, err)
+			}
+		case ActionDeploy, ActionUpgrade, ActionUpdate:
+			if _, err := instance.Deploy(cfg, deployOptions(action.spec, action.Image, action.versionRange), w); err != nil {
+				return fmt.Errorf("failed to %s instance %s: %w", action.Type, action.Name, err)
+			}
+		case ActionRemove:
+			if _, err := instance.Remove(cfg.GetDeployDir(), action.Name); err != nil {
+				return fmt.Errorf("failed to remove instance %s: %w", action.Name, err)
+			}
+		}
+	}
+	return nil
+}
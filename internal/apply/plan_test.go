@@ -0,0 +1,182 @@
+package apply
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth/registrytest"
+)
+
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	imageDir := filepath.Join(cfg.ImageDir, "counter:1.0")
+	if err := os.MkdirAll(filepath.Join(imageDir, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "dist", "main.mjs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func actionTypes(plan *Plan) string {
+	var types []string
+	for _, action := range plan.Actions {
+		types = append(types, string(action.Type)+":"+action.Name+action.Image)
+	}
+	return strings.Join(types, ",")
+}
+
+func TestPlanAndExecute(t *testing.T) {
+	cfg := newTestConfig(t)
+	manifest := &Manifest{
+		Images: []string{"counter:1.0", "other:2.0"},
+		Instances: []InstanceSpec{
+			{Name: "a", Image: "counter:1.0", Topics: []string{"te/device/main///m/+"}},
+			{Name: "b", Image: "counter:1.0", Params: map[string]any{"threshold": 5}},
+		},
+	}
+	plan, err := ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actionTypes(plan); got != "pull:other:2.0,deploy:acounter:1.0,deploy:bcounter:1.0" {
+		t.Fatalf("unexpected plan: %s", got)
+	}
+
+	// Skip the pull as it requires a registry
+	plan.Actions = plan.Actions[1:]
+	if err := Execute(cfg, plan, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest.Images = nil
+	plan, err = ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 0 || len(plan.Unchanged) != 2 {
+		t.Fatalf("expected no changes after apply, got: %s", actionTypes(plan))
+	}
+
+	manifest.Instances[0].Topics = []string{"te/device/main///e/+"}
+	manifest.Instances = manifest.Instances[:1]
+	plan, err = ComputePlan(cfg, manifest, Options{Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actionTypes(plan); got != "update:acounter:1.0,remove:bcounter:1.0" {
+		t.Fatalf("unexpected plan: %s", got)
+	}
+}
+
+func TestPlanLegacyInstance(t *testing.T) {
+	cfg := newTestConfig(t)
+	manifest := &Manifest{
+		Instances: []InstanceSpec{{Name: "a", Image: "ghcr.io/thin-edge/counter:1.0"}},
+	}
+	plan, err := ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Execute(cfg, plan, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Instances deployed by older versions don't record the image
+	path := filepath.Join(cfg.DeployDir, "a.toml")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "image =") {
+			lines = append(lines, line)
+		}
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err = ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rewritten to record the image, but not upgraded
+	if got := actionTypes(plan); got != "update:aghcr.io/thin-edge/counter:1.0" {
+		t.Fatalf("unexpected plan: %s", got)
+	}
+	manifest.Instances[0].Image = "other:2.0"
+	plan, err = ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actionTypes(plan); got != "pull:other:2.0,upgrade:aother:2.0" {
+		t.Fatalf("unexpected plan: %s", got)
+	}
+}
+
+func TestPlanVersionRange(t *testing.T) {
+	reg := registrytest.Start()
+	defer reg.Close()
+	for _, version := range []string{"1.2.0", "1.2.3", "1.3.0"} {
+		reg.Push("thin-edge/counter", version, map[string]string{"dist/main.mjs": "// " + version})
+	}
+	cfg := newTestConfig(t)
+	repo := reg.Host() + "/thin-edge/counter"
+	manifest := &Manifest{
+		Instances: []InstanceSpec{{Name: "a", Image: repo + ":~1.2"}},
+	}
+	plan, err := ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actionTypes(plan); got != "pull:"+repo+":1.2.3,deploy:a"+repo+":1.2.3" {
+		t.Fatalf("unexpected plan: %s", got)
+	}
+	if err := Execute(cfg, plan, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// The instance stays on its version while the range is unchanged
+	reg.Push("thin-edge/counter", "1.2.4", map[string]string{"dist/main.mjs": "// 1.2.4"})
+	plan, err = ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 0 || len(plan.Unchanged) != 1 {
+		t.Fatalf("expected no changes after apply, got: %s", actionTypes(plan))
+	}
+
+	manifest.Instances[0].Image = repo + ":^1.2"
+	plan, err = ComputePlan(cfg, manifest, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actionTypes(plan); got != "pull:"+repo+":1.3.0,upgrade:a"+repo+":1.3.0" {
+		t.Fatalf("unexpected plan: %s", got)
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	for _, m := range []Manifest{
+		{Images: []string{"ghcr.io/thin-edge/counter"}},
+		{Instances: []InstanceSpec{{Name: "", Image: "counter:1.0"}}},
+		{Instances: []InstanceSpec{{Name: "../a", Image: "counter:1.0"}}},
+		{Instances: []InstanceSpec{{Name: "a", Image: "counter:1.0"}, {Name: "a", Image: "counter:1.0"}}},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("expected manifest to be invalid: %+v", m)
+		}
+	}
+}
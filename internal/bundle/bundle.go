@@ -0,0 +1,455 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/signature"
+)
+
+// IndexFile is the name of the bundle index inside the tarball
+const IndexFile = "bundle.json"
+
+const (
+	instancesPrefix = "instances/"
+	imagesPrefix    = "images/"
+)
+
+// Index describes the contents of a bundle
+type Index struct {
+	Version   int             `json:"version"`
+	ImageDir  string          `json:"imageDir"`
+	DeployDir string          `json:"deployDir"`
+	Images    []ImageEntry    `json:"images"`
+	Instances []InstanceEntry `json:"instances"`
+}
+
+// ImageEntry is an image referenced by the exported instances
+type ImageEntry struct {
+	// Ref is the image reference used to pull the image
+	Ref string `json:"ref"`
+	// Dir is the folder name of the image in the image_dir
+	Dir string `json:"dir"`
+	// Embedded is true if the image contents are included in the bundle
+	Embedded bool `json:"embedded"`
+}
+
+// InstanceEntry is an exported instance file
+type InstanceEntry struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Image   string `json:"image,omitempty"`
+}
+
+// ExportOptions controls the contents of the bundle
+type ExportOptions struct {
+	// IncludeImages embeds the contents of the referenced images
+	IncludeImages bool
+}
+
+// Export writes all instances (and optionally their images) as a tar.gz bundle to w.
+// The caller is responsible for locking the image_dir and deploy_dir.
+func Export(cfg *config.Config, w io.Writer, opts ExportOptions) (*Index, error) {
+	deployDir := cfg.GetDeployDir()
+	entries, err := instance.List(deployDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read deploy dir: %w", err)
+	}
+	index := &Index{
+		Version:   1,
+		ImageDir:  cfg.ImageDir,
+		DeployDir: deployDir,
+		Images:    []ImageEntry{},
+		Instances: []InstanceEntry{},
+	}
+
+	images := map[string]string{}
+	for _, entry := range entries {
+		item := InstanceEntry{Name: entry.Name, Enabled: entry.Enabled}
+		if data, err := instance.Read(entry.Path); err == nil {
+			item.Image = data.Metadata.Image
+			if len(data.Steps) > 0 {
+				// Prefer the recorded image reference as it includes the registry
+				if dir := imageDirName(cfg.ImageDir, data.Steps[0].Script); dir != "" {
+					if _, ok := images[dir]; !ok {
+						images[dir] = dir
+					}
+					if item.Image != "" {
+						images[dir] = item.Image
+					}
+				}
+			}
+		}
+		index.Instances = append(index.Instances, item)
+	}
+	for dir, ref := range images {
+		index.Images = append(index.Images, ImageEntry{Ref: ref, Dir: dir, Embedded: opts.IncludeImages})
+	}
+	sort.Slice(index.Images, func(i, j int) bool {
+		return index.Images[i].Dir < index.Images[j].Dir
+	})
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	indexData, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, IndexFile, indexData, 0644); err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		data, err := os.ReadFile(entry.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read instance %s: %w", entry.Name, err)
+		}
+		if err := writeTarFile(tw, instancesPrefix+instance.FileName(index.Instances[i].Name, entry.Enabled), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	if opts.IncludeImages {
+		for _, image := range index.Images {
+			if err := addDirToTar(tw, filepath.Join(cfg.ImageDir, image.Dir), imagesPrefix+image.Dir); err != nil {
+				return nil, fmt.Errorf("failed to add image %s: %w", image.Dir, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// ImportOptions controls how a bundle is restored
+type ImportOptions struct {
+	// Pull missing images which are not embedded in the bundle
+	Pull bool
+	// Overwrite existing images with the embedded images
+	OverwriteImages bool
+}
+
+// Import restores the instances and images of a bundle. Absolute paths which point to the
+// image_dir or deploy_dir of the exporting device are rewritten to the local folders.
+// The caller is responsible for locking the image_dir and deploy_dir.
+func Import(cfg *config.Config, r io.Reader, opts ImportOptions, w io.Writer) (*Index, error) {
+	stagingDir, err := os.MkdirTemp("", "tedge-oscar-import-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := extract(r, stagingDir); err != nil {
+		return nil, err
+	}
+
+	var index Index
+	indexData, err := os.ReadFile(filepath.Join(stagingDir, IndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle, missing %s: %w", IndexFile, err)
+	}
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, fmt.Errorf("invalid bundle index: %w", err)
+	}
+	if index.Version != 1 {
+		return nil, fmt.Errorf("unsupported bundle version: %d", index.Version)
+	}
+	// The index comes from the bundle, so check it before anything is written
+	if err := index.validate(); err != nil {
+		return nil, err
+	}
+
+	// Restore images first so that instances never point to missing images
+	for _, image := range index.Images {
+		target := filepath.Join(cfg.ImageDir, image.Dir)
+		_, statErr := os.Stat(target)
+		exists := statErr == nil
+		switch {
+		case image.Embedded && (!exists || opts.OverwriteImages):
+			src := filepath.Join(stagingDir, "images", image.Dir)
+			if err := signature.VerifyImage(cfg, image.Ref, src); err != nil {
+				return nil, err
+			}
+			// The bundle may be extracted on another filesystem, so copy the image to a
+			// staging folder next to the target before moving it into place
+			staged, err := fsutil.StageDir(target)
+			if err != nil {
+				return nil, err
+			}
+			if err := copyDir(src, staged); err != nil {
+				os.RemoveAll(staged)
+				return nil, fmt.Errorf("failed to stage image %s: %w", image.Dir, err)
+			}
+			if err := fsutil.ReplaceDir(staged, target); err != nil {
+				os.RemoveAll(staged)
+				return nil, err
+			}
+			fmt.Fprintf(w, "Image %s restored to %s\n", image.Ref, target)
+		case exists:
+			fmt.Fprintf(w, "Image %s already exists locally\n", image.Ref)
+		case opts.Pull && image.Ref != image.Dir:
+			fmt.Fprintf(w, "Image %s not found locally. Pulling...\n", image.Ref)
+			if err := imagepull.PullImage(cfg, image.Ref, target, imagepull.Options{}); err != nil {
+				return nil, fmt.Errorf("failed to pull image %s: %w", image.Ref, err)
+			}
+		default:
+			fmt.Fprintf(w, "Warning: image %s is not available locally\n", image.Ref)
+		}
+	}
+
+	deployDir := cfg.GetDeployDir()
+	if err := os.MkdirAll(deployDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, item := range index.Instances {
+		src := filepath.Join(stagingDir, "instances", instance.FileName(item.Name, item.Enabled))
+		var data map[string]interface{}
+		if _, err := toml.DecodeFile(src, &data); err != nil {
+			return nil, fmt.Errorf("failed to parse instance %s: %w", item.Name, err)
+		}
+		rewritePaths(data, []pathReplacement{
+			{from: index.ImageDir, to: cfg.ImageDir},
+			{from: index.DeployDir, to: deployDir},
+		})
+
+		tomlPath := filepath.Join(deployDir, instance.FileName(item.Name, item.Enabled))
+		if err := instance.WriteFile(tomlPath, data); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(w, "Instance %s restored (%s)\n", item.Name, item.Status())
+	}
+	return &index, nil
+}
+
+// validate rejects image folders and instance names which would be written outside of the
+// image_dir and deploy_dir, or replace them entirely
+func (index *Index) validate() error {
+	for _, image := range index.Images {
+		if err := validateImageDir(image.Dir); err != nil {
+			return fmt.Errorf("invalid image %s in bundle: %w", image.Ref, err)
+		}
+	}
+	for _, item := range index.Instances {
+		if err := instance.ValidateName(item.Name); err != nil {
+			return fmt.Errorf("invalid instance in bundle: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateImageDir checks that dir is the name of a folder directly in the image_dir
+func validateImageDir(dir string) error {
+	if dir == "" || !filepath.IsLocal(dir) || strings.ContainsAny(dir, `/\`) || strings.HasPrefix(dir, ".") {
+		return fmt.Errorf("invalid image folder %q", dir)
+	}
+	return nil
+}
+
+// Status returns the status of the instance (enabled or disabled)
+func (i InstanceEntry) Status() string {
+	return instance.Entry{Name: i.Name, Enabled: i.Enabled}.Status()
+}
+
+// imageDirName returns the name of the image folder a script belongs to
+func imageDirName(imageDir string, script string) string {
+	rel, err := filepath.Rel(imageDir, script)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	dir, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+type pathReplacement struct {
+	from string
+	to   string
+}
+
+// rewritePaths replaces directory prefixes in all string values of a decoded TOML document.
+// The longest matching prefix wins and each value is rewritten at most once, so nested
+// folders (e.g. an image_dir inside the deploy_dir) are handled correctly.
+func rewritePaths(v any, replacements []pathReplacement) any {
+	switch value := v.(type) {
+	case string:
+		return rewritePath(value, replacements)
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = rewritePaths(item, replacements)
+		}
+	case []map[string]interface{}:
+		for _, item := range value {
+			rewritePaths(item, replacements)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = rewritePaths(item, replacements)
+		}
+	}
+	return v
+}
+
+func rewritePath(value string, replacements []pathReplacement) string {
+	best := -1
+	for i, r := range replacements {
+		if r.from == "" {
+			continue
+		}
+		from := strings.TrimSuffix(r.from, "/")
+		if value != from && !strings.HasPrefix(value, from+"/") {
+			continue
+		}
+		if best == -1 || len(from) > len(strings.TrimSuffix(replacements[best].from, "/")) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return value
+	}
+	rest := strings.TrimPrefix(value, strings.TrimSuffix(replacements[best].from, "/"))
+	return filepath.Join(replacements[best].to, rest)
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+	hdr := &tar.Header{
+		Name: name,
+		Size: int64(len(data)),
+		Mode: mode,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, bytes.NewReader(data))
+	return err
+}
+
+func addDirToTar(tw *tar.Writer, dir string, prefix string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hdr := &tar.Header{
+			Name: path.Join(prefix, filepath.ToSlash(rel)),
+			Size: info.Size(),
+			Mode: int64(info.Mode().Perm()),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// copyDir copies all regular files from src to dst
+func copyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// extract unpacks a tar.gz bundle into dir, rejecting entries which would escape dir
+func extract(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue // skip non-regular files
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid path in bundle: %s", hdr.Name)
+		}
+		outPath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		outFile, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm()|0600)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		if _, err := io.Copy(outFile, tr); err != nil {
+			outFile.Close()
+			return fmt.Errorf("failed to extract file: %w", err)
+		}
+		if err := outFile.Close(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+)
+
+func TestRewritePath(t *testing.T) {
+	replacements := []pathReplacement{
+		{from: "/etc/tedge/flows/images", to: "/data/images"},
+		{from: "/etc/tedge/flows", to: "/opt/tedge/flows"},
+	}
+	tests := map[string]string{
+		"/etc/tedge/flows/images/counter:1.0/dist/main.mjs": "/data/images/counter:1.0/dist/main.mjs",
+		"/etc/tedge/flows/shared.js":                        "/opt/tedge/flows/shared.js",
+		"/etc/tedge/flows":                                  "/opt/tedge/flows",
+		"/etc/tedge/flowsx/main.mjs":                        "/etc/tedge/flowsx/main.mjs",
+		"te/device/main///m/+":                              "te/device/main///m/+",
+	}
+	for input, want := range tests {
+		if got := rewritePath(input, replacements); got != want {
+			t.Errorf("rewritePath(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	root := t.TempDir()
+	return &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := newTestConfig(t)
+	script := filepath.Join(src.ImageDir, "counter:1.0", "dist", "main.mjs")
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("export function onMessage() {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.Deploy(src, instance.DeployOptions{Name: "a", Image: "ghcr.io/thin-edge/counter:1.0"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Export(src, &buf, ExportOptions{IncludeImages: true}); err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestConfig(t)
+	index, err := Import(dst, &buf, ImportOptions{}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Images) != 1 || index.Images[0].Dir != "counter:1.0" || len(index.Instances) != 1 {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+	if _, err := os.Stat(filepath.Join(dst.ImageDir, "counter:1.0", "dist", "main.mjs")); err != nil {
+		t.Fatalf("image not restored: %v", err)
+	}
+	restored, err := instance.Read(filepath.Join(dst.DeployDir, instance.FileName("a", true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Steps) == 0 || !strings.HasPrefix(restored.Steps[0].Script, dst.ImageDir+string(filepath.Separator)) {
+		t.Errorf("script not rewritten to the local image_dir: %+v", restored.Steps)
+	}
+}
+
+// craftBundle returns a bundle with an embedded image in the given folder
+func craftBundle(t *testing.T, dir string) *bytes.Buffer {
+	t.Helper()
+	index, err := json.Marshal(Index{Version: 1, Images: []ImageEntry{{Ref: "counter:1.0", Dir: dir, Embedded: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := writeTarFile(tw, IndexFile, index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTarFile(tw, "images/dist/main.mjs", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestImportRejectsInvalidImageDir(t *testing.T) {
+	for _, dir := range []string{"", ".", "..", "../../etc", "a/b", ".hidden"} {
+		cfg := newTestConfig(t)
+		existing := filepath.Join(cfg.ImageDir, "other:1.0", "flow.toml")
+		if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(existing, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Import(cfg, craftBundle(t, dir), ImportOptions{OverwriteImages: true}, io.Discard); err == nil {
+			t.Errorf("expected image folder %q to be rejected", dir)
+		}
+		if _, err := os.Stat(existing); err != nil {
+			t.Errorf("image_dir was modified by image folder %q: %v", dir, err)
+		}
+	}
+}
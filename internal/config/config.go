@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"oras.land/oras-go/v2/registry/remote/credentials"
@@ -18,16 +21,138 @@ type RegistryCredential struct {
 	Registry string `toml:"registry" json:"registry" yaml:"registry"`
 	Username string `toml:"username" json:"username" yaml:"username"`
 	Password string `toml:"password" json:"password" yaml:"password"`
+	// HTTP overrides the transport settings of the [http] section for the registry
+	HTTP HTTPConfig `toml:"http" json:"http" yaml:"http"`
+}
+
+// HTTPConfig configures the HTTP transport used for the registries and tarball downloads
+type HTTPConfig struct {
+	// HTTPSProxy overrides the HTTPS_PROXY environment variable, e.g. http://proxy:3128
+	HTTPSProxy string `toml:"https_proxy" json:"https_proxy" yaml:"https_proxy"`
+	// NoProxy overrides the NO_PROXY environment variable, e.g. "localhost,.local"
+	NoProxy string `toml:"no_proxy" json:"no_proxy" yaml:"no_proxy"`
+	// ConnectTimeout limits the time to establish a connection (default 30s)
+	ConnectTimeout string `toml:"connect_timeout" json:"connect_timeout" yaml:"connect_timeout"`
+	// ReadTimeout fails a request when no data is received for this long (default: no timeout)
+	ReadTimeout string `toml:"read_timeout" json:"read_timeout" yaml:"read_timeout"`
+	// MaxIdleConns is the number of idle (keep-alive) connections kept per host (default 2)
+	MaxIdleConns int `toml:"max_idle_conns" json:"max_idle_conns" yaml:"max_idle_conns"`
+	// UserAgent replaces the User-Agent header of the requests
+	UserAgent string `toml:"user_agent" json:"user_agent" yaml:"user_agent"`
+}
+
+// MQTTConfig overrides the MQTT settings which are otherwise read from the tedge config
+// dir (tedge.toml)
+type MQTTConfig struct {
+	Host          string `toml:"host" json:"host" yaml:"host"`
+	Port          int    `toml:"port" json:"port" yaml:"port"`
+	TopicRoot     string `toml:"topic_root" json:"topic_root" yaml:"topic_root"`
+	DeviceTopicID string `toml:"device_topic_id" json:"device_topic_id" yaml:"device_topic_id"`
+	// AutoPublish publishes the flow status after every change to the instances or images
+	AutoPublish bool `toml:"auto_publish" json:"auto_publish" yaml:"auto_publish"`
+}
+
+// AgentConfig configures the operation handler (tedge-oscar agent)
+type AgentConfig struct {
+	// Namespace is the prefix of the operation names, e.g. flow for flow_deploy and flow_remove
+	Namespace string `toml:"namespace" json:"namespace" yaml:"namespace"`
+}
+
+// WatchConfig configures the automatic update watcher (tedge-oscar watch)
+type WatchConfig struct {
+	// Interval is the time between two checks of the registries, e.g. 1h
+	Interval string `toml:"interval" json:"interval" yaml:"interval"`
+	// Jitter is the fraction of the interval by which each check is randomly moved, so a
+	// fleet of devices doesn't query the registries at the same time
+	Jitter float64 `toml:"jitter" json:"jitter" yaml:"jitter"`
+}
+
+// ReloadConfig configures how the flows runtime is notified after an instance changes
+type ReloadConfig struct {
+	// Type is the kind of hook: command, mqtt or systemd. No hook is run if empty.
+	Type string `toml:"type" json:"type" yaml:"type"`
+	// Command is a shell command, run for the command hook
+	Command string `toml:"command" json:"command" yaml:"command"`
+	// Unit is the systemd unit which is reloaded by the systemd hook
+	Unit string `toml:"unit" json:"unit" yaml:"unit"`
+	// Topic is where the mqtt hook publishes the reload message
+	Topic string `toml:"topic" json:"topic" yaml:"topic"`
+	// ConfirmTopic is where the runtime reports which flows are loaded. If set, the hook
+	// waits for the runtime to confirm the change.
+	ConfirmTopic string `toml:"confirm_topic" json:"confirm_topic" yaml:"confirm_topic"`
+	// Timeout is the maximum time to wait for the hook and the confirmation
+	Timeout string `toml:"timeout" json:"timeout" yaml:"timeout"`
+}
+
+// LogsConfig configures where "flows instances logs" reads the logs of the flows runtime
+type LogsConfig struct {
+	// Source is journald (default), file or mqtt
+	Source string `toml:"source" json:"source" yaml:"source"`
+	// Unit is the systemd unit of the flows runtime, for the journald source
+	Unit string `toml:"unit" json:"unit" yaml:"unit"`
+	// File is the log file of the flows runtime, for the file source
+	File string `toml:"file" json:"file" yaml:"file"`
+	// Topic is the topic filter of the debug messages, for the mqtt source
+	Topic string `toml:"topic" json:"topic" yaml:"topic"`
+}
+
+// TestConfig configures the runner used by "flows test"
+type TestConfig struct {
+	// Runner is the command which runs a flow, with the {flow}, {flows_dir} and {script}
+	// placeholders
+	Runner string `toml:"runner" json:"runner" yaml:"runner"`
+	// Timeout is the maximum duration of each test case
+	Timeout string `toml:"timeout" json:"timeout" yaml:"timeout"`
+}
+
+// TrustConfig is the signature policy which is enforced when images are pulled or deployed
+type TrustConfig struct {
+	// Enforce rejects images of registries and namespaces which are not covered by a policy
+	Enforce bool `toml:"enforce" json:"enforce" yaml:"enforce"`
+	// Policies are matched by the longest scope
+	Policies []TrustPolicy `toml:"policy" json:"policy" yaml:"policy"`
+}
+
+// TrustPolicy lists the keys which are trusted to sign the images of a scope
+type TrustPolicy struct {
+	// Scope is a registry (ghcr.io), a registry and namespace (ghcr.io/thin-edge) or "*"
+	Scope string `toml:"scope" json:"scope" yaml:"scope"`
+	// Keys are the paths of the trusted public keys (PEM). Images of a scope without keys
+	// don't need to be signed.
+	Keys []string `toml:"keys" json:"keys" yaml:"keys"`
+}
+
+// PlatformConfig describes the device, to select the variant of multi-variant flow images
+type PlatformConfig struct {
+	// TedgeVersion overrides the thin-edge.io version reported by "tedge --version"
+	TedgeVersion string `toml:"tedge_version" json:"tedge_version" yaml:"tedge_version"`
+	// Labels are matched against the io.thin-edge.flow.<label> annotations of the variants
+	Labels map[string]string `toml:"labels" json:"labels" yaml:"labels"`
 }
 
 type Config struct {
 	ImageDir            string               `toml:"image_dir" json:"image_dir" yaml:"image_dir"`
 	DeployDir           string               `toml:"deploy_dir" json:"deploy_dir" yaml:"deploy_dir"`
 	Registries          []RegistryCredential `toml:"registries" json:"registries" yaml:"registries"`
+	LockTimeout         string               `toml:"lock_timeout" json:"lock_timeout" yaml:"lock_timeout"`
+	LimitRate           string               `toml:"limit_rate" json:"limit_rate" yaml:"limit_rate"`
+	MaxImageSize        string               `toml:"max_image_size" json:"max_image_size" yaml:"max_image_size"`
+	MQTT                MQTTConfig           `toml:"mqtt" json:"mqtt" yaml:"mqtt"`
+	Agent               AgentConfig          `toml:"agent" json:"agent" yaml:"agent"`
+	HTTP                HTTPConfig           `toml:"http" json:"http" yaml:"http"`
+	Watch               WatchConfig          `toml:"watch" json:"watch" yaml:"watch"`
+	Reload              ReloadConfig         `toml:"reload" json:"reload" yaml:"reload"`
+	Logs                LogsConfig           `toml:"logs" json:"logs" yaml:"logs"`
+	Test                TestConfig           `toml:"test" json:"test" yaml:"test"`
+	Trust               TrustConfig          `toml:"trust" json:"trust" yaml:"trust"`
+	Platform            PlatformConfig       `toml:"platform" json:"platform" yaml:"platform"`
 	UnexpandedImageDir  string               `toml:"-" json:"-" yaml:"-"`
 	UnexpandedDeployDir string               `toml:"-" json:"-" yaml:"-"`
 }
 
+// DefaultLockTimeout is how long commands wait for another tedge-oscar process to release its lock
+const DefaultLockTimeout = 30 * time.Second
+
 func DefaultConfigPath() string {
 	if envPath := os.Getenv("TEDGE_OSCAR_CONFIG"); envPath != "" {
 		return os.ExpandEnv(envPath)
@@ -53,13 +178,119 @@ func (c *Config) Expand() {
 	c.UnexpandedDeployDir = c.DeployDir
 	c.ImageDir = expandEnvVars(c.ImageDir)
 	c.DeployDir = expandEnvVars(c.DeployDir)
+	c.Logs.File = expandEnvVars(c.Logs.File)
+	for i := range c.Trust.Policies {
+		for j := range c.Trust.Policies[i].Keys {
+			c.Trust.Policies[i].Keys[j] = expandEnvVars(c.Trust.Policies[i].Keys[j])
+		}
+	}
+	c.HTTP.HTTPSProxy = expandEnvVars(c.HTTP.HTTPSProxy)
 	for i := range c.Registries {
+		c.Registries[i].HTTP.HTTPSProxy = expandEnvVars(c.Registries[i].HTTP.HTTPSProxy)
 		c.Registries[i].Registry = expandEnvVars(c.Registries[i].Registry)
 		c.Registries[i].Username = expandEnvVars(c.Registries[i].Username)
 		c.Registries[i].Password = expandEnvVars(c.Registries[i].Password)
 	}
 }
 
+// GetDeployDir returns the directory where instance files are written. It falls back to the
+// DEPLOY_DIR environment variable and then to a deployments folder next to the image_dir.
+func (c *Config) GetDeployDir() string {
+	deployDir := c.DeployDir
+	if deployDir == "" {
+		deployDir = os.Getenv("DEPLOY_DIR")
+	}
+	if deployDir == "" {
+		deployDir = filepath.Join(filepath.Dir(c.ImageDir), "deployments")
+	}
+	return deployDir
+}
+
+// GetLockTimeout returns the configured lock wait timeout, or DefaultLockTimeout if not set
+func (c *Config) GetLockTimeout() (time.Duration, error) {
+	if c.LockTimeout == "" {
+		return DefaultLockTimeout, nil
+	}
+	timeout, err := time.ParseDuration(c.LockTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lock_timeout: %w", err)
+	}
+	return timeout, nil
+}
+
+// GetHTTPConfig returns the transport settings of the [http] section, with the overrides of
+// the registries entry of host (a registry or the server of a tarball) applied
+func (c *Config) GetHTTPConfig(host string) HTTPConfig {
+	settings := c.HTTP
+	for _, reg := range c.Registries {
+		if reg.Registry != host {
+			continue
+		}
+		if reg.HTTP.HTTPSProxy != "" {
+			settings.HTTPSProxy = reg.HTTP.HTTPSProxy
+		}
+		if reg.HTTP.NoProxy != "" {
+			settings.NoProxy = reg.HTTP.NoProxy
+		}
+		if reg.HTTP.ConnectTimeout != "" {
+			settings.ConnectTimeout = reg.HTTP.ConnectTimeout
+		}
+		if reg.HTTP.ReadTimeout != "" {
+			settings.ReadTimeout = reg.HTTP.ReadTimeout
+		}
+		if reg.HTTP.MaxIdleConns != 0 {
+			settings.MaxIdleConns = reg.HTTP.MaxIdleConns
+		}
+		if reg.HTTP.UserAgent != "" {
+			settings.UserAgent = reg.HTTP.UserAgent
+		}
+	}
+	return settings
+}
+
+// GetLimitRate returns the maximum transfer rate to and from registries in bytes per second,
+// or 0 if it is not limited
+func (c *Config) GetLimitRate() (int64, error) {
+	rate, err := ParseSize(c.LimitRate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit_rate: %w", err)
+	}
+	return rate, nil
+}
+
+// GetMaxImageSize returns the maximum size of the images which are pulled in bytes, or 0 if
+// it is not limited
+func (c *Config) GetMaxImageSize() (int64, error) {
+	size, err := ParseSize(c.MaxImageSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max_image_size: %w", err)
+	}
+	return size, nil
+}
+
+// ParseSize parses a number of bytes with an optional unit, e.g. 512, 500k, 1.5M or 2GiB.
+// The units are powers of 1024 and are case-insensitive. An empty string is 0.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	upper := strings.ToUpper(s)
+	upper = strings.TrimSuffix(strings.TrimSuffix(upper, "IB"), "B")
+	multiplier := int64(1)
+	if i := len(upper) - 1; i >= 0 {
+		if exp := strings.IndexByte("KMGT", upper[i]); exp >= 0 {
+			multiplier = int64(1) << (10 * (exp + 1))
+			upper = upper[:i]
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 512, 500k, 1.5M or 2GiB", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
 func loadEmbeddedConfig() (*Config, error) {
 	var cfg Config
 	if err := toml.Unmarshal(embeddedConfig, &cfg); err != nil {
@@ -0,0 +1,122 @@
+package filelock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// FileName is the name of the lock file created in each locked directory
+const FileName = ".tedge-oscar.lock"
+
+const retryDelay = 100 * time.Millisecond
+
+// Mode controls whether a lock can be shared with other readers
+type Mode int
+
+const (
+	// Shared locks can be held by multiple read-only commands at the same time
+	Shared Mode = iota
+	// Exclusive locks are used by commands which modify the directory
+	Exclusive
+)
+
+func (m Mode) String() string {
+	if m == Exclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+// ErrTimeout is returned when a lock could not be acquired within the timeout
+var ErrTimeout = errors.New("timed out waiting for lock")
+
+// Lock is an advisory lock (flock) on a directory
+type Lock struct {
+	fl *flock.Flock
+}
+
+// Acquire takes an advisory lock on dir, waiting up to timeout if another process holds a
+// conflicting lock. A message is written to w (if not nil) when the lock is busy.
+//
+// Shared locks are best effort: if the directory does not exist or the lock file can't be
+// created due to permissions, the directory is read without a lock.
+func Acquire(dir string, mode Mode, timeout time.Duration, w io.Writer) (*Lock, error) {
+	if mode == Exclusive {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	path := filepath.Join(dir, FileName)
+	fl := flock.New(path, flock.SetPermissions(0644))
+
+	try := fl.TryLock
+	tryContext := fl.TryLockContext
+	if mode == Shared {
+		try = fl.TryRLock
+		tryContext = fl.TryRLockContext
+	}
+
+	locked, err := try()
+	if err != nil {
+		if mode == Shared && (errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission)) {
+			return &Lock{}, nil
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	if locked {
+		return &Lock{fl: fl}, nil
+	}
+
+	if timeout <= 0 {
+		return nil, fmt.Errorf("%w: %s is locked by another tedge-oscar process", ErrTimeout, dir)
+	}
+	if w != nil {
+		fmt.Fprintf(w, "Waiting up to %s for another tedge-oscar process to release the lock on %s\n", timeout, dir)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	locked, err = tryContext(ctx, retryDelay)
+	if !locked {
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %s is still locked by another tedge-oscar process after %s (lock file: %s)", ErrTimeout, dir, timeout, path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return &Lock{fl: fl}, nil
+}
+
+// Unlock releases the lock. It is safe to call on a nil or no-op lock.
+func (l *Lock) Unlock() error {
+	if l == nil || l.fl == nil {
+		return nil
+	}
+	return l.fl.Unlock()
+}
+
+// AcquireAll locks each directory in the given order (always image_dir before deploy_dir
+// to avoid deadlocks). The returned function releases all of the locks.
+func AcquireAll(dirs []string, mode Mode, timeout time.Duration, w io.Writer) (func(), error) {
+	locks := make([]*Lock, 0, len(dirs))
+	unlock := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			_ = locks[i].Unlock()
+		}
+	}
+	for _, dir := range dirs {
+		lock, err := Acquire(dir, mode, timeout, w)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return unlock, nil
+}
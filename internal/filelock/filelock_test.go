@@ -0,0 +1,46 @@
+package filelock
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	dir := t.TempDir()
+
+	exclusive, err := Acquire(dir, Exclusive, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Acquire(dir, Shared, 0, nil); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected shared lock to time out while an exclusive lock is held, got: %v", err)
+	}
+	if err := exclusive.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	shared1, err := Acquire(dir, Shared, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared1.Unlock()
+	shared2, err := Acquire(dir, Shared, 0, nil)
+	if err != nil {
+		t.Errorf("expected multiple shared locks to be allowed, got: %v", err)
+	}
+	defer shared2.Unlock()
+	if _, err := Acquire(dir, Exclusive, retryDelay*2, nil); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected exclusive lock to time out while a shared lock is held, got: %v", err)
+	}
+}
+
+func TestAcquireSharedMissingDir(t *testing.T) {
+	lock, err := Acquire(filepath.Join(t.TempDir(), "missing"), Shared, 0, nil)
+	if err != nil {
+		t.Fatalf("expected shared lock on a missing directory to be a no-op, got: %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
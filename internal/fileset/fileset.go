@@ -0,0 +1,263 @@
+// Package fileset expands the files and directories of a flow image, honouring .flowignore
+// files (gitignore syntax) and include/exclude globs.
+package fileset
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// IgnoreFile is the name of the files listing the paths which are not part of an image
+const IgnoreFile = ".flowignore"
+
+// vcsDirs are the version control folders which are never part of an image
+var vcsDirs = map[string]bool{".git": true, ".hg": true, ".svn": true}
+
+// Options filters the expanded files
+type Options struct {
+	// Include globs: if set, only files matching one of them are kept
+	Include []string
+	// Exclude globs: files and directories matching one of them are skipped
+	Exclude []string
+}
+
+// Expand returns the files of paths, expanding directories recursively. Version control
+// folders such as .git are skipped, as are files below a directory which are ignored by a
+// .flowignore file in rootDir or in the directory tree; explicitly listed files are always
+// kept. Globs without a slash match the base name, other globs match the path relative to
+// rootDir. "**" matches any number of directories. The result is sorted and free of duplicates.
+func Expand(rootDir string, paths []string, opts Options) ([]string, error) {
+	include, err := compileGlobs(opts.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compileGlobs(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	ignore := &ignoreRules{}
+	if err := ignore.load(rootDir, ""); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var files []string
+	keep := func(p string, rel string) {
+		if len(include) > 0 && !matchAny(include, rel) {
+			return
+		}
+		if !seen[p] {
+			seen[p] = true
+			files = append(files, p)
+		}
+	}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		rel := relPath(rootDir, p)
+		if !info.IsDir() {
+			if !matchAny(exclude, rel) {
+				keep(p, rel)
+			}
+			continue
+		}
+		err = filepath.WalkDir(p, func(walkPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := relPath(rootDir, walkPath)
+			isDir := d.IsDir()
+			if isDir && vcsDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			if walkPath != p && (matchAny(exclude, rel) || ignore.ignored(rel, isDir)) {
+				if isDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if isDir {
+				if filepath.Clean(walkPath) != filepath.Clean(rootDir) {
+					return ignore.load(walkPath, rel)
+				}
+				return nil
+			}
+			if d.Type().IsRegular() && d.Name() != IgnoreFile {
+				keep(walkPath, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files in %s: %w", p, err)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// relPath returns the path of p relative to rootDir, using forward slashes. Paths outside of
+// rootDir are returned as is, so globs still apply to them.
+func relPath(rootDir string, p string) string {
+	rel, err := filepath.Rel(rootDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = p
+	}
+	return filepath.ToSlash(rel)
+}
+
+type glob struct {
+	re       *regexp.Regexp
+	basename bool
+}
+
+func (g glob) match(rel string) bool {
+	if g.basename {
+		return g.re.MatchString(path.Base(rel))
+	}
+	return g.re.MatchString(rel)
+}
+
+func compileGlobs(patterns []string) ([]glob, error) {
+	var globs []glob
+	for _, p := range patterns {
+		re, err := globRegexp(strings.TrimPrefix(p, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", p, err)
+		}
+		globs = append(globs, glob{re: re, basename: !strings.Contains(p, "/")})
+	}
+	return globs, nil
+}
+
+func matchAny(globs []glob, rel string) bool {
+	for _, g := range globs {
+		if g.match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// globRegexp converts a gitignore style glob into a regular expression
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			if i+1 < len(pattern) && pattern[i+1] == '/' {
+				i++
+				b.WriteString("(?:.*/)?")
+			} else {
+				b.WriteString(".*")
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+type ignoreRule struct {
+	// base is the directory of the .flowignore file, relative to the root
+	base    string
+	glob    glob
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules are the rules of all .flowignore files found so far
+type ignoreRules struct {
+	rules []ignoreRule
+}
+
+// load reads the .flowignore file of dir, if any. base is the path of dir relative to the root.
+func (r *ignoreRules) load(dir string, base string) error {
+	f, err := os.Open(filepath.Join(dir, IgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A pattern with a slash is relative to the .flowignore file, otherwise it matches
+		// at any depth
+		rule.glob.basename = !strings.Contains(line, "/")
+		re, err := globRegexp(strings.TrimPrefix(line, "/"))
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q in %s: %w", line, f.Name(), err)
+		}
+		rule.glob.re = re
+		r.rules = append(r.rules, rule)
+	}
+	return scanner.Err()
+}
+
+// ignored reports whether the path (relative to the root) is ignored. The last matching
+// rule wins, so a negated rule can re-include a file.
+func (r *ignoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		sub := rel
+		if rule.base != "" {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+			sub = strings.TrimPrefix(rel, rule.base+"/")
+		}
+		if rule.glob.match(sub) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,94 @@
+package fileset
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func relFiles(t *testing.T, dir string, files []string) []string {
+	t.Helper()
+	rel := []string{}
+	for _, f := range files {
+		r, err := filepath.Rel(dir, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	return rel
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".flowignore":             "# build output\n*.map\nnode_modules/\n/scratch.txt\n!keep.map\n",
+		"flow.toml":               "",
+		"scratch.txt":             "",
+		"dist/main.mjs":           "",
+		"dist/main.mjs.map":       "",
+		"dist/keep.map":           "",
+		"dist/vendor/lib..v2.js":  "",
+		"dist/scratch.txt":        "",
+		"node_modules/x/index.js": "",
+		"tests/.flowignore":       "*.tmp\n",
+		"tests/a.input.jsonl":     "",
+		"tests/a.tmp":             "",
+		".git/HEAD":               "",
+	})
+
+	tests := []struct {
+		name  string
+		paths []string
+		opts  Options
+		want  []string
+	}{
+		{
+			name:  "flowignore",
+			paths: []string{dir},
+			want:  []string{"dist/keep.map", "dist/main.mjs", "dist/scratch.txt", "dist/vendor/lib..v2.js", "flow.toml", "tests/a.input.jsonl"},
+		},
+		{
+			name:  "explicit files are kept",
+			paths: []string{filepath.Join(dir, "scratch.txt"), filepath.Join(dir, "dist")},
+			want:  []string{"dist/keep.map", "dist/main.mjs", "dist/scratch.txt", "dist/vendor/lib..v2.js", "scratch.txt"},
+		},
+		{
+			name:  "include and exclude",
+			paths: []string{dir},
+			opts:  Options{Include: []string{"**/*.js", "*.mjs"}, Exclude: []string{"vendor"}},
+			want:  []string{"dist/main.mjs"},
+		},
+		{
+			name:  "exclude path",
+			paths: []string{dir},
+			opts:  Options{Exclude: []string{"dist/**", "tests/*.jsonl"}},
+			want:  []string{"flow.toml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := Expand(dir, tt.paths, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := relFiles(t, dir, files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+// Package flowproject scaffolds, validates and builds flow projects, i.e. the source folder
+// of a flow image.
+package flowproject
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+
+	"github.com/thin-edge/tedge-oscar/internal/fileset"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/imagepush"
+)
+
+//go:embed all:templates
+var templates embed.FS
+
+// Entrypoint is the script of a flow, relative to the project folder
+const Entrypoint = "dist/main.mjs"
+
+// DefaultBuildDir is the output folder of a build, relative to the project folder
+const DefaultBuildDir = "build"
+
+// DefinitionFiles are the supported flow definition files, in priority order
+var DefinitionFiles = []string{"flow.toml", "pipeline.toml"}
+
+// includedDirs are the folders of a project which are part of the image, in addition to
+// the flow definition and README.md
+var includedDirs = []string{"dist", "tests"}
+
+// entrypointExport matches the functions the flows runtime calls
+var entrypointExport = regexp.MustCompile(`export\s+(?:async\s+)?(?:function\*?|const|let|var)\s+(?:onMessage|onInterval|process)\b|export\s*\{[^}]*\b(?:onMessage|onInterval|process)\b`)
+
+// Init creates a flow project named name in dir. It fails if dir already contains files,
+// unless force is set, in which case existing files are overwritten.
+// It returns the created files, relative to dir.
+func Init(dir string, name string, force bool) ([]string, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 && !force {
+		return nil, fmt.Errorf("directory %s is not empty, use --force to overwrite the existing files", dir)
+	}
+	data := struct{ Name string }{Name: name}
+	var created []string
+	err := fs.WalkDir(templates, "templates", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel := strings.TrimPrefix(p, "templates/")
+		// Dot files are stored without the dot, so the template folder is not affected by them
+		if rel == "gitignore" {
+			rel = ".gitignore"
+		}
+		tmpl, err := template.ParseFS(templates, p)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		err = fsutil.WriteFileAtomic(dest, 0644, func(w io.Writer) error {
+			return tmpl.Execute(w, data)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", dest, err)
+		}
+		created = append(created, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The entrypoint is created by the JS build, but an initial copy makes the project
+	// buildable (and testable) right away
+	src := filepath.Join(dir, "src", "main.mjs")
+	if err := copyFile(src, filepath.Join(dir, filepath.FromSlash(Entrypoint))); err != nil {
+		return nil, err
+	}
+	created = append(created, Entrypoint)
+	sort.Strings(created)
+	return created, nil
+}
+
+// Project is a validated flow project
+type Project struct {
+	Dir string
+	// Definition is the path of the flow definition (flow.toml or pipeline.toml)
+	Definition string
+	// Files are the paths of all files which are part of the image
+	Files []string
+}
+
+// Load validates the layout of a flow project: it must contain a flow definition with at
+// least one step, and an entrypoint which exports a function called by the flows runtime.
+// Files of dist/ and tests/ which are listed in a .flowignore file are not part of the image.
+func Load(dir string) (*Project, error) {
+	p := &Project{Dir: dir}
+	for _, name := range DefinitionFiles {
+		candidate := filepath.Join(dir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			p.Definition = candidate
+			break
+		}
+	}
+	if p.Definition == "" {
+		return nil, fmt.Errorf("no flow definition found in %s, expected one of: %s", dir, strings.Join(DefinitionFiles, ", "))
+	}
+	var definition map[string]interface{}
+	if _, err := toml.DecodeFile(p.Definition, &definition); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", p.Definition, err)
+	}
+	// Steps are decoded as a slice of maps for [[steps]] tables, or of interfaces for inline arrays
+	numSteps := 0
+	switch steps := definition["steps"].(type) {
+	case []map[string]interface{}:
+		numSteps = len(steps)
+	case []interface{}:
+		numSteps = len(steps)
+	}
+	if numSteps == 0 {
+		return nil, fmt.Errorf("%s must define at least one step ([[steps]])", p.Definition)
+	}
+
+	entrypoint := filepath.Join(dir, filepath.FromSlash(Entrypoint))
+	script, err := os.ReadFile(entrypoint)
+	if err != nil {
+		return nil, fmt.Errorf("entrypoint %s not found, build the flow script first: %w", Entrypoint, err)
+	}
+	if !entrypointExport.Match(script) {
+		return nil, fmt.Errorf("entrypoint %s does not export an onMessage, onInterval or process function", Entrypoint)
+	}
+
+	p.Files = append(p.Files, p.Definition)
+	if readme := filepath.Join(dir, "README.md"); fileExists(readme) {
+		p.Files = append(p.Files, readme)
+	}
+	var dirs []string
+	for _, sub := range includedDirs {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err == nil && info.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, sub))
+		}
+	}
+	files, err := fileset.Expand(dir, dirs, fileset.Options{})
+	if err != nil {
+		return nil, err
+	}
+	p.Files = append(p.Files, files...)
+	return p, nil
+}
+
+// RelFiles returns the files of the image relative to the project folder, using forward slashes
+func (p *Project) RelFiles() []string {
+	rel := make([]string, 0, len(p.Files))
+	for _, f := range p.Files {
+		r, _ := filepath.Rel(p.Dir, f)
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	return rel
+}
+
+// Build copies the files of the image to outDir, replacing it atomically. The folder can be
+// pushed with "images push --dir". An existing outDir which isn't the output of a previous
+// build is only replaced if force is set.
+func (p *Project) Build(outDir string, force bool) error {
+	if err := p.checkOutDir(outDir, force, isBuildDir); err != nil {
+		return err
+	}
+	staging, err := fsutil.StageDir(outDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	for i, rel := range p.RelFiles() {
+		if err := copyFile(p.Files[i], filepath.Join(staging, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return fsutil.ReplaceDir(staging, outDir)
+}
+
+// BuildOCILayout packs the files of the image into an OCI image layout in outDir, tagged with
+// tag. The layout can be pushed with "images push --oci-layout". An existing outDir which
+// isn't an OCI image layout is only replaced if force is set.
+func (p *Project) BuildOCILayout(outDir string, ociType string, tag string, force bool) (ocispec.Descriptor, error) {
+	if err := p.checkOutDir(outDir, force, isOCILayout); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	staging, err := fsutil.StageDir(outDir)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.RemoveAll(staging)
+	ctx := context.Background()
+	store, err := oci.NewWithContext(ctx, staging)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	// The target registry is not known yet, so use the manifest format all registries accept
+	desc, err := imagepush.PackFiles(ctx, store, p.Files, p.Dir, imagepush.PackOptions{
+		ArtifactType: ociType,
+		Legacy:       true,
+		Annotations:  imagepush.DefaultAnnotations("", p.Dir),
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := store.Tag(ctx, desc, tag); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to tag image: %w", err)
+	}
+	return desc, fsutil.ReplaceDir(staging, outDir)
+}
+
+// checkOutDir refuses to replace the project folder, or an existing folder with other files
+// than a previous build, as isBuild reports, unless force is set
+func (p *Project) checkOutDir(outDir string, force bool, isBuild func(dir string) bool) error {
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return err
+	}
+	absProject, err := filepath.Abs(p.Dir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(absOut, absProject); err == nil && filepath.IsLocal(rel) {
+		return fmt.Errorf("output directory %s must not contain the project", outDir)
+	}
+	entries, err := os.ReadDir(outDir)
+	if err != nil || len(entries) == 0 || force || isBuild(outDir) {
+		return nil
+	}
+	return fmt.Errorf("directory %s is not empty and not the output of a build, use --force to replace it", outDir)
+}
+
+// isBuildDir reports whether dir only contains files which are part of an image
+func isBuildDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	allowed := append([]string{"README.md"}, DefinitionFiles...)
+	allowed = append(allowed, includedDirs...)
+	for _, entry := range entries {
+		if !slices.Contains(allowed, entry.Name()) {
+			return false
+		}
+	}
+	return true
+}
+
+// isOCILayout reports whether dir is an OCI image layout
+func isOCILayout(dir string) bool {
+	return fileExists(filepath.Join(dir, ocispec.ImageLayoutFile))
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// ProjectName returns the default project name of a folder
+func ProjectName(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return filepath.Base(abs)
+	}
+	return filepath.Base(dir)
+}
@@ -0,0 +1,137 @@
+package flowproject
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestInitLoadBuild(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "my-flow")
+	created, err := Init(dir, "my-flow", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) == 0 {
+		t.Fatal("expected files to be created")
+	}
+	definition, err := os.ReadFile(filepath.Join(dir, "flow.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(definition), "my-flow") {
+		t.Errorf("expected the project name in flow.toml:\n%s", definition)
+	}
+	if _, err := Init(dir, "my-flow", false); err == nil {
+		t.Error("expected Init to fail on a non empty directory")
+	}
+
+	project, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"flow.toml", "README.md", "dist/main.mjs", "tests/passthrough.expected.jsonl", "tests/passthrough.input.jsonl"}
+	if got := project.RelFiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected image files: got %v, want %v", got, want)
+	}
+
+	outDir := filepath.Join(dir, DefaultBuildDir)
+	if err := project.Build(outDir, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range want {
+		if _, err := os.Stat(filepath.Join(outDir, filepath.FromSlash(f))); err != nil {
+			t.Errorf("expected %s in the build output: %v", f, err)
+		}
+	}
+
+	layoutDir := filepath.Join(t.TempDir(), "my-flow.oci")
+	desc, err := project.BuildOCILayout(layoutDir, "application/vnd.tedge.flow.v1", "1.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := oci.New(layoutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Resolve(context.Background(), "1.0"); err != nil || got.Digest != desc.Digest {
+		t.Errorf("expected tag 1.0 to resolve to %s, got %v (%v)", desc.Digest, got.Digest, err)
+	}
+}
+
+func TestBuildExistingOutput(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "my-flow")
+	if _, err := Init(dir, "my-flow", false); err != nil {
+		t.Fatal(err)
+	}
+	project, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, outDir := range []string{dir, root} {
+		if err := project.Build(outDir, true); err == nil {
+			t.Errorf("expected a build into %s, which contains the project, to fail", outDir)
+		}
+	}
+
+	// A folder with other files is only replaced with force
+	outDir := filepath.Join(root, "shared")
+	notes := filepath.Join(outDir, "notes.txt")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(notes, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.Build(outDir, false); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("expected the build to refuse the folder, got %v", err)
+	}
+	if _, err := project.BuildOCILayout(outDir, "application/vnd.tedge.flow.v1", "1.0", false); err == nil {
+		t.Error("expected the OCI build to refuse the folder")
+	}
+	if _, err := os.Stat(notes); err != nil {
+		t.Fatalf("expected the existing files to be kept: %v", err)
+	}
+	if err := project.Build(outDir, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output of a previous build is replaced
+	if err := project.Build(outDir, false); err != nil {
+		t.Fatal(err)
+	}
+	layoutDir := filepath.Join(root, "my-flow.oci")
+	for i := 0; i < 2; i++ {
+		if _, err := project.BuildOCILayout(layoutDir, "application/vnd.tedge.flow.v1", "1.0", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "no flow definition") {
+		t.Errorf("expected a missing definition error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "flow.toml"), []byte("[[steps]]\nscript = \"main.mjs\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "entrypoint") {
+		t.Errorf("expected a missing entrypoint error, got %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dist", "main.mjs"), []byte("function onMessage() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "does not export") {
+		t.Errorf("expected a missing export error, got %v", err)
+	}
+}
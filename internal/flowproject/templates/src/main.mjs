@@ -0,0 +1,9 @@
+// {{.Name}}: called by the flows runtime for every input message.
+// Return the list of messages to publish.
+export function onMessage(message, config) {
+  const payload = JSON.parse(message.payload);
+  return [{
+    topic: message.topic,
+    payload: JSON.stringify(payload),
+  }];
+}
@@ -0,0 +1,321 @@
+// Package flowtest runs sample messages through a flow and compares the output with the
+// expected messages stored in the tests/ directory of a flow image.
+//
+// A test case is a pair of JSON lines files: tests/<name>.input.jsonl with the messages
+// fed to the flow, and tests/<name>.expected.jsonl with the messages the flow should output.
+// Each line is an object with a topic and a payload, e.g.
+//
+//	{"topic": "te/device/main///m/env", "payload": {"temperature": 23.5}}
+//
+// A payload which is not a JSON string is passed to the flow as compact JSON text.
+package flowtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+)
+
+// DefaultRunner runs the flow with the tedge flows runtime
+const DefaultRunner = "tedge flows test --flows-dir {flows_dir} --flow {flow}"
+
+// DefaultTimeout is the maximum duration of a test case if no timeout is configured
+const DefaultTimeout = 30 * time.Second
+
+// TestsDir is the folder of a flow image which contains the test cases
+const TestsDir = "tests"
+
+const (
+	inputSuffix    = ".input.jsonl"
+	expectedSuffix = ".expected.jsonl"
+)
+
+// Message is an MQTT message fed to or output by a flow
+type Message struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+// UnmarshalJSON accepts the payload as a string or as any other JSON value
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Topic   string          `json:"topic"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Topic = raw.Topic
+	if err := json.Unmarshal(raw.Payload, &m.Payload); err != nil {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, raw.Payload); err != nil {
+			return err
+		}
+		m.Payload = compact.String()
+	}
+	return nil
+}
+
+// Case is a test case of a flow
+type Case struct {
+	Name  string
+	Input []Message
+	// Expected is nil if the output of the flow is not checked
+	Expected []Message
+}
+
+// Result is the outcome of a test case
+type Result struct {
+	Case     Case
+	Output   []Message
+	Duration time.Duration
+	// Failure describes why the output did not match the expected messages
+	Failure string
+	// Err is set if the flow could not be run
+	Err error
+}
+
+// Passed reports whether the test case passed
+func (r Result) Passed() bool {
+	return r.Err == nil && r.Failure == ""
+}
+
+// ReadMessages reads a JSON lines file of messages. Empty lines are skipped.
+func ReadMessages(path string) ([]Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	messages := []Message{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid message: %w", path, lineNum, err)
+		}
+		messages = append(messages, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return messages, nil
+}
+
+// LoadCases returns the test cases in the tests/ directory of a flow, sorted by name.
+// A missing tests/ directory is treated as empty.
+func LoadCases(flowDir string) ([]Case, error) {
+	inputs, err := filepath.Glob(filepath.Join(flowDir, TestsDir, "*"+inputSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(inputs)
+	var cases []Case
+	for _, input := range inputs {
+		c, err := LoadCase(input)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// LoadCase loads the test case of an input file. The expected messages are read from the
+// <name>.expected.jsonl file next to it, if it exists.
+func LoadCase(inputPath string) (Case, error) {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(inputPath), inputSuffix), ".jsonl")
+	input, err := ReadMessages(inputPath)
+	if err != nil {
+		return Case{}, err
+	}
+	c := Case{Name: name, Input: input}
+	expectedPath := filepath.Join(filepath.Dir(inputPath), name+expectedSuffix)
+	if _, err := os.Stat(expectedPath); err == nil {
+		if c.Expected, err = ReadMessages(expectedPath); err != nil {
+			return Case{}, err
+		}
+	}
+	return c, nil
+}
+
+// Runner runs test cases of a flow through an external runtime
+type Runner struct {
+	// Command is the runner command, see DefaultRunner. The messages are written to its stdin
+	// and read from its stdout as "[topic] payload" lines. Other output lines are ignored.
+	Command string
+	Timeout time.Duration
+	// Log receives the stderr of the runner
+	Log io.Writer
+}
+
+// Run renders the flow of flowDir (the same way as it is deployed) into a temporary flows
+// directory and runs each test case in a separate runner process, with the temporary
+// directory as working directory
+func (r Runner) Run(flowDir string, cases []Case) ([]Result, error) {
+	sandbox, err := os.MkdirTemp("", "tedge-oscar-test-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(sandbox)
+
+	name := filepath.Base(filepath.Clean(flowDir))
+	data, err := instance.RenderDir(flowDir, instance.DeployOptions{Name: name, Image: name})
+	if err != nil {
+		return nil, err
+	}
+	delete(data, instance.MetadataKey)
+	flowsDir := filepath.Join(sandbox, "flows")
+	if err := os.MkdirAll(flowsDir, 0755); err != nil {
+		return nil, err
+	}
+	flowPath := filepath.Join(flowsDir, "flow.toml")
+	f, err := os.Create(flowPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := toml.NewEncoder(f).Encode(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	args, err := r.args(map[string]string{
+		"{flow}":      flowPath,
+		"{flows_dir}": flowsDir,
+		"{script}":    filepath.Join(flowDir, "dist", "main.mjs"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, 0, len(cases))
+	for _, c := range cases {
+		start := time.Now()
+		output, err := r.runCase(sandbox, args, c.Input)
+		result := Result{Case: c, Output: output, Duration: time.Since(start), Err: err}
+		if err == nil && c.Expected != nil {
+			result.Failure = Compare(c.Expected, output)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (r Runner) args(placeholders map[string]string) ([]string, error) {
+	command := r.Command
+	if command == "" {
+		command = DefaultRunner
+	}
+	// The command is split before the placeholders are replaced, so paths may contain spaces
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("the test runner command is empty")
+	}
+	for i, arg := range args {
+		for placeholder, value := range placeholders {
+			arg = strings.ReplaceAll(arg, placeholder, value)
+		}
+		args[i] = arg
+	}
+	return args, nil
+}
+
+func (r Runner) runCase(dir string, args []string, input []Message) ([]Message, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdin bytes.Buffer
+	for _, m := range input {
+		fmt.Fprintf(&stdin, "[%s] %s\n", m.Topic, m.Payload)
+	}
+	var stdout bytes.Buffer
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Dir = dir
+	c.Stdin = &stdin
+	c.Stdout = &stdout
+	if r.Log != nil {
+		c.Stderr = r.Log
+	}
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("test runner timed out after %s", timeout)
+		}
+		return nil, fmt.Errorf("test runner failed: %w", err)
+	}
+	return parseOutput(stdout.String()), nil
+}
+
+// parseOutput returns the "[topic] payload" lines of the runner output
+func parseOutput(output string) []Message {
+	messages := []Message{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		topic, payload, ok := strings.Cut(line[1:], "] ")
+		if !ok {
+			topic, ok = strings.CutSuffix(line[1:], "]")
+			if !ok {
+				continue
+			}
+		}
+		messages = append(messages, Message{Topic: topic, Payload: payload})
+	}
+	return messages
+}
+
+// Compare returns a description of the first difference between the expected and actual
+// messages, or an empty string if they match. JSON payloads are compared by value.
+func Compare(expected []Message, actual []Message) string {
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		if expected[i].Topic != actual[i].Topic {
+			return fmt.Sprintf("message %d: expected topic %q, got %q", i+1, expected[i].Topic, actual[i].Topic)
+		}
+		if !equalPayload(expected[i].Payload, actual[i].Payload) {
+			return fmt.Sprintf("message %d (%s): expected payload %s, got %s", i+1, expected[i].Topic, expected[i].Payload, actual[i].Payload)
+		}
+	}
+	if len(expected) != len(actual) {
+		return fmt.Sprintf("expected %d message(s), got %d", len(expected), len(actual))
+	}
+	return ""
+}
+
+func equalPayload(expected string, actual string) bool {
+	if expected == actual {
+		return true
+	}
+	var e, a any
+	if json.Unmarshal([]byte(expected), &e) != nil || json.Unmarshal([]byte(actual), &a) != nil {
+		return false
+	}
+	return reflect.DeepEqual(e, a)
+}
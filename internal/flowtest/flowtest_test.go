@@ -0,0 +1,65 @@
+package flowtest
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	flowDir := t.TempDir()
+	writeFile(t, filepath.Join(flowDir, "dist", "main.mjs"), "")
+	writeFile(t, filepath.Join(flowDir, "flow.toml"), "[[steps]]\n")
+	input := `{"topic": "te/device/main///m/env", "payload": {"temperature": 23.5}}` + "\n"
+	writeFile(t, filepath.Join(flowDir, "tests", "echo.input.jsonl"), input)
+	writeFile(t, filepath.Join(flowDir, "tests", "echo.expected.jsonl"), `{"topic": "te/device/main///m/env", "payload": "{ \"temperature\": 23.5 }"}`+"\n")
+	writeFile(t, filepath.Join(flowDir, "tests", "wrong.input.jsonl"), input)
+	writeFile(t, filepath.Join(flowDir, "tests", "wrong.expected.jsonl"), `{"topic": "te/device/main///m/env", "payload": {"temperature": 0}}`+"\n")
+
+	cases, err := LoadCases(flowDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 || cases[0].Name != "echo" || cases[1].Name != "wrong" {
+		t.Fatalf("unexpected test cases: %+v", cases)
+	}
+
+	// cat outputs the input messages unchanged
+	results, err := Runner{Command: "cat"}.Run(flowDir, cases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !results[0].Passed() {
+		t.Errorf("expected echo to pass: %s %v", results[0].Failure, results[0].Err)
+	}
+	if results[1].Passed() || !strings.Contains(results[1].Failure, "expected payload") {
+		t.Errorf("expected wrong to fail, got %+v", results[1])
+	}
+
+	var tap bytes.Buffer
+	if err := WriteReport(&tap, FormatTAP, "flow", results); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(tap.String(), "1..2\nok 1 - echo\nnot ok 2 - wrong\n") {
+		t.Errorf("unexpected TAP report:\n%s", tap.String())
+	}
+	var junit bytes.Buffer
+	if err := WriteReport(&junit, FormatJUnit, "flow", results); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(junit.String(), `<testsuite name="flow" tests="2" failures="1" errors="0"`) {
+		t.Errorf("unexpected JUnit report:\n%s", junit.String())
+	}
+}
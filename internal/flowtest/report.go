@@ -0,0 +1,124 @@
+package flowtest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Report formats
+const (
+	FormatJUnit = "junit"
+	FormatTAP   = "tap"
+)
+
+// WriteReport writes the results in the given format (junit or tap)
+func WriteReport(w io.Writer, format string, suite string, results []Result) error {
+	switch format {
+	case FormatJUnit:
+		return WriteJUnit(w, suite, results)
+	case FormatTAP:
+		return WriteTAP(w, results)
+	}
+	return fmt.Errorf("unknown report format %q, expected %s or %s", format, FormatJUnit, FormatTAP)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the results as a JUnit XML report
+func WriteJUnit(w io.Writer, suite string, results []Result) error {
+	s := junitTestSuite{Name: suite, Tests: len(results)}
+	var total time.Duration
+	for _, r := range results {
+		total += r.Duration
+		tc := junitTestCase{
+			Name:      r.Case.Name,
+			ClassName: suite,
+			Time:      seconds(r.Duration),
+			SystemOut: formatMessages(r.Output),
+		}
+		switch {
+		case r.Err != nil:
+			s.Errors++
+			tc.Error = &junitMessage{Message: r.Err.Error()}
+		case r.Failure != "":
+			s.Failures++
+			tc.Failure = &junitMessage{Message: r.Failure, Text: "expected:\n" + formatMessages(r.Case.Expected)}
+		}
+		s.Cases = append(s.Cases, tc)
+	}
+	s.Time = seconds(total)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{s}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteTAP writes the results in the Test Anything Protocol (version 13)
+func WriteTAP(w io.Writer, results []Result) error {
+	var b strings.Builder
+	b.WriteString("TAP version 13\n")
+	fmt.Fprintf(&b, "1..%d\n", len(results))
+	for i, r := range results {
+		if r.Passed() {
+			fmt.Fprintf(&b, "ok %d - %s\n", i+1, r.Case.Name)
+			continue
+		}
+		fmt.Fprintf(&b, "not ok %d - %s\n", i+1, r.Case.Name)
+		message := r.Failure
+		if r.Err != nil {
+			message = r.Err.Error()
+		}
+		b.WriteString("  ---\n")
+		fmt.Fprintf(&b, "  message: %q\n", message)
+		b.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatMessages(messages []Message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&b, "[%s] %s\n", m.Topic, m.Payload)
+	}
+	return b.String()
+}
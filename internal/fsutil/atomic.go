@@ -0,0 +1,171 @@
+package fsutil
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// WriteFileAtomic writes a file by streaming the content into a temporary file in the
+// same directory, syncing it to disk and then renaming it over path. Readers will either
+// see the old file or the complete new file, never a partially written one.
+//
+// The temporary file is prefixed with a "." and does not keep the original extension so
+// that directory watchers (e.g. tedge-flows watching *.toml) ignore it.
+func WriteFileAtomic(path string, perm os.FileMode, write func(w io.Writer) error) (err error) {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err = write(f); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// StageDir creates an empty hidden staging directory next to dest which can be populated
+// and then moved into place using ReplaceDir. The parent directory is created if needed.
+func StageDir(dest string) (string, error) {
+	parent := filepath.Dir(dest)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(parent, "."+filepath.Base(dest)+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to set staging directory permissions: %w", err)
+	}
+	return dir, nil
+}
+
+// ReplaceDir syncs the contents of the staging directory to disk and renames it to dest.
+// An existing dest directory is moved aside first and only removed once the new directory
+// is in place, and it is restored if the rename fails.
+func ReplaceDir(staging, dest string) error {
+	if err := syncTree(staging); err != nil {
+		return fmt.Errorf("failed to sync staging directory: %w", err)
+	}
+
+	parent := filepath.Dir(dest)
+	backup := ""
+	if _, err := os.Lstat(dest); err == nil {
+		backup = filepath.Join(parent, fmt.Sprintf(".%s.old-%d", filepath.Base(dest), os.Getpid()))
+		_ = os.RemoveAll(backup)
+		if err := os.Rename(dest, backup); err != nil {
+			return fmt.Errorf("failed to move existing directory aside: %w", err)
+		}
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		if backup != "" {
+			_ = os.Rename(backup, dest)
+		}
+		return fmt.Errorf("failed to move directory into place: %w", err)
+	}
+	if err := syncDir(parent); err != nil {
+		return err
+	}
+	if backup != "" {
+		if err := os.RemoveAll(backup); err != nil {
+			return fmt.Errorf("failed to remove previous directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// MergeDir syncs the contents of the staging directory to disk and moves its files into
+// dest, replacing files with the same path. Other files in dest are kept. The staging
+// directory is renamed to dest if dest doesn't exist.
+func MergeDir(staging, dest string) error {
+	if _, err := os.Lstat(dest); os.IsNotExist(err) {
+		return ReplaceDir(staging, dest)
+	}
+	if err := syncTree(staging); err != nil {
+		return fmt.Errorf("failed to sync staging directory: %w", err)
+	}
+	err := filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return os.Rename(path, target)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge directory: %w", err)
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("failed to remove staging directory: %w", err)
+	}
+	return syncDir(dest)
+}
+
+// syncTree fsyncs all regular files and directories below root.
+func syncTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return syncDir(path)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Sync()
+	})
+}
+
+// syncDir fsyncs a directory so that renames within it are persisted.
+// Windows does not support syncing directories, so it is a no-op there.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package fsutil
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "instance.toml")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write must leave the existing file untouched and no temp files behind
+	err := WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, _ = w.Write([]byte("partial"))
+		return errors.New("encode failed")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	assertContent(t, path, "old")
+	assertEntries(t, dir, 1)
+
+	if err := WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write([]byte("new"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, path, "new")
+	assertEntries(t, dir, 1)
+}
+
+func TestReplaceDir(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "images", "counter:1.0")
+
+	for _, content := range []string{"v1", "v2"} {
+		staging, err := StageDir(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(staging, "flow.toml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ReplaceDir(staging, dest); err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, filepath.Join(dest, "flow.toml"), content)
+		assertEntries(t, filepath.Dir(dest), 1)
+	}
+}
+
+func TestMergeDir(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "out")
+	if err := os.MkdirAll(filepath.Join(dest, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{"notes.txt": "mine", "dist/main.mjs": "old"} {
+		if err := os.WriteFile(filepath.Join(dest, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staging, err := StageDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(staging, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(staging, "dist", "main.mjs"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeDir(staging, dest); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, filepath.Join(dest, "notes.txt"), "mine")
+	assertContent(t, filepath.Join(dest, "dist", "main.mjs"), "new")
+	assertEntries(t, root, 1)
+}
+
+func assertContent(t *testing.T, path string, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("expected content %q, got %q", want, got)
+	}
+}
+
+func assertEntries(t *testing.T, dir string, want int) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != want {
+		t.Errorf("expected %d entries in %s, got %d", want, dir, len(entries))
+	}
+}
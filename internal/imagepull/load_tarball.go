@@ -5,22 +5,38 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
 )
 
 // LoadTarballImage loads a flow image from a tarball, either from a URL or a local file path, and extracts it to outputDir.
-func LoadTarballImage(source string, outputDir string) error {
+// The tarball is extracted to a staging directory which replaces outputDir once extraction has completed,
+// or whose files are merged into outputDir if it is an existing directory outside of the image_dir.
+// URLs are downloaded with the HTTP transport settings of the config.
+func LoadTarballImage(cfg *config.Config, source string, outputDir string) error {
 	var reader io.ReadCloser
 	var err error
 	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
-		resp, err := http.Get(source)
+		u, err := url.Parse(source)
+		if err != nil {
+			return fmt.Errorf("invalid tarball URL: %w", err)
+		}
+		client, err := registryauth.NewHTTPClient(cfg, u.Host)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Get(source)
 		if err != nil {
 			return fmt.Errorf("failed to download tarball: %w", err)
 		}
 		if resp.StatusCode != 200 {
+			resp.Body.Close()
 			return fmt.Errorf("failed to download tarball: status %d", resp.StatusCode)
 		}
 		reader = resp.Body
@@ -42,11 +58,29 @@ func LoadTarballImage(source string, outputDir string) error {
 		reader = gzReader
 	}
 
-	tr := tar.NewReader(reader)
+	stagingDir, err := fsutil.StageDir(outputDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if err := extractTar(reader, stagingDir); err != nil {
+		return err
+	}
+	if !isImageFolder(cfg, outputDir) {
+		return fsutil.MergeDir(stagingDir, outputDir)
+	}
+	return fsutil.ReplaceDir(stagingDir, outputDir)
+}
+
+// extractTar extracts the regular files of a tarball into dir. Entries which would be
+// written outside of dir are rejected.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
 			return fmt.Errorf("error reading tarball: %w", err)
@@ -54,7 +88,11 @@ func LoadTarballImage(source string, outputDir string) error {
 		if hdr.Typeflag != tar.TypeReg {
 			continue // skip non-regular files
 		}
-		outPath := filepath.Join(outputDir, hdr.Name)
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path in tarball: %s", hdr.Name)
+		}
+		outPath := filepath.Join(dir, name)
 		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
 			return fmt.Errorf("failed to create directory: %w", err)
 		}
@@ -66,7 +104,8 @@ func LoadTarballImage(source string, outputDir string) error {
 			outFile.Close()
 			return fmt.Errorf("failed to extract file: %w", err)
 		}
-		outFile.Close()
+		if err := outFile.Close(); err != nil {
+			return fmt.Errorf("failed to extract file: %w", err)
+		}
 	}
-	return nil
 }
@@ -0,0 +1,177 @@
+package imagepull
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Progress receives the download progress of the layers of an image
+type Progress interface {
+	// Start is called when a download starts, with the offset of a resumed download
+	Start(desc ocispec.Descriptor, offset int64)
+	// Update is called with the number of bytes downloaded so far
+	Update(desc ocispec.Descriptor, downloaded int64)
+	// Retry is called when a failed download is retried after the delay
+	Retry(desc ocispec.Descriptor, attempt int, err error, delay time.Duration)
+	// Done is called when a download is complete and verified
+	Done(desc ocispec.Descriptor)
+}
+
+type noProgress struct{}
+
+func (noProgress) Start(ocispec.Descriptor, int64)                     {}
+func (noProgress) Update(ocispec.Descriptor, int64)                    {}
+func (noProgress) Retry(ocispec.Descriptor, int, error, time.Duration) {}
+func (noProgress) Done(ocispec.Descriptor)                             {}
+
+// progressInterval limits how often the progress of a download is reported
+const progressInterval = 500 * time.Millisecond
+
+// layerName returns the file name of a layer, or its short digest
+func layerName(desc ocispec.Descriptor) string {
+	if title := desc.Annotations[ocispec.AnnotationTitle]; title != "" {
+		return title
+	}
+	return desc.Digest.Encoded()[:min(12, len(desc.Digest.Encoded()))]
+}
+
+// BarProgress draws a progress bar per layer, for terminals
+type BarProgress struct {
+	w        io.Writer
+	mu       sync.Mutex
+	lastDraw map[string]time.Time
+}
+
+// NewBarProgress returns a progress which draws progress bars to w
+func NewBarProgress(w io.Writer) *BarProgress {
+	return &BarProgress{w: w, lastDraw: map[string]time.Time{}}
+}
+
+func (p *BarProgress) Start(desc ocispec.Descriptor, offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset > 0 {
+		fmt.Fprintf(p.w, "Resuming %s at %s\n", layerName(desc), formatBytes(offset))
+	}
+	p.draw(desc, offset)
+}
+
+func (p *BarProgress) Update(desc ocispec.Descriptor, downloaded int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastDraw[desc.Digest.String()]) >= progressInterval {
+		p.draw(desc, downloaded)
+	}
+}
+
+func (p *BarProgress) Retry(desc ocispec.Descriptor, attempt int, err error, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, "\nDownload of %s failed, retrying in %s (attempt %d): %s\n", layerName(desc), delay, attempt, err)
+}
+
+func (p *BarProgress) Done(desc ocispec.Descriptor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw(desc, desc.Size)
+	fmt.Fprintln(p.w)
+}
+
+// draw redraws the line of the layer: name [=====>    ]  45% 1.2MiB/2.7MiB
+func (p *BarProgress) draw(desc ocispec.Descriptor, downloaded int64) {
+	const width = 30
+	p.lastDraw[desc.Digest.String()] = time.Now()
+	percent := 100
+	if desc.Size > 0 {
+		percent = int(min(downloaded, desc.Size) * 100 / desc.Size)
+	}
+	filled := percent * width / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	if filled > 0 && filled < width {
+		bar = bar[:filled-1] + ">" + bar[filled:]
+	}
+	fmt.Fprintf(p.w, "\r%-24s [%s] %3d%% %s/%s", layerName(desc), bar, percent, formatBytes(downloaded), formatBytes(desc.Size))
+}
+
+// ProgressEvent is a progress update written by JSONProgress
+type ProgressEvent struct {
+	// Event is start, progress, retry or done
+	Event      string `json:"event"`
+	Digest     string `json:"digest"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Delay      string `json:"delay,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// JSONProgress writes the progress as JSON lines (see ProgressEvent), e.g. for log files
+type JSONProgress struct {
+	enc        *json.Encoder
+	mu         sync.Mutex
+	lastUpdate map[string]time.Time
+}
+
+// NewJSONProgress returns a progress which writes JSON lines to w
+func NewJSONProgress(w io.Writer) *JSONProgress {
+	return &JSONProgress{enc: json.NewEncoder(w), lastUpdate: map[string]time.Time{}}
+}
+
+func (p *JSONProgress) emit(event string, desc ocispec.Descriptor, downloaded int64, fill func(*ProgressEvent)) {
+	e := ProgressEvent{Event: event, Digest: desc.Digest.String(), Name: layerName(desc), Size: desc.Size, Downloaded: downloaded}
+	if fill != nil {
+		fill(&e)
+	}
+	_ = p.enc.Encode(e)
+}
+
+func (p *JSONProgress) Start(desc ocispec.Descriptor, offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastUpdate[desc.Digest.String()] = time.Now()
+	p.emit("start", desc, offset, nil)
+}
+
+func (p *JSONProgress) Update(desc ocispec.Descriptor, downloaded int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastUpdate[desc.Digest.String()]) < progressInterval {
+		return
+	}
+	p.lastUpdate[desc.Digest.String()] = time.Now()
+	p.emit("progress", desc, downloaded, nil)
+}
+
+func (p *JSONProgress) Retry(desc ocispec.Descriptor, attempt int, err error, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emit("retry", desc, 0, func(e *ProgressEvent) {
+		e.Attempt, e.Delay, e.Error = attempt, delay.String(), err.Error()
+	})
+}
+
+func (p *JSONProgress) Done(desc ocispec.Descriptor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emit("done", desc, desc.Size, nil)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
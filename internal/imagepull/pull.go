@@ -5,169 +5,321 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/file"
-	"oras.land/oras-go/v2/registry/remote"
 
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/signature"
+	"github.com/thin-edge/tedge-oscar/internal/variant"
 )
 
+// Options configures a pull. The zero value pulls with the default retries and no timeout.
+type Options struct {
+	// TarballPath is where a tarball of the image is written, if set
+	TarballPath string
+	// Compress compresses the tarball with gzip
+	Compress bool
+	// Retries is how often a failed download of a layer is retried: 0 uses DefaultRetries
+	// and a negative value disables the retries
+	Retries int
+	// Backoff is the delay before the first retry, which doubles with each retry up to MaxBackoff
+	Backoff time.Duration
+	// Timeout limits the duration of the whole pull, if set
+	Timeout time.Duration
+	// Progress receives the download progress of the layers, if set
+	Progress Progress
+	// Force pulls images which are larger than the max_image_size of the config
+	Force bool
+	// CacheDir is where the layers are downloaded to, defaults to BlobCacheDir. Pulls which
+	// don't hold the lock of the image_dir must use their own folder.
+	CacheDir string
+}
+
+// ErrImageTooLarge is returned when an image is larger than the max_image_size of the config
+var ErrImageTooLarge = errors.New("image exceeds max_image_size")
+
 // PullImage pulls an OCI artifact and stores its contents in outputDir.
-func PullImage(cfg *config.Config, imageRef string, outputDir string, tarballPath string, compress bool) error {
-	repoRef, ref := imageRef, ""
-	if i := strings.LastIndex(imageRef, ":"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	} else if i := strings.LastIndex(imageRef, "@"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	}
-	if repoRef == imageRef || ref == "" {
-		return fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
-	}
-	store, err := file.New(outputDir)
+// The artifact is downloaded to a staging directory first and only moved to outputDir
+// once it is complete, so a partially pulled image is never visible. An outputDir in the
+// image_dir is replaced, while the files are merged into any other existing directory. The layers are
+// downloaded to the BlobCacheDir, where an interrupted download is resumed by the next pull.
+func PullImage(cfg *config.Config, imageRef string, outputDir string, opts Options) error {
+	repoRef, ref, err := registryauth.SplitRef(imageRef)
 	if err != nil {
-		return fmt.Errorf("failed to open image dir: %w", err)
+		return err
+	}
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	repo, err := registryauth.NewRepository(cfg, repoRef, false)
+	if err != nil {
+		return err
 	}
-	repo, err := remote.NewRepository(repoRef)
+	// Verify the signature before anything is written to the image_dir, and pull the verified
+	// digest, so a tag which is moved in the meantime can't bypass the verification
+	desc, err := repo.Resolve(ctx, ref)
 	if err != nil {
-		return fmt.Errorf("invalid repository: %w", err)
+		return fmt.Errorf("failed to resolve %s: %w", imageRef, err)
 	}
-	// Use shared registry auth logic
-	client, _, _, _, err := registryauth.GetAuthenticatedClient(cfg, repoRef, "")
+	resolved := desc.Digest
+	record, err := signature.VerifyRemote(ctx, cfg, repo, repoRef, desc)
 	if err != nil {
-		return fmt.Errorf("auth error: %w", err)
+		return err
 	}
-	if client != nil {
-		repo.Client = client
+	// Multi-variant images are an index, of which the manifest matching the device is pulled.
+	// Signing the index covers its manifests.
+	if desc.MediaType == ocispec.MediaTypeImageIndex {
+		if desc, err = variant.Resolve(ctx, repo, desc, variant.LocalFacts(cfg)); err != nil {
+			return fmt.Errorf("failed to select variant of %s: %w", imageRef, err)
+		}
+		if record != nil {
+			if record.Variant, err = content.FetchAll(ctx, repo, desc); err != nil {
+				return fmt.Errorf("failed to fetch variant manifest: %w", err)
+			}
+		}
+	}
+
+	if !opts.Force {
+		if err := checkImageSize(ctx, cfg, repo, desc); err != nil {
+			return fmt.Errorf("%s: %w", imageRef, err)
+		}
 	}
+
+	stagingDir, err := fsutil.StageDir(outputDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	store, err := file.New(stagingDir)
+	if err != nil {
+		return fmt.Errorf("failed to open image dir: %w", err)
+	}
+	defer store.Close()
 	// Pull the image and get the manifest descriptor
-	desc, err := oras.Copy(context.Background(), repo, ref, store, "", oras.DefaultCopyOptions)
+	cacheDir := opts.CacheDir
+	if cacheDir == "" {
+		cacheDir = BlobCacheDir(cfg)
+	}
+	src := newResumableSource(repo, cacheDir, opts)
+	copyOpts := oras.DefaultCopyOptions
+	if opts.Progress != nil {
+		// One layer at a time, so the progress of each layer can be followed
+		copyOpts.Concurrency = 1
+	}
+	desc, err = oras.Copy(ctx, src, desc.Digest.String(), store, "", copyOpts)
 	if err != nil {
 		return fmt.Errorf("oras pull failed: %w", err)
 	}
 
-	if tarballPath != "" {
-		// Save manifest.json to outputDir first (same as pull)
-		manifestBytes, err := store.Fetch(context.Background(), desc)
-		if err == nil {
-			manifestPath := filepath.Join(outputDir, "manifest.json")
-			var data []byte
-			rc := manifestBytes
-			defer rc.Close()
-			data, err = io.ReadAll(rc)
-			if err != nil {
-				data = nil
-			}
-			if data != nil {
-				var manifest map[string]any
-				if err := json.Unmarshal(data, &manifest); err == nil {
-					ann, ok := manifest["annotations"].(map[string]any)
-					if !ok {
-						ann = make(map[string]any)
-					}
-					if _, hasVersion := ann["org.opencontainers.image.version"]; !hasVersion && ref != "" {
-						ann["org.opencontainers.image.version"] = ref
-					}
-					manifest["annotations"] = ann
-					if newData, err := json.MarshalIndent(manifest, "", "  "); err == nil {
-						data = newData
-					}
-				}
-				_ = os.WriteFile(manifestPath, data, 0644)
-			}
+	// Unpack archive layers (e.g. pushed with "images push --archive") into the image folder
+	if err := unpackArchives(store, desc, stagingDir); err != nil {
+		return err
+	}
+
+	// Save the manifest JSON to the image folder
+	saveManifest(store, desc, stagingDir, ref, resolved.String())
+	if record != nil {
+		if err := record.Save(stagingDir); err != nil {
+			return fmt.Errorf("failed to save signature: %w", err)
 		}
+	}
+	if err := store.Close(); err != nil {
+		return fmt.Errorf("failed to close image dir: %w", err)
+	}
+
+	if opts.TarballPath != "" {
 		// Save as tarball (with optional compression)
-		var out io.WriteCloser
-		out, err = os.Create(tarballPath)
+		err := fsutil.WriteFileAtomic(opts.TarballPath, 0644, func(out io.Writer) error {
+			return writeTarball(out, stagingDir, opts.Compress)
+		})
 		if err != nil {
 			return fmt.Errorf("failed to create tarball: %w", err)
 		}
-		defer out.Close()
-		var tw *tar.Writer
-		if compress {
-			gz := gzip.NewWriter(out)
-			defer gz.Close()
-			tw = tar.NewWriter(gz)
-			defer tw.Close()
-		} else {
-			tw = tar.NewWriter(out)
-			defer tw.Close()
-		}
-		// Walk outputDir and add files to tarball (including manifest.json)
-		addToTar := func(path string, info os.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			stat, err := f.Stat()
-			if err != nil {
-				return err
-			}
-			hdr := &tar.Header{
-				Name: strings.TrimPrefix(path, outputDir+string(os.PathSeparator)),
-				Size: stat.Size(),
-				Mode: int64(stat.Mode()),
-			}
-			if err := tw.WriteHeader(hdr); err != nil {
-				return err
-			}
-			if _, err := io.Copy(tw, f); err != nil {
-				return err
-			}
-			return nil
+	}
+
+	// Image folders are replaced as a whole, while the pulled files are merged into other
+	// folders, e.g. given by "images pull --output-dir", so their other files are kept
+	place := fsutil.MergeDir
+	if isImageFolder(cfg, outputDir) {
+		place = fsutil.ReplaceDir
+	}
+	if err := place(stagingDir, outputDir); err != nil {
+		return err
+	}
+	src.cleanup()
+	return nil
+}
+
+// isImageFolder reports whether dir is in the image_dir, where the folders are owned by
+// tedge-oscar
+func isImageFolder(cfg *config.Config, dir string) bool {
+	imageDir, err := filepath.Abs(cfg.ImageDir)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(imageDir, dir)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// checkImageSize refuses an image whose config and layers are larger than max_image_size,
+// before anything is downloaded
+func checkImageSize(ctx context.Context, cfg *config.Config, src content.Fetcher, desc ocispec.Descriptor) error {
+	maxSize, err := cfg.GetMaxImageSize()
+	if err != nil || maxSize == 0 {
+		return err
+	}
+	data, err := content.FetchAll(ctx, src, desc)
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	if size > maxSize {
+		return fmt.Errorf("%w: %s is larger than %s", ErrImageTooLarge, formatBytes(size), formatBytes(maxSize))
+	}
+	return nil
+}
+
+// unpackArchives extracts the tar+gzip layers without a title into dir. Layers with a title
+// are written to their path by the file store.
+func unpackArchives(store *file.Store, desc ocispec.Descriptor, dir string) error {
+	ctx := context.Background()
+	data, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != ocispec.MediaTypeImageLayerGzip || layer.Annotations[ocispec.AnnotationTitle] != "" {
+			continue
 		}
-		if err := filepath.WalkDir(outputDir, addToTar); err != nil {
-			return fmt.Errorf("failed to create tarball: %w", err)
+		if err := unpackArchive(ctx, store, layer, dir); err != nil {
+			return fmt.Errorf("failed to unpack layer %s: %w", layer.Digest, err)
 		}
-		return nil
 	}
+	return nil
+}
 
-	// Save the manifest JSON to the image folder
-	manifestBytes, err := store.Fetch(context.Background(), desc)
-	if err == nil {
-		manifestPath := filepath.Join(outputDir, "manifest.json")
-		var data []byte
-		// manifestBytes is already io.ReadCloser
-		rc := manifestBytes
-		defer rc.Close()
-		data, err = io.ReadAll(rc)
-		if err != nil {
-			data = nil
-		}
-		if data != nil {
-			// Try to add version if not present
-			var manifest map[string]any
-			if err := json.Unmarshal(data, &manifest); err == nil {
-				ann, ok := manifest["annotations"].(map[string]any)
-				if !ok {
-					ann = make(map[string]any)
-				}
-				if _, hasVersion := ann["org.opencontainers.image.version"]; !hasVersion && ref != "" {
-					ann["org.opencontainers.image.version"] = ref
-				}
-				manifest["annotations"] = ann
-				if newData, err := json.MarshalIndent(manifest, "", "  "); err == nil {
-					data = newData
-				}
-			}
-			_ = os.WriteFile(manifestPath, data, 0644)
+func unpackArchive(ctx context.Context, store *file.Store, layer ocispec.Descriptor, dir string) error {
+	rc, err := store.Fetch(ctx, layer)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	return extractTar(gz, dir)
+}
+
+// saveManifest writes the manifest of the pulled artifact to manifest.json in dir.
+// The tag is added as the version annotation if the manifest does not already have one, and
+// the digest the reference resolved to (of the manifest, or of the index of a multi-variant
+// image) is recorded as digest.
+func saveManifest(store *file.Store, desc ocispec.Descriptor, dir string, ref string, resolved string) {
+	rc, err := store.Fetch(context.Background(), desc)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return
+	}
+	// Try to add version if not present
+	var manifest map[string]any
+	if err := json.Unmarshal(data, &manifest); err == nil {
+		ann, ok := manifest["annotations"].(map[string]any)
+		if !ok {
+			ann = make(map[string]any)
+		}
+		if _, hasVersion := ann["org.opencontainers.image.version"]; !hasVersion && ref != "" {
+			ann["org.opencontainers.image.version"] = ref
+		}
+		manifest["annotations"] = ann
+		manifest["digest"] = resolved
+		if newData, err := json.MarshalIndent(manifest, "", "  "); err == nil {
+			data = newData
 		}
 	}
+	_ = os.WriteFile(filepath.Join(dir, "manifest.json"), data, 0644)
+}
 
+// writeTarball writes all files in dir (including manifest.json) to out as a tarball.
+func writeTarball(out io.Writer, dir string, compress bool) error {
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(out)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+	addToTar := func(path string, info os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name: strings.TrimPrefix(path, dir+string(os.PathSeparator)),
+			Size: stat.Size(),
+			Mode: int64(stat.Mode()),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+		return nil
+	}
+	if err := filepath.WalkDir(dir, addToTar); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
 	return nil
 }
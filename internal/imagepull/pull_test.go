@@ -0,0 +1,64 @@
+package imagepull
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth/registrytest"
+)
+
+func TestPullImageOutputDir(t *testing.T) {
+	reg := registrytest.Start()
+	defer reg.Close()
+	reg.Push("thin-edge/counter", "1.0", map[string]string{"dist/main.mjs": "new"})
+	root := t.TempDir()
+	cfg := &config.Config{ImageDir: filepath.Join(root, "images")}
+	imageRef := reg.Host() + "/thin-edge/counter:1.0"
+
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(path string) string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// The pulled files are merged into a directory outside of the image_dir
+	outputDir := filepath.Join(root, "out")
+	write(filepath.Join(outputDir, "notes.txt"), "mine")
+	write(filepath.Join(outputDir, "dist", "main.mjs"), "old")
+	if err := PullImage(cfg, imageRef, outputDir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(filepath.Join(outputDir, "notes.txt")); got != "mine" {
+		t.Errorf("expected existing files to be kept, got %q", got)
+	}
+	if got := read(filepath.Join(outputDir, "dist", "main.mjs")); got != "new" {
+		t.Errorf("expected pulled files to replace existing ones, got %q", got)
+	}
+
+	// Image folders are replaced as a whole
+	imagePath := filepath.Join(cfg.ImageDir, "counter:1.0")
+	write(filepath.Join(imagePath, "stale.mjs"), "old")
+	if err := PullImage(cfg, imageRef, imagePath, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(imagePath, "stale.mjs")); !os.IsNotExist(err) {
+		t.Errorf("expected the image folder to be replaced")
+	}
+	if got := read(filepath.Join(imagePath, "dist", "main.mjs")); got != "new" {
+		t.Errorf("unexpected pulled file: %q", got)
+	}
+}
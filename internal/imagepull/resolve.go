@@ -0,0 +1,95 @@
+package imagepull
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"oras.land/oras-go/v2/registry"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/semver"
+)
+
+// rangeChars are not allowed in tags, so a reference containing one of them has a version range
+const rangeChars = "^~<>=*|, "
+
+// Resolved is a version range resolved to the highest matching tag of a repository
+type Resolved struct {
+	// ImageRef is the image reference with the resolved tag
+	ImageRef string
+	Tag      string
+	// Range is the version range which was resolved
+	Range string
+	// Digest is the digest the tag pointed to when it was resolved
+	Digest digest.Digest
+}
+
+// IsVersionRange reports whether imageRef has a version range instead of a tag, e.g.
+// ghcr.io/thin-edge/counter:^1.2, :~1.2 or ":>=1.0 <2"
+func IsVersionRange(imageRef string) bool {
+	if strings.Contains(imageRef, "@") {
+		return false
+	}
+	_, ref, err := registryauth.SplitRef(imageRef)
+	return err == nil && strings.ContainsAny(ref, rangeChars)
+}
+
+// LatestTag returns the highest of the tags which are semantic versions matching the
+// constraint, and false if no tag matches
+func LatestTag(tags []string, constraint semver.Constraint) (string, bool) {
+	var latest string
+	var latestVersion semver.Version
+	for _, tag := range tags {
+		v, err := semver.Parse(tag)
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		if latest == "" || v.Compare(latestVersion) > 0 {
+			latest, latestVersion = tag, v
+		}
+	}
+	return latest, latest != ""
+}
+
+// ResolveVersion lists the tags of the repository and returns the highest one which matches
+// the version range
+func ResolveVersion(cfg *config.Config, repoRef string, versionRange string) (Resolved, error) {
+	constraint, err := semver.ParseConstraint(versionRange)
+	if err != nil {
+		return Resolved{}, err
+	}
+	ctx := context.Background()
+	repo, err := registryauth.NewRepository(cfg, repoRef, false)
+	if err != nil {
+		return Resolved{}, err
+	}
+	tags, err := registry.Tags(ctx, repo)
+	if err != nil {
+		return Resolved{}, fmt.Errorf("failed to list the tags of %s: %w", repoRef, err)
+	}
+	tag, ok := LatestTag(tags, constraint)
+	if !ok {
+		return Resolved{}, fmt.Errorf("no tag of %s matches the version range %s", repoRef, versionRange)
+	}
+	desc, err := repo.Resolve(ctx, tag)
+	if err != nil {
+		return Resolved{}, fmt.Errorf("failed to resolve %s:%s: %w", repoRef, tag, err)
+	}
+	return Resolved{ImageRef: repoRef + ":" + tag, Tag: tag, Range: versionRange, Digest: desc.Digest}, nil
+}
+
+// ResolveImageRef resolves the version range of imageRef (see IsVersionRange). A reference
+// with a tag or digest is returned unchanged.
+func ResolveImageRef(cfg *config.Config, imageRef string) (Resolved, error) {
+	if !IsVersionRange(imageRef) {
+		return Resolved{ImageRef: imageRef}, nil
+	}
+	repoRef, versionRange, err := registryauth.SplitRef(imageRef)
+	if err != nil {
+		return Resolved{}, err
+	}
+	return ResolveVersion(cfg, repoRef, versionRange)
+}
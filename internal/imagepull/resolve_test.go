@@ -0,0 +1,44 @@
+package imagepull
+
+import (
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/semver"
+)
+
+func TestLatestTag(t *testing.T) {
+	tags := []string{"latest", "1.1.9", "1.2.0", "v1.2.5", "1.3.0", "1.4.0-rc.1", "2.0.0"}
+	tests := []struct {
+		versionRange string
+		want         string
+	}{
+		{"^1.2", "1.3.0"},
+		{"~1.2", "v1.2.5"},
+		{">=1.0 <2", "1.3.0"},
+		{">=1.4.0-rc.0", "2.0.0"},
+		{"^3", ""},
+	}
+	for _, tt := range tests {
+		constraint, err := semver.ParseConstraint(tt.versionRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := LatestTag(tags, constraint); got != tt.want {
+			t.Errorf("LatestTag(%s) = %q, want %q", tt.versionRange, got, tt.want)
+		}
+	}
+}
+
+func TestIsVersionRange(t *testing.T) {
+	for ref, want := range map[string]bool{
+		"ghcr.io/thin-edge/counter:^1.2":                 true,
+		"ghcr.io/thin-edge/counter:>=1.0 <2":             true,
+		"localhost:5000/counter:~1.2":                    true,
+		"localhost:5000/counter:1.2.0":                   false,
+		"ghcr.io/thin-edge/counter@sha256:0123456789abc": false,
+	} {
+		if got := IsVersionRange(ref); got != want {
+			t.Errorf("IsVersionRange(%s) = %v, want %v", ref, got, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package imagepull
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+// Defaults of the retry options
+const (
+	DefaultRetries = 5
+	DefaultBackoff = time.Second
+	// MaxBackoff limits the delay between two retries
+	MaxBackoff = time.Minute
+)
+
+// BlobCacheDir is where the blobs of an image are downloaded to before they are written to
+// the image folder. Partially downloaded blobs are kept there to be resumed by the next pull.
+func BlobCacheDir(cfg *config.Config) string {
+	return filepath.Join(cfg.ImageDir, ".blobs")
+}
+
+// resumableSource downloads the layers of an image into a cache folder, resuming partial
+// downloads with range requests if the registry supports them, and retrying failed
+// downloads with an exponential backoff. Manifests are fetched directly.
+type resumableSource struct {
+	oras.ReadOnlyTarget
+	cacheDir string
+	opts     Options
+	mu       sync.Mutex
+	// downloaded are the cached blobs, which are removed once the image is complete
+	downloaded []string
+}
+
+func newResumableSource(src oras.ReadOnlyTarget, cacheDir string, opts Options) *resumableSource {
+	switch {
+	case opts.Retries == 0:
+		opts.Retries = DefaultRetries
+	case opts.Retries < 0:
+		opts.Retries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.Progress == nil {
+		opts.Progress = noProgress{}
+	}
+	return &resumableSource{ReadOnlyTarget: src, cacheDir: cacheDir, opts: opts}
+}
+
+func isManifest(desc ocispec.Descriptor) bool {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex,
+		"application/vnd.docker.distribution.manifest.v2+json", "application/vnd.docker.distribution.manifest.list.v2+json":
+		return true
+	}
+	return false
+}
+
+// Fetch returns the content of a blob from the cache, downloading it first
+func (s *resumableSource) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if isManifest(desc) {
+		return s.ReadOnlyTarget.Fetch(ctx, desc)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.cacheDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	if _, err := os.Stat(path); err != nil {
+		if err := s.download(ctx, desc, path); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	s.downloaded = append(s.downloaded, path)
+	s.mu.Unlock()
+	return os.Open(path)
+}
+
+// download downloads the blob to path, retrying with an exponential backoff
+func (s *resumableSource) download(ctx context.Context, desc ocispec.Descriptor, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create blob cache: %w", err)
+	}
+	partial := path + ".partial"
+	backoff := s.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := s.downloadOnce(ctx, desc, partial)
+		if err == nil {
+			err = verifyBlob(desc, partial)
+			if err == nil {
+				s.opts.Progress.Done(desc)
+				return os.Rename(partial, path)
+			}
+			// Start from scratch, e.g. if the registry ignored the range of a resumed download
+			os.Remove(partial)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to download %s: %w", desc.Digest, ctx.Err())
+		}
+		if attempt >= s.opts.Retries {
+			return fmt.Errorf("failed to download %s after %d attempts: %w", desc.Digest, attempt+1, err)
+		}
+		s.opts.Progress.Retry(desc, attempt+1, err, backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to download %s: %w", desc.Digest, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, MaxBackoff)
+	}
+}
+
+// downloadOnce appends the rest of the blob to the partial file
+func (s *resumableSource) downloadOnce(ctx context.Context, desc ocispec.Descriptor, partial string) error {
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > desc.Size {
+		offset = 0
+	}
+	rc, err := s.ReadOnlyTarget.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if offset > 0 {
+		// The registry supports range requests if the content is seekable
+		seeker, ok := rc.(io.Seeker)
+		if !ok {
+			offset = 0
+		} else if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.opts.Progress.Start(desc, offset)
+	counter := &progressWriter{desc: desc, written: offset, progress: s.opts.Progress}
+	if _, err := io.Copy(io.MultiWriter(f, counter), rc); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// verifyBlob checks the size and digest of a downloaded blob
+func verifyBlob(desc ocispec.Descriptor, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(verifier, f)
+	if err != nil {
+		return err
+	}
+	if n != desc.Size {
+		return fmt.Errorf("%s: %w: got %d bytes, expected %d", desc.Digest, content.ErrMismatchedDigest, n, desc.Size)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("%s: %w", desc.Digest, content.ErrMismatchedDigest)
+	}
+	return nil
+}
+
+// cleanup removes the cached blobs of a completed pull
+func (s *resumableSource) cleanup() {
+	for _, path := range s.downloaded {
+		_ = os.Remove(path)
+	}
+}
+
+type progressWriter struct {
+	desc     ocispec.Descriptor
+	written  int64
+	progress Progress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	w.progress.Update(w.desc, w.written)
+	return len(p), nil
+}
@@ -0,0 +1,91 @@
+package imagepull
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// flakyTarget serves a blob which is seekable, and drops the connection after limit bytes
+// on the first fetch
+type flakyTarget struct {
+	data    []byte
+	limit   int
+	fetches int
+	seeks   []int64
+}
+
+type flakyReader struct {
+	r      *bytes.Reader
+	target *flakyTarget
+	limit  int
+	read   int
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.limit > 0 && r.read >= r.limit {
+		return 0, errors.New("connection reset")
+	}
+	if r.limit > 0 && len(p) > r.limit-r.read {
+		p = p[:r.limit-r.read]
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	return n, err
+}
+
+func (r *flakyReader) Seek(offset int64, whence int) (int64, error) {
+	r.target.seeks = append(r.target.seeks, offset)
+	return r.r.Seek(offset, whence)
+}
+
+func (r *flakyReader) Close() error { return nil }
+
+func (t *flakyTarget) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	t.fetches++
+	limit := 0
+	if t.fetches == 1 {
+		limit = t.limit
+	}
+	return &flakyReader{r: bytes.NewReader(t.data), target: t, limit: limit}, nil
+}
+
+func (t *flakyTarget) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	return true, nil
+}
+
+func (t *flakyTarget) Resolve(ctx context.Context, ref string) (ocispec.Descriptor, error) {
+	return ocispec.Descriptor{}, errors.New("not implemented")
+}
+
+func TestResumableSource(t *testing.T) {
+	data := bytes.Repeat([]byte("flow"), 1000)
+	desc := ocispec.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromBytes(data), Size: int64(len(data))}
+	target := &flakyTarget{data: data, limit: 1500}
+	src := newResumableSource(target, t.TempDir(), Options{Backoff: time.Millisecond})
+
+	rc, err := src.Fetch(context.Background(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("unexpected content (%d bytes): %v", len(got), err)
+	}
+	if target.fetches != 2 || len(target.seeks) != 1 || target.seeks[0] != 1500 {
+		t.Errorf("expected the download to be resumed at 1500, got %d fetches and seeks %v", target.fetches, target.seeks)
+	}
+
+	src.cleanup()
+	if _, err := os.Stat(src.downloaded[0]); !os.IsNotExist(err) {
+		t.Errorf("expected the cached blob to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package imagepush
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+)
+
+// ParseAnnotations parses key=value pairs. An empty value removes an annotation which is
+// set automatically.
+func ParseAnnotations(values []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid annotation %q, expected key=value", v)
+		}
+		annotations[key] = value
+	}
+	return annotations, nil
+}
+
+// ReadAnnotationFile reads annotations from a JSON file. The file is either an object of
+// string values, or uses the format of the oras CLI, where the manifest annotations are
+// stored in the "$manifest" object.
+func ReadAnnotationFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read annotation file: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse annotation file %s: %w", path, err)
+	}
+	if manifest, ok := raw["$manifest"]; ok {
+		data = manifest
+	}
+	var annotations map[string]string
+	if err := json.Unmarshal(data, &annotations); err != nil {
+		return nil, fmt.Errorf("annotation file %s must contain an object of string values: %w", path, err)
+	}
+	return annotations, nil
+}
+
+// DefaultAnnotations returns the standard OCI annotations of an image built from rootDir:
+// the version is the tag of imageRef, the source and revision are read from git, and the
+// description and licenses from the flow definition or README.md. The creation time is set
+// by PackFiles. Values which can't be determined are left out.
+func DefaultAnnotations(imageRef string, rootDir string) map[string]string {
+	annotations := map[string]string{}
+	if _, ref, err := registryauth.SplitRef(imageRef); err == nil && !strings.Contains(ref, ":") {
+		annotations[ocispec.AnnotationVersion] = ref
+	}
+	if revision := git(rootDir, "rev-parse", "HEAD"); revision != "" {
+		annotations[ocispec.AnnotationRevision] = revision
+		if source := sourceURL(git(rootDir, "config", "--get", "remote.origin.url")); source != "" {
+			annotations[ocispec.AnnotationSource] = source
+		}
+	}
+	var definition struct {
+		Description string `toml:"description"`
+		License     string `toml:"license"`
+		Licenses    string `toml:"licenses"`
+	}
+	for _, name := range []string{"flow.toml", "pipeline.toml"} {
+		if _, err := toml.DecodeFile(filepath.Join(rootDir, name), &definition); err == nil {
+			break
+		}
+	}
+	description := definition.Description
+	if description == "" {
+		description = readmeDescription(filepath.Join(rootDir, "README.md"))
+	}
+	if description != "" {
+		annotations[ocispec.AnnotationDescription] = description
+	}
+	if licenses := definition.Licenses; licenses != "" {
+		annotations[ocispec.AnnotationLicenses] = licenses
+	} else if definition.License != "" {
+		annotations[ocispec.AnnotationLicenses] = definition.License
+	}
+	return annotations
+}
+
+// git runs a git command in dir and returns its trimmed output, or "" if it fails
+func git(dir string, args ...string) string {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+var scpLikeURL = regexp.MustCompile(`^[\w.-]+@([\w.-]+):(.+)$`)
+
+// sourceURL converts a git remote into a browsable https URL without credentials
+func sourceURL(remote string) string {
+	if m := scpLikeURL.FindStringSubmatch(remote); m != nil {
+		remote = "ssh://" + m[1] + "/" + m[2]
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		u.Host = u.Hostname()
+	}
+	u.Scheme = "https"
+	u.User = nil
+	return strings.TrimSuffix(u.String(), ".git")
+}
+
+// readmeDescription returns the first paragraph of a README, skipping headings and badges
+func readmeDescription(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		skip := strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[![") || strings.HasPrefix(line, "![")
+		if line == "" || skip {
+			if len(lines) > 0 {
+				break
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "```") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, " ")
+}
@@ -1,129 +1,509 @@
 package imagepush
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/memory"
-	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/content/oci"
 
 	"github.com/thin-edge/tedge-oscar/internal/config"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
 )
 
-// PushImage pushes files as an OCI artifact, preserving their paths relative to rootDir.
-func PushImage(cfg *config.Config, imageRef string, ociType string, files []string, rootDir string) error {
-	var err error
-	repoRef, ref := imageRef, ""
-	if i := strings.LastIndex(imageRef, ":"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	} else if i := strings.LastIndex(imageRef, "@"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	}
-	if repoRef == imageRef || ref == "" {
-		return fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
+// DefaultArtifactType is the OCI artifact type of flow images
+const DefaultArtifactType = "application/vnd.tedge.flow.v1"
+
+// legacyOnly reports whether the registry of the image only accepts legacy manifests
+func legacyOnly(imageRef string) bool {
+	return strings.HasPrefix(imageRef, "ghcr.io/")
+}
+
+// PackOptions controls how files are packed into an image
+type PackOptions struct {
+	// ArtifactType is the OCI artifact type of the manifest (default: DefaultArtifactType)
+	ArtifactType string
+	// Legacy creates an OCI 1.0 image manifest without an artifact type, which all
+	// registries (e.g. ghcr.io) accept
+	Legacy bool
+	// Archive packs all files into a single tar+gzip layer instead of one layer per file
+	Archive bool
+	// Created is the creation time of the image (default: SOURCE_DATE_EPOCH or now). A fixed
+	// creation time makes the image reproducible.
+	Created time.Time
+	// Annotations are added to the manifest. An org.opencontainers.image.created annotation
+	// overrides Created, and annotations with an empty value are left out.
+	Annotations map[string]string
+}
+
+// SourceDateEpoch returns the time set in the SOURCE_DATE_EPOCH environment variable, or the
+// zero time if it is not set
+func SourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, nil
 	}
-	memStore := memory.New()
-	var descriptors []ocispec.Descriptor
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", value, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// resolveCreated sets the creation time of the image if it is not set yet, and normalizes it
+// to UTC with a precision of one second
+func (o *PackOptions) resolveCreated() error {
+	if value := o.Annotations[ocispec.AnnotationCreated]; value != "" {
+		created, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", ocispec.AnnotationCreated, err)
+		}
+		o.Created = created
+	}
+	if o.Created.IsZero() {
+		created, err := SourceDateEpoch()
+		if err != nil {
+			return err
+		}
+		if created.IsZero() {
+			created = time.Now()
+		}
+		o.Created = created
+	}
+	o.Created = o.Created.UTC().Truncate(time.Second)
+	return nil
+}
+
+// imageConfig is the config blob of an image. It is marshalled from a struct, so the field
+// order and therefore its digest is stable.
+type imageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Created      string `json:"created"`
+	CreatedBy    string `json:"created_by"`
+}
+
+// packEntry is a file of the image and its path inside of the image
+type packEntry struct {
+	path string
+	rel  string
+}
+
+// relativePath returns the path of f inside the image, i.e. relative to rootDir
+func relativePath(f string, rootDir string) (string, error) {
+	relPath, err := filepath.Rel(rootDir, f)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine relative path for %s: %w", f, err)
+	}
+	relPath = filepath.ToSlash(relPath) // OCI prefers forward slashes
+	if relPath == "" || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("file %s is outside of the root directory %s, set --root to a parent directory", f, rootDir)
+	}
+	return relPath, nil
+}
+
+// MediaTypeOf returns the media type of a file layer, based on its (case insensitive) extension
+func MediaTypeOf(f string) string {
+	switch strings.ToLower(filepath.Ext(f)) {
+	case ".json":
+		return "application/json"
+	case ".toml":
+		return "application/toml"
+	case ".mjs", ".js":
+		return "application/javascript"
+	}
+	return "application/octet-stream"
+}
+
+// PackFiles adds the files as layers, preserving their paths relative to rootDir, and a
+// config to the store, and packs them into a manifest. The layers are sorted by path and the
+// creation time is taken from opts, so packing the same files twice results in the same digest.
+func PackFiles(ctx context.Context, store content.Pusher, files []string, rootDir string, opts PackOptions) (ocispec.Descriptor, error) {
+	if err := opts.resolveCreated(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	entries := make([]packEntry, 0, len(files))
 	for _, f := range files {
-		data, err := os.ReadFile(f)
+		relPath, err := relativePath(f, rootDir)
 		if err != nil {
-			return fmt.Errorf("failed to read file %s: %w", f, err)
+			return ocispec.Descriptor{}, err
 		}
-		relPath, err := filepath.Rel(rootDir, f)
+		entries = append(entries, packEntry{path: f, rel: relPath})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].rel < entries[j].rel })
+	for i := 1; i < len(entries); i++ {
+		if entries[i].rel == entries[i-1].rel {
+			return ocispec.Descriptor{}, fmt.Errorf("files %s and %s have the same path %s in the image", entries[i-1].path, entries[i].path, entries[i].rel)
+		}
+	}
+
+	var descriptors []ocispec.Descriptor
+	if opts.Archive {
+		data, err := archiveFiles(entries, opts.Created)
 		if err != nil {
-			return fmt.Errorf("failed to determine relative path for %s: %w", f, err)
-		}
-		relPath = filepath.ToSlash(relPath) // OCI prefers forward slashes
-		if relPath == "" || relPath == "." || strings.Contains(relPath, "..") {
-			return fmt.Errorf("invalid relative path for file %s: got '%s' (root: %s)", f, relPath, rootDir)
-		}
-		mediaType := "application/octet-stream"
-		var contentReader *bytes.Reader
-		if strings.HasSuffix(f, ".json") {
-			mediaType = "application/json"
-		} else if strings.HasSuffix(f, ".toml") {
-			mediaType = "application/toml"
-		} else if strings.HasSuffix(f, ".mjs") || strings.HasSuffix(f, ".js") {
-			mediaType = "application/javascript"
-		}
-		contentReader = bytes.NewReader(data)
+			return ocispec.Descriptor{}, err
+		}
+		// The layer has no title, so it is unpacked into the image folder by PullImage
 		d := ocispec.Descriptor{
-			MediaType:   mediaType,
-			Digest:      digest.FromBytes(data),
-			Size:        int64(len(data)),
-			Annotations: map[string]string{"org.opencontainers.image.title": relPath},
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
 		}
-		if err := memStore.Push(context.Background(), d, contentReader); err != nil {
-			return fmt.Errorf("failed to add file %s to store: %w", f, err)
+		if err := pushIfMissing(ctx, store, d, data); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to add archive to store: %w", err)
 		}
 		descriptors = append(descriptors, d)
+	} else {
+		for _, e := range entries {
+			data, err := os.ReadFile(e.path)
+			if err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("failed to read file %s: %w", e.path, err)
+			}
+			d := ocispec.Descriptor{
+				MediaType:   MediaTypeOf(e.path),
+				Digest:      digest.FromBytes(data),
+				Size:        int64(len(data)),
+				Annotations: map[string]string{ocispec.AnnotationTitle: e.rel},
+			}
+			if err := pushIfMissing(ctx, store, d, data); err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("failed to add file %s to store: %w", e.path, err)
+			}
+			descriptors = append(descriptors, d)
+		}
+	}
+	created := opts.Created.Format(time.RFC3339)
+	configBytes, err := json.Marshal(imageConfig{
+		Architecture: "amd64",
+		OS:           "linux",
+		Created:      created,
+		CreatedBy:    "tedge-oscar",
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
 	}
-	// Always create a minimal config blob
-	configBytes := []byte(`{"architecture":"amd64","os":"linux","created_by":"tedge-oscar"}`)
 	configDesc := ocispec.Descriptor{
-		MediaType: "application/vnd.oci.image.config.v1+json",
+		MediaType: ocispec.MediaTypeImageConfig,
 		Digest:    digest.FromBytes(configBytes),
 		Size:      int64(len(configBytes)),
 	}
-	if err := memStore.Push(context.Background(), configDesc, bytes.NewReader(configBytes)); err != nil {
-		return fmt.Errorf("failed to add config to store: %w", err)
+	if err := pushIfMissing(ctx, store, configDesc, configBytes); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to add config to store: %w", err)
+	}
+	packVersion := oras.PackManifestVersion1_1
+	artifactType := opts.ArtifactType
+	if artifactType == "" {
+		artifactType = DefaultArtifactType
 	}
-	var packVersion oras.PackManifestVersion
-	artifactType := ociType
-	if strings.HasPrefix(repoRef, "ghcr.io/") {
+	if opts.Legacy {
 		packVersion = oras.PackManifestVersion1_0
 		artifactType = ""
-	} else {
-		packVersion = oras.PackManifestVersion1_1
 	}
+	annotations := map[string]string{}
+	for k, v := range opts.Annotations {
+		if v != "" {
+			annotations[k] = v
+		}
+	}
+	annotations[ocispec.AnnotationCreated] = created
 	packOpts := oras.PackManifestOptions{
-		ConfigDescriptor: &configDesc,
-		Layers:           descriptors,
+		ConfigDescriptor:    &configDesc,
+		Layers:              descriptors,
+		ManifestAnnotations: annotations,
+	}
+	manifestDesc, err := oras.PackManifest(ctx, store, packVersion, artifactType, packOpts)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to pack manifest: %w", err)
+	}
+	return manifestDesc, nil
+}
+
+// archiveFiles returns a tar+gzip archive of the files. Timestamps, owners and permissions
+// are normalized, so the archive only depends on the paths and contents of the files.
+func archiveFiles(entries []packEntry, modTime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		data, err := os.ReadFile(e.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", e.path, err)
+		}
+		info, err := os.Stat(e.path)
+		if err != nil {
+			return nil, err
+		}
+		mode := int64(0644)
+		if info.Mode().Perm()&0111 != 0 {
+			mode = 0755
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.rel,
+			Size:     int64(len(data)),
+			Mode:     mode,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CheckReproducible packs the files for imageRef twice and returns the manifest descriptor
+// if both builds are identical, or an error listing the layers which differ. The creation
+// time must be fixed (opts.Created, the created annotation or SOURCE_DATE_EPOCH), as it
+// would otherwise change with every push.
+func CheckReproducible(imageRef string, files []string, rootDir string, opts PackOptions) (ocispec.Descriptor, error) {
+	if legacyOnly(imageRef) {
+		opts.Legacy = true
+	}
+	// Both builds share the creation time, which is the time of the push unless it is fixed
+	if opts.Created.IsZero() && opts.Annotations[ocispec.AnnotationCreated] == "" {
+		epoch, err := SourceDateEpoch()
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if epoch.IsZero() {
+			return ocispec.Descriptor{}, fmt.Errorf("image is not reproducible, its creation time is the time of the push: set SOURCE_DATE_EPOCH (e.g. to the commit time: git log -1 --format=%%ct) or the %s annotation", ocispec.AnnotationCreated)
+		}
+	}
+	if err := opts.resolveCreated(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	ctx := context.Background()
+	var manifests [2]ocispec.Manifest
+	var descs [2]ocispec.Descriptor
+	for i := range descs {
+		store := memory.New()
+		desc, err := PackFiles(ctx, store, files, rootDir, opts)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		data, err := content.FetchAll(ctx, store, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if err := json.Unmarshal(data, &manifests[i]); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to parse manifest: %w", err)
+		}
+		descs[i] = desc
+	}
+	if descs[0].Digest == descs[1].Digest {
+		return descs[0], nil
+	}
+	var diffs []string
+	first, second := manifests[0].Layers, manifests[1].Layers
+	if len(first) != len(second) {
+		diffs = append(diffs, fmt.Sprintf("layer count %d != %d", len(first), len(second)))
+	} else {
+		for i := range first {
+			if first[i].Digest == second[i].Digest {
+				continue
+			}
+			name := first[i].Annotations[ocispec.AnnotationTitle]
+			if name == "" {
+				name = "archive"
+			}
+			diffs = append(diffs, fmt.Sprintf("%s: %s != %s", name, first[i].Digest, second[i].Digest))
+		}
+	}
+	if manifests[0].Config.Digest != manifests[1].Config.Digest {
+		diffs = append(diffs, fmt.Sprintf("config: %s != %s", manifests[0].Config.Digest, manifests[1].Config.Digest))
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("image is not reproducible, the manifest digests differ (%s != %s): %s", descs[0].Digest, descs[1].Digest, strings.Join(diffs, "; "))
+}
+
+// pushIfMissing adds a blob to the store, ignoring blobs which already exist (e.g. two
+// files with the same content)
+func pushIfMissing(ctx context.Context, store content.Pusher, d ocispec.Descriptor, data []byte) error {
+	if storage, ok := store.(content.ReadOnlyStorage); ok {
+		if exists, err := storage.Exists(ctx, d); err == nil && exists {
+			return nil
+		}
+	}
+	return store.Push(ctx, d, bytes.NewReader(data))
+}
+
+// PushImage pushes files as an OCI artifact, preserving their paths relative to rootDir.
+// ghcr.io only accepts legacy manifests, so opts.Legacy is always set for it.
+// It returns the descriptor of the pushed manifest.
+func PushImage(cfg *config.Config, imageRef string, files []string, rootDir string, opts PackOptions) (ocispec.Descriptor, error) {
+	repoRef, ref, err := registryauth.SplitRef(imageRef)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	ctx := context.Background()
+	memStore := memory.New()
+	if legacyOnly(repoRef) {
+		opts.Legacy = true
+	}
+	manifestDesc, err := PackFiles(ctx, memStore, files, rootDir, opts)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return manifestDesc, pushFromMemory(ctx, cfg, memStore, manifestDesc, repoRef, ref)
+}
+
+// Variant is one manifest of a multi-variant image
+type Variant struct {
+	Files   []string
+	RootDir string
+	// Annotations are the requirements of the variant (see package variant). They are set on
+	// the manifest and on its descriptor in the index, so a variant can be selected without
+	// fetching all manifests.
+	Annotations map[string]string
+}
+
+// PackIndex packs each variant into a manifest, like PackFiles, and an OCI image index of
+// these manifests. The annotations of opts are set on the index and on all manifests.
+func PackIndex(ctx context.Context, store content.Pusher, variants []Variant, opts PackOptions) (ocispec.Descriptor, error) {
+	if len(variants) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("no variants to pack")
+	}
+	if err := opts.resolveCreated(); err != nil {
+		return ocispec.Descriptor{}, err
 	}
-	manifestDesc, err := oras.PackManifest(context.Background(), memStore, packVersion, artifactType, packOpts)
+	manifests := make([]ocispec.Descriptor, 0, len(variants))
+	for i, v := range variants {
+		for j := range i {
+			if maps.Equal(variants[j].Annotations, v.Annotations) {
+				return ocispec.Descriptor{}, fmt.Errorf("variants %s and %s have the same requirements", variants[j].RootDir, v.RootDir)
+			}
+		}
+		variantOpts := opts
+		variantOpts.Annotations = maps.Clone(opts.Annotations)
+		if variantOpts.Annotations == nil {
+			variantOpts.Annotations = map[string]string{}
+		}
+		maps.Copy(variantOpts.Annotations, v.Annotations)
+		desc, err := PackFiles(ctx, store, v.Files, v.RootDir, variantOpts)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to pack variant %s: %w", v.RootDir, err)
+		}
+		desc.Annotations = maps.Clone(v.Annotations)
+		manifests = append(manifests, desc)
+	}
+	annotations := map[string]string{}
+	for k, v := range opts.Annotations {
+		if v != "" {
+			annotations[k] = v
+		}
+	}
+	annotations[ocispec.AnnotationCreated] = opts.Created.Format(time.RFC3339)
+	index := ocispec.Index{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageIndex,
+		Manifests:   manifests,
+		Annotations: annotations,
+	}
+	if !opts.Legacy {
+		index.ArtifactType = opts.ArtifactType
+		if index.ArtifactType == "" {
+			index.ArtifactType = DefaultArtifactType
+		}
+	}
+	data, err := json.Marshal(index)
 	if err != nil {
-		return fmt.Errorf("failed to pack manifest: %w", err)
+		return ocispec.Descriptor{}, err
 	}
+	desc := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageIndex,
+		ArtifactType: index.ArtifactType,
+		Digest:       digest.FromBytes(data),
+		Size:         int64(len(data)),
+	}
+	if err := pushIfMissing(ctx, store, desc, data); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to add index to store: %w", err)
+	}
+	return desc, nil
+}
+
+// PushIndex pushes a multi-variant image: an OCI image index of one manifest per variant.
+// It returns the descriptor of the pushed index.
+func PushIndex(cfg *config.Config, imageRef string, variants []Variant, opts PackOptions) (ocispec.Descriptor, error) {
+	repoRef, ref, err := registryauth.SplitRef(imageRef)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	ctx := context.Background()
+	memStore := memory.New()
+	if legacyOnly(repoRef) {
+		opts.Legacy = true
+	}
+	indexDesc, err := PackIndex(ctx, memStore, variants, opts)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return indexDesc, pushFromMemory(ctx, cfg, memStore, indexDesc, repoRef, ref)
+}
+
+// pushFromMemory tags the manifest or index desc of the memory store and copies it to the
+// repository
+func pushFromMemory(ctx context.Context, cfg *config.Config, memStore *memory.Store, desc ocispec.Descriptor, repoRef string, ref string) error {
 	// Tag the manifest in the memory store with the user-supplied tag and its own digest
-	if err := memStore.Tag(context.Background(), manifestDesc, ref); err != nil {
+	if err := memStore.Tag(ctx, desc, ref); err != nil {
 		return fmt.Errorf("failed to tag manifest in memory store: %w", err)
 	}
-	if err := memStore.Tag(context.Background(), manifestDesc, manifestDesc.Digest.String()); err != nil {
+	if err := memStore.Tag(ctx, desc, desc.Digest.String()); err != nil {
 		return fmt.Errorf("failed to tag manifest digest in memory store: %w", err)
 	}
-	// Prepare remote repository and authentication
-	var repo *remote.Repository
-	repo, err = remote.NewRepository(repoRef)
+	return copyToRemote(ctx, cfg, memStore, desc.Digest.String(), repoRef, ref)
+}
+
+// PushLayout pushes an image from an OCI image layout (e.g. created by "flows build") to
+// the registry. srcRef is the tag of the image in the layout.
+func PushLayout(cfg *config.Config, imageRef string, layoutDir string, srcRef string) error {
+	repoRef, ref, err := registryauth.SplitRef(imageRef)
 	if err != nil {
-		return fmt.Errorf("invalid repository: %w", err)
+		return err
 	}
-	// Use shared registry auth logic
-	scope := ""
-	if strings.HasPrefix(repoRef, "ghcr.io/") {
-		ownerRepo := strings.TrimPrefix(repoRef, "ghcr.io/")
-		scope = "repository:" + ownerRepo + ":push,pull"
-	}
-	client, _, _, _, err := registryauth.GetAuthenticatedClient(cfg, repoRef, scope)
+	ctx := context.Background()
+	store, err := oci.NewWithContext(ctx, layoutDir)
 	if err != nil {
-		return fmt.Errorf("auth error: %w", err)
+		return fmt.Errorf("failed to open OCI layout %s: %w", layoutDir, err)
 	}
-	if client != nil {
-		repo.Client = client
+	if _, err := store.Resolve(ctx, srcRef); err != nil {
+		return fmt.Errorf("image %s not found in OCI layout %s: %w", srcRef, layoutDir, err)
 	}
-	// Push the manifest and its blobs to the remote repository using the manifest digest as the source reference
-	copyOpts := oras.DefaultCopyOptions
-	_, err = oras.Copy(context.Background(), memStore, manifestDesc.Digest.String(), repo, ref, copyOpts)
+	return copyToRemote(ctx, cfg, store, srcRef, repoRef, ref)
+}
+
+// copyToRemote copies the manifest srcRef and its blobs from the source to the repository
+func copyToRemote(ctx context.Context, cfg *config.Config, src oras.ReadOnlyTarget, srcRef string, repoRef string, ref string) error {
+	repo, err := registryauth.NewRepository(cfg, repoRef, true)
 	if err != nil {
+		return err
+	}
+	// Push the manifest and its blobs to the remote repository
+	copyOpts := oras.DefaultCopyOptions
+	if _, err := oras.Copy(ctx, src, srcRef, repo, ref, copyOpts); err != nil {
 		return fmt.Errorf("oras push failed: %w", err)
 	}
 	return nil
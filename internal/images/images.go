@@ -0,0 +1,110 @@
+package images
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+)
+
+// Unknown is shown for values which could not be read from the image manifest
+const Unknown = "<unknown>"
+
+// AnnotationColumns maps the short column names of "images list" to manifest annotations.
+// Other annotations can be selected by their full key.
+var AnnotationColumns = map[string]string{
+	"created":     ocispec.AnnotationCreated,
+	"source":      ocispec.AnnotationSource,
+	"revision":    ocispec.AnnotationRevision,
+	"description": ocispec.AnnotationDescription,
+	"licenses":    ocispec.AnnotationLicenses,
+	"authors":     ocispec.AnnotationAuthors,
+	"vendor":      ocispec.AnnotationVendor,
+	"url":         ocispec.AnnotationURL,
+}
+
+// Info describes a flow image in the image_dir
+type Info struct {
+	// Name is the image name without the version
+	Name string
+	// Dir is the folder name of the image, e.g. name:version
+	Dir     string
+	Path    string
+	Version string
+	Digest  string
+	// Annotations of the image manifest
+	Annotations map[string]string
+}
+
+// Annotation returns the value of a column name of AnnotationColumns, or of an annotation key
+func (i Info) Annotation(name string) string {
+	if key, ok := AnnotationColumns[name]; ok {
+		name = key
+	}
+	return i.Annotations[name]
+}
+
+// List returns all images in imageDir. A missing imageDir is treated as empty.
+func List(imageDir string) ([]Info, error) {
+	entries, err := os.ReadDir(imageDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var items []Info
+	for _, entry := range entries {
+		// Skip non-image folders, e.g. hidden staging folders of in-progress pulls
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		items = append(items, Read(filepath.Join(imageDir, entry.Name())))
+	}
+	return items, nil
+}
+
+// Read returns the information about the image stored in dir. Values which can't be
+// read from the manifest.json are set to Unknown.
+func Read(dir string) Info {
+	info := Info{
+		Name:        artifact.TrimVersion(filepath.Base(dir)),
+		Dir:         filepath.Base(dir),
+		Path:        dir,
+		Version:     Unknown,
+		Digest:      Unknown,
+		Annotations: map[string]string{},
+	}
+	f, err := os.Open(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return info
+	}
+	defer f.Close()
+	var manifest map[string]interface{}
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return info
+	}
+	if ann, ok := manifest["annotations"].(map[string]interface{}); ok {
+		for k, v := range ann {
+			if s, ok := v.(string); ok {
+				info.Annotations[k] = s
+			}
+		}
+		if v, ok := ann["org.opencontainers.image.version"].(string); ok {
+			info.Version = v
+		}
+	}
+	if d, ok := manifest["config"].(map[string]interface{}); ok {
+		if dgst, ok := d["digest"].(string); ok {
+			info.Digest = dgst
+		}
+	}
+	if d, ok := manifest["digest"].(string); ok && d != "" {
+		info.Digest = d
+	}
+	return info
+}
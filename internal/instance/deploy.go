@@ -0,0 +1,238 @@
+package instance
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/signature"
+	"github.com/thin-edge/tedge-oscar/pkg/maputil"
+	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
+)
+
+// MetadataKey is the table in the instance file where tedge-oscar stores its own metadata
+const MetadataKey = "tedge-oscar"
+
+// DeployOptions describes how an instance should be created from an image
+type DeployOptions struct {
+	Name     string
+	Image    string
+	Topics   []string
+	Interval string
+	// Params are merged into the config of each step
+	Params map[string]any
+	// ManagedBy records which tool owns the instance, e.g. "apply"
+	ManagedBy string
+	// VersionRange is the range of versions the instance may be upgraded to. It is set
+	// when Image has a version range, e.g. ghcr.io/thin-edge/counter:^1.2.
+	VersionRange string
+	// UpdatePolicy is how "tedge-oscar watch" updates the instance, see the watch package
+	UpdatePolicy string
+}
+
+// ImagePath returns the local folder of an image reference in the image_dir
+func ImagePath(cfg *config.Config, imageRef string) (string, error) {
+	// Extract repository part from image reference (remove tag/digest)
+	name, err := artifact.ParseName(imageRef, false)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cfg.ImageDir, name), nil
+}
+
+// Render builds the instance definition from the flow definition (flow.toml or pipeline.toml)
+// of a locally available image. All fields of the flow definition are preserved.
+func Render(cfg *config.Config, opts DeployOptions) (map[string]interface{}, error) {
+	imagePath, err := ImagePath(cfg, opts.Image)
+	if err != nil {
+		return nil, err
+	}
+	return RenderDir(imagePath, opts)
+}
+
+// RenderDir builds the instance definition from the flow definition in imagePath, which is
+// an image folder or a flow project containing dist/main.mjs
+func RenderDir(imagePath string, opts DeployOptions) (map[string]interface{}, error) {
+	scriptPath := filepath.Join(imagePath, "dist/main.mjs")
+	if _, err := os.Stat(scriptPath); err != nil {
+		return nil, fmt.Errorf("image %s does not contain the expected entrypoint. path=%s: %w", opts.Image, scriptPath, err)
+	}
+
+	// Look for the first existing TOML config file in priority order
+	var imageFlowDefinitionPath string
+	for _, candidate := range []string{"flow.toml", "pipeline.toml"} {
+		candidatePath := filepath.Join(imagePath, candidate)
+		if _, err := os.Stat(candidatePath); err == nil {
+			imageFlowDefinitionPath = candidatePath
+			break
+		}
+	}
+
+	var m map[string]interface{}
+	if imageFlowDefinitionPath != "" {
+		// Load flow definition as a map to preserve all fields
+		if _, err := toml.DecodeFile(imageFlowDefinitionPath, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", imageFlowDefinitionPath, err)
+		}
+	} else {
+		// Fallback: create minimal config
+		m = map[string]interface{}{
+			"steps": []map[string]interface{}{{}},
+		}
+	}
+
+	// Always update topics from CLI using a helper to set nested keys
+	if len(opts.Topics) > 0 {
+		if err := maputil.SetNestedMapValue(m, []string{"input", "mqtt", "topics"}, opts.Topics); err != nil {
+			return nil, fmt.Errorf("failed to set input.mqtt.topics: %w", err)
+		}
+	}
+	// Point all steps to the image's script and apply the interval and params
+	if stepsRaw, ok := m["steps"]; ok {
+		var newSteps []map[string]interface{}
+		switch steps := stepsRaw.(type) {
+		case []map[string]interface{}:
+			newSteps = steps
+		case []interface{}:
+			for _, s := range steps {
+				if stepMap, ok := s.(map[string]interface{}); ok {
+					newSteps = append(newSteps, stepMap)
+				}
+			}
+		}
+		for _, stepMap := range newSteps {
+			stepMap["script"] = scriptPath
+			if opts.Interval != "" {
+				stepMap["interval"] = opts.Interval
+			}
+			if len(opts.Params) > 0 {
+				stepConfig, _ := stepMap["config"].(map[string]interface{})
+				if stepConfig == nil {
+					stepConfig = map[string]interface{}{}
+				}
+				for k, v := range opts.Params {
+					stepConfig[k] = v
+				}
+				stepMap["config"] = stepConfig
+			}
+		}
+		m["steps"] = newSteps
+	}
+
+	metadata := map[string]interface{}{
+		"image": opts.Image,
+	}
+	if opts.ManagedBy != "" {
+		metadata["managed_by"] = opts.ManagedBy
+	}
+	if opts.VersionRange != "" {
+		metadata["version_range"] = opts.VersionRange
+	}
+	if opts.UpdatePolicy != "" {
+		metadata["update_policy"] = opts.UpdatePolicy
+	}
+	m[MetadataKey] = metadata
+	return m, nil
+}
+
+// Deploy creates or replaces an instance in the deploy_dir, pulling the image first if it
+// is not available locally. An image with a version range is resolved to the highest matching
+// tag, and the range is recorded in the instance. The image must satisfy the trust policy.
+// Progress messages are written to w.
+// The caller is responsible for locking the image_dir and deploy_dir.
+func Deploy(cfg *config.Config, opts DeployOptions, w io.Writer) (string, error) {
+	return deploy(cfg, opts, true, w)
+}
+
+func deploy(cfg *config.Config, opts DeployOptions, enabled bool, w io.Writer) (string, error) {
+	deployDir := cfg.GetDeployDir()
+	if err := os.MkdirAll(deployDir, 0755); err != nil {
+		return "", err
+	}
+	if imagepull.IsVersionRange(opts.Image) {
+		resolved, err := imagepull.ResolveImageRef(cfg, opts.Image)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(w, "Version range %s resolved to %s (%s)\n", resolved.Range, resolved.Tag, resolved.Digest)
+		opts.Image, opts.VersionRange = resolved.ImageRef, resolved.Range
+	}
+	imagePath, err := ImagePath(cfg, opts.Image)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(w, "script path: %s\n", filepath.Join(imagePath, "dist/main.mjs"))
+
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		fmt.Fprintf(w, "Image %s not found locally. Pulling...\n", opts.Image)
+		if err := imagepull.PullImage(cfg, opts.Image, imagePath, imagepull.Options{}); err != nil {
+			return "", fmt.Errorf("failed to pull image: %w", err)
+		}
+	}
+	if err := signature.VerifyImage(cfg, opts.Image, imagePath); err != nil {
+		return "", err
+	}
+
+	data, err := Render(cfg, opts)
+	if err != nil {
+		return "", err
+	}
+	tomlPath := filepath.Join(deployDir, FileName(opts.Name, enabled))
+	if err := WriteFile(tomlPath, data); err != nil {
+		return "", err
+	}
+	return tomlPath, nil
+}
+
+// WriteFile atomically writes the instance definition to path so that
+// tedge-flows never loads a partially written file. The path determines whether the
+// instance is enabled or disabled, and the copy with the other status is removed afterwards.
+func WriteFile(path string, data map[string]interface{}) error {
+	err := fsutil.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		return toml.NewEncoder(w).Encode(data)
+	})
+	if err != nil {
+		return err
+	}
+	name, enabled, _ := parseFileName(filepath.Base(path))
+	otherPath := filepath.Join(filepath.Dir(path), FileName(name, !enabled))
+	if err := os.Remove(otherPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove previous instance file: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes both the enabled and disabled files of an instance.
+// It returns the paths of the removed files, which is empty if the instance did not exist.
+func Remove(deployDir string, name string) ([]string, error) {
+	if _, err := os.Stat(deployDir); err != nil {
+		return nil, fmt.Errorf("failed to read deploy dir: %w", err)
+	}
+	var removed []string
+	for _, enabled := range []bool{true, false} {
+		path := filepath.Join(deployDir, FileName(name, enabled))
+		if err := os.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, fmt.Errorf("failed to remove instance file: %w", err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// Read decodes an instance file
+func Read(path string) (*flows.InstanceFile, error) {
+	var data flows.InstanceFile
+	if _, err := toml.DecodeFile(path, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
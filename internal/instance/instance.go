@@ -0,0 +1,132 @@
+package instance
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Ext is the file extension of enabled instances, which tedge-flows loads
+	Ext = ".toml"
+	// DisabledExt is the file extension of disabled instances, which tedge-flows ignores
+	DisabledExt = ".toml.disabled"
+)
+
+const (
+	StatusEnabled  = "enabled"
+	StatusDisabled = "disabled"
+)
+
+// Entry is an instance file found in the deploy_dir
+type Entry struct {
+	Name    string
+	Path    string
+	Enabled bool
+}
+
+// Status returns the status of the instance (enabled or disabled)
+func (e Entry) Status() string {
+	if e.Enabled {
+		return StatusEnabled
+	}
+	return StatusDisabled
+}
+
+// FileName returns the file name of an instance in the deploy_dir
+func FileName(name string, enabled bool) string {
+	if enabled {
+		return name + Ext
+	}
+	return name + DisabledExt
+}
+
+// ValidateName checks that an instance name can be used as a file name in the deploy_dir
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("instance name is required")
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid instance name %q", name)
+	}
+	return nil
+}
+
+// parseFileName returns the instance name and whether it is enabled from a file name.
+// ok is false if the file is not an instance file.
+func parseFileName(fileName string) (name string, enabled bool, ok bool) {
+	if strings.HasPrefix(fileName, ".") {
+		return "", false, false
+	}
+	if name, found := strings.CutSuffix(fileName, DisabledExt); found {
+		return name, false, true
+	}
+	if name, found := strings.CutSuffix(fileName, Ext); found {
+		return name, true, true
+	}
+	return "", false, false
+}
+
+// List returns all enabled and disabled instances in deployDir, sorted by name
+func List(deployDir string) ([]Entry, error) {
+	files, err := os.ReadDir(deployDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name, enabled, ok := parseFileName(file.Name())
+		if !ok {
+			continue
+		}
+		entries = append(entries, Entry{
+			Name:    name,
+			Path:    filepath.Join(deployDir, file.Name()),
+			Enabled: enabled,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// Find returns the instance with the given name, or nil if it does not exist.
+// The enabled file is preferred if both an enabled and disabled file exist.
+func Find(deployDir string, name string) (*Entry, error) {
+	for _, enabled := range []bool{true, false} {
+		path := filepath.Join(deployDir, FileName(name, enabled))
+		if _, err := os.Stat(path); err == nil {
+			return &Entry{Name: name, Path: path, Enabled: enabled}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// SetEnabled enables or disables an instance by renaming its file. Disabled instances keep
+// their configuration but are not loaded by tedge-flows.
+// It returns false if the instance already had the requested status.
+func SetEnabled(deployDir string, name string, enabled bool) (bool, error) {
+	entry, err := Find(deployDir, name)
+	if err != nil {
+		return false, err
+	}
+	if entry == nil {
+		return false, fmt.Errorf("instance %s does not exist", name)
+	}
+	if entry.Enabled == enabled {
+		return false, nil
+	}
+	target := filepath.Join(deployDir, FileName(name, enabled))
+	if err := os.Rename(entry.Path, target); err != nil {
+		return false, fmt.Errorf("failed to rename instance file: %w", err)
+	}
+	return true, nil
+}
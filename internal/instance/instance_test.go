@@ -0,0 +1,41 @@
+package instance
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetEnabled(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.toml", "a.toml.disabled", ".a.toml.tmp-123", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "a" || entries[0].Enabled || entries[1].Name != "b" || !entries[1].Enabled {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	changed, err := SetEnabled(dir, "b", false)
+	if err != nil || !changed {
+		t.Fatalf("expected b to be disabled, changed=%v, err=%v", changed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.toml.disabled")); err != nil {
+		t.Errorf("expected disabled file to exist: %v", err)
+	}
+
+	changed, err = SetEnabled(dir, "b", false)
+	if err != nil || changed {
+		t.Errorf("expected disabling twice to be a no-op, changed=%v, err=%v", changed, err)
+	}
+
+	if _, err := SetEnabled(dir, "missing", true); err == nil {
+		t.Error("expected error for missing instance")
+	}
+}
@@ -0,0 +1,160 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"oras.land/oras-go/v2/registry"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/semver"
+)
+
+// anyVersion matches all released versions, to find the latest version of an image
+var anyVersion, _ = semver.ParseConstraint("*")
+
+// Update describes the newer versions available for the image of an instance
+type Update struct {
+	Instance string `json:"instance"`
+	Status   string `json:"status"`
+	// Repository is the image reference without the tag
+	Repository string `json:"repository"`
+	Current    string `json:"current"`
+	// Latest is the highest version of the repository
+	Latest string `json:"latest,omitempty"`
+	// LatestInRange is the highest version within Range, which "upgrade --to-latest" upgrades to
+	LatestInRange string `json:"latestInRange,omitempty"`
+	Range         string `json:"range,omitempty"`
+	// DigestChanged is true if the current tag points to another digest than the pulled one
+	DigestChanged bool `json:"digestChanged"`
+	// Outdated is true if there is a newer version (in range or not) or the tag was moved
+	Outdated bool `json:"outdated"`
+	// Upgradable is true if LatestInRange is newer than the current version
+	Upgradable bool `json:"upgradable"`
+	// Error is set if the instance file could not be read or the registry could not be queried
+	Error string `json:"error,omitempty"`
+}
+
+// CheckUpdates queries the registries of the images of the instances for newer versions.
+// The tags of each repository are listed once. An instance file which can't be read, or a
+// registry which can't be reached, is reported in the Error of its instances. Instances which
+// were not deployed from an image are skipped.
+func CheckUpdates(cfg *config.Config, entries []Entry) ([]Update, error) {
+	var updates []Update
+	repos := map[string][]int{}
+	var repoOrder []string
+	for _, entry := range entries {
+		current, err := Read(entry.Path)
+		if err != nil {
+			updates = append(updates, Update{Instance: entry.Name, Status: entry.Status(), Error: fmt.Sprintf("failed to read instance: %s", err)})
+			continue
+		}
+		if current.Metadata.Image == "" {
+			continue
+		}
+		repoRef, tag, err := registryauth.SplitRef(current.Metadata.Image)
+		if err != nil {
+			updates = append(updates, Update{Instance: entry.Name, Status: entry.Status(), Error: err.Error()})
+			continue
+		}
+		update := Update{Instance: entry.Name, Status: entry.Status(), Repository: repoRef, Current: tag}
+		// Without an allowed range (the tag is not a semantic version) only the latest is shown
+		update.Range, _ = AllowedRange(current.Metadata)
+		if _, ok := repos[repoRef]; !ok {
+			repoOrder = append(repoOrder, repoRef)
+		}
+		repos[repoRef] = append(repos[repoRef], len(updates))
+		updates = append(updates, update)
+	}
+	for _, repoRef := range repoOrder {
+		if err := checkRepository(cfg, repoRef, repos[repoRef], updates); err != nil {
+			for _, i := range repos[repoRef] {
+				updates[i].Error = err.Error()
+			}
+		}
+	}
+	return updates, nil
+}
+
+// checkRepository fills in the updates at indexes, which all have the image repository repoRef.
+// An error is returned if the tags of the repository can't be listed.
+func checkRepository(cfg *config.Config, repoRef string, indexes []int, updates []Update) error {
+	ctx := context.Background()
+	repo, err := registryauth.NewRepository(cfg, repoRef, false)
+	if err != nil {
+		return err
+	}
+	tags, err := registry.Tags(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("failed to list the tags of %s: %w", repoRef, err)
+	}
+	latest, _ := imagepull.LatestTag(tags, anyVersion)
+	remoteDigests := map[string]string{}
+	for _, i := range indexes {
+		u := &updates[i]
+		u.Latest = latest
+		current, currentErr := semver.Parse(u.Current)
+		if latest != "" && currentErr == nil {
+			latestVersion, _ := semver.Parse(latest)
+			u.Outdated = latestVersion.Compare(current) > 0
+		}
+		if u.Range != "" {
+			if constraint, err := semver.ParseConstraint(u.Range); err == nil {
+				u.LatestInRange, _ = imagepull.LatestTag(tags, constraint)
+			}
+		}
+		if u.LatestInRange != "" && currentErr == nil {
+			inRange, _ := semver.Parse(u.LatestInRange)
+			u.Upgradable = inRange.Compare(current) > 0
+		}
+
+		// A moving tag (e.g. latest) is outdated when it points to another digest. A tag which
+		// can't be resolved is reported for its instances only.
+		imageRef := repoRef + ":" + u.Current
+		imagePath, err := ImagePath(cfg, imageRef)
+		if err != nil {
+			u.Error = err.Error()
+			continue
+		}
+		pulled := PulledDigest(imagePath)
+		if pulled == "" || !slices.Contains(tags, u.Current) {
+			continue
+		}
+		remote, ok := remoteDigests[u.Current]
+		if !ok {
+			desc, err := repo.Resolve(ctx, u.Current)
+			if err != nil {
+				u.Error = fmt.Sprintf("failed to resolve %s: %s", imageRef, err)
+				continue
+			}
+			remote = desc.Digest.String()
+			remoteDigests[u.Current] = remote
+		}
+		if remote != pulled {
+			u.DigestChanged, u.Outdated = true, true
+		}
+	}
+	return nil
+}
+
+// PulledDigest returns the digest recorded when the image in imagePath was pulled, or an empty
+// string if it is unknown (e.g. the image was pulled by an older version or loaded from a tarball)
+func PulledDigest(imagePath string) string {
+	data, err := os.ReadFile(filepath.Join(imagePath, "manifest.json"))
+	if err != nil {
+		return ""
+	}
+	var manifest struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ""
+	}
+	return manifest.Digest
+}
@@ -0,0 +1,81 @@
+package instance
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth/registrytest"
+)
+
+func TestCheckUpdates(t *testing.T) {
+	reg := registrytest.Start()
+	defer reg.Close()
+	flow := func(version string) map[string]string {
+		return map[string]string{"dist/main.mjs": "// " + version}
+	}
+	for _, version := range []string{"1.0.0", "1.0.1", "1.1.0", "2.0.0"} {
+		reg.Push("thin-edge/counter", version, flow(version))
+	}
+	reg.Push("thin-edge/moving", "latest", flow("a"))
+
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	// The images are pulled from the registry, except the one of the unreachable registry
+	unreachable := filepath.Join(cfg.ImageDir, "offline:1.0.0", "dist", "main.mjs")
+	if err := os.MkdirAll(filepath.Dir(unreachable), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(unreachable, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, image := range map[string]string{
+		"a": reg.Host() + "/thin-edge/counter:1.0.0",
+		"b": reg.Host() + "/thin-edge/counter:1.0.0",
+		"c": reg.Host() + "/thin-edge/moving:latest",
+		"d": "127.0.0.1:1/thin-edge/offline:1.0.0",
+	} {
+		if _, err := Deploy(cfg, DeployOptions{Name: name, Image: image}, io.Discard); err != nil {
+			t.Fatalf("failed to deploy %s: %s", name, err)
+		}
+	}
+	reg.Push("thin-edge/moving", "latest", flow("b"))
+	// An invalid instance file is reported without failing the others
+	if err := os.WriteFile(filepath.Join(cfg.DeployDir, "e.toml"), []byte("steps = ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := List(cfg.DeployDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := CheckUpdates(cfg, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 5 {
+		t.Fatalf("expected an update per instance, got %+v", updates)
+	}
+	for _, u := range updates[:2] {
+		if u.Error != "" || u.Latest != "2.0.0" || u.LatestInRange != "1.0.1" || !u.Outdated || !u.Upgradable || u.DigestChanged {
+			t.Errorf("unexpected update of %s: %+v", u.Instance, u)
+		}
+	}
+	if got := reg.Requests("GET", "thin-edge/counter/tags/list"); got != 1 {
+		t.Errorf("expected the tags of a repository to be listed once, got %d requests", got)
+	}
+	if u := updates[2]; u.Error != "" || !u.DigestChanged || !u.Outdated {
+		t.Errorf("expected the moved tag of %s to be reported: %+v", u.Instance, u)
+	}
+	if u := updates[3]; u.Error == "" || u.Outdated {
+		t.Errorf("expected the unreachable registry of %s to be reported: %+v", u.Instance, u)
+	}
+	if u := updates[4]; u.Instance != "e" || u.Error == "" {
+		t.Errorf("expected the invalid instance file to be reported: %+v", u)
+	}
+}
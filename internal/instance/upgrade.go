@@ -0,0 +1,89 @@
+package instance
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/semver"
+	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
+)
+
+// AllowedRange returns the range of versions an instance may be upgraded within: the range
+// it was deployed with, or else the patch releases of its current version (e.g. ~1.2.3)
+func AllowedRange(metadata flows.InstanceMetadata) (string, error) {
+	if metadata.VersionRange != "" {
+		return metadata.VersionRange, nil
+	}
+	_, tag, err := registryauth.SplitRef(metadata.Image)
+	if err != nil {
+		return "", err
+	}
+	v, err := semver.Parse(tag)
+	if err != nil {
+		return "", fmt.Errorf("the version %s of %s is not a semantic version, set the version range explicitly", tag, metadata.Image)
+	}
+	return "~" + v.String(), nil
+}
+
+// LatestImage returns the highest version of the image current which is within the range.
+// upgrade is false if current is already the highest version (or newer).
+func LatestImage(cfg *config.Config, current string, versionRange string) (resolved imagepull.Resolved, upgrade bool, err error) {
+	repoRef, tag, err := registryauth.SplitRef(current)
+	if err != nil {
+		return resolved, false, err
+	}
+	resolved, err = imagepull.ResolveVersion(cfg, repoRef, versionRange)
+	if err != nil || resolved.Tag == tag {
+		return resolved, false, err
+	}
+	if currentVersion, err := semver.Parse(tag); err == nil {
+		latestVersion, _ := semver.Parse(resolved.Tag)
+		return resolved, latestVersion.Compare(currentVersion) > 0, nil
+	}
+	return resolved, true, nil
+}
+
+// Upgrade redeploys an instance with another image. The topics, interval and step config of
+// the instance are kept, as well as its status (enabled or disabled), owner and update policy.
+// The version range is recorded for later upgrades, unless image has a version range itself.
+// The caller is responsible for locking the image_dir and deploy_dir.
+func Upgrade(cfg *config.Config, entry Entry, image string, versionRange string, w io.Writer) (string, error) {
+	current, err := Read(entry.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read instance %s: %w", entry.Name, err)
+	}
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(entry.Path, &raw); err != nil {
+		return "", fmt.Errorf("failed to read instance %s: %w", entry.Name, err)
+	}
+	opts := DeployOptions{
+		Name:         entry.Name,
+		Image:        image,
+		Topics:       current.Input.MQTT.Topics,
+		ManagedBy:    current.Metadata.ManagedBy,
+		VersionRange: versionRange,
+		UpdatePolicy: current.Metadata.UpdatePolicy,
+	}
+	var firstStep map[string]interface{}
+	switch steps := raw["steps"].(type) {
+	case []map[string]interface{}:
+		if len(steps) > 0 {
+			firstStep = steps[0]
+		}
+	case []interface{}:
+		if len(steps) > 0 {
+			firstStep, _ = steps[0].(map[string]interface{})
+		}
+	}
+	if interval, ok := firstStep["interval"].(string); ok {
+		opts.Interval = interval
+	}
+	if params, ok := firstStep["config"].(map[string]interface{}); ok {
+		opts.Params = params
+	}
+	return deploy(cfg, opts, entry.Enabled, w)
+}
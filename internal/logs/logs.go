@@ -0,0 +1,335 @@
+// Package logs reads the log lines which the flows runtime emitted for an instance, from
+// a log file, journald or MQTT debug topics.
+package logs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+	"github.com/thin-edge/tedge-oscar/internal/tedge"
+)
+
+// Source types
+const (
+	SourceJournald = "journald"
+	SourceFile     = "file"
+	SourceMQTT     = "mqtt"
+)
+
+// DefaultUnit is the systemd unit of the flows runtime, used if logs.unit is not set
+const DefaultUnit = "tedge-flows"
+
+// pollInterval is how often a followed log file is checked for new lines
+const pollInterval = 500 * time.Millisecond
+
+// Entry is a log line of an instance
+type Entry struct {
+	// Time is zero if the time of the line is unknown
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Message  string    `json:"message"`
+}
+
+// String formats the entry as a text line, prefixed with its time unless the message
+// already starts with a timestamp
+func (e Entry) String() string {
+	if _, ok := parseLineTime(e.Message); ok || e.Time.IsZero() {
+		return e.Message
+	}
+	return e.Time.Format(time.RFC3339) + " " + e.Message
+}
+
+// Options controls which lines are read
+type Options struct {
+	Instance string
+	// Match reports whether a line belongs to the instance
+	Match func(line string) bool
+	// Since skips lines older than this time, if set
+	Since  time.Time
+	Follow bool
+}
+
+// Source reads log lines, calling emit for each line which belongs to the instance
+type Source interface {
+	Read(ctx context.Context, opts Options, emit func(Entry) error) error
+}
+
+// NewSource returns the configured source. kind overrides logs.source if not empty.
+func NewSource(cfg *config.Config, kind string) (Source, error) {
+	if kind == "" {
+		kind = cfg.Logs.Source
+	}
+	switch kind {
+	case "", SourceJournald:
+		unit := cfg.Logs.Unit
+		if unit == "" {
+			unit = DefaultUnit
+		}
+		return &journaldSource{unit: unit}, nil
+	case SourceFile:
+		if cfg.Logs.File == "" {
+			return nil, fmt.Errorf("logs.file is required for the file log source")
+		}
+		return &fileSource{path: cfg.Logs.File}, nil
+	case SourceMQTT:
+		if cfg.Logs.Topic == "" {
+			return nil, fmt.Errorf("logs.topic is required for the mqtt log source")
+		}
+		return &mqttSource{cfg: cfg, topic: cfg.Logs.Topic}, nil
+	}
+	return nil, fmt.Errorf("unknown log source %q, expected one of: %s, %s, %s", kind, SourceJournald, SourceFile, SourceMQTT)
+}
+
+// Matcher returns a function which reports whether a line mentions one of the instance
+// files. The file name must not be part of a longer name, e.g. counter1.toml does not
+// match mycounter1.toml or counter1.toml.bak, but it matches /etc/tedge/flows/counter1.toml
+// and "loaded counter1.toml.".
+func Matcher(paths ...string) func(string) bool {
+	return func(line string) bool {
+		for _, path := range paths {
+			base := filepath.Base(path)
+			for offset := 0; ; {
+				i := strings.Index(line[offset:], base)
+				if i < 0 {
+					break
+				}
+				pos := offset + i
+				if (pos == 0 || !isNameChar(rune(line[pos-1]))) && isNameEnd(line[pos+len(base):]) {
+					return true
+				}
+				offset = pos + 1
+			}
+		}
+		return false
+	}
+}
+
+// isNameEnd reports whether a name is not continued by rest. A dot which ends a sentence
+// doesn't continue the name.
+func isNameEnd(rest string) bool {
+	if rest == "" || !isNameChar(rune(rest[0])) {
+		return true
+	}
+	return rest[0] == '.' && (len(rest) == 1 || !isNameChar(rune(rest[1])))
+}
+
+func isNameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.'
+}
+
+// ParseSince parses a --since value, either a duration before now (e.g. 10m) or a
+// timestamp (RFC3339 or "2006-01-02 15:04:05" in local time)
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateTime, value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value %q, expected a duration (e.g. 10m) or a timestamp (e.g. 2025-01-02T15:04:05Z)", value)
+}
+
+// parseLineTime returns the timestamp at the start of a log line, if there is one
+func parseLineTime(line string) (time.Time, bool) {
+	field, _, _ := strings.Cut(strings.TrimLeft(line, "["), " ")
+	field = strings.TrimRight(field, "]")
+	for _, layout := range []string{time.RFC3339Nano, time.RFC3339} {
+		if t, err := time.Parse(layout, field); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// fileSource reads a log file, e.g. when the runtime is not managed by systemd
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Read(ctx context.Context, opts Options, emit func(Entry) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer f.Close()
+
+	handle := func(line string) error {
+		if !opts.Match(line) {
+			return nil
+		}
+		// Lines without a timestamp can't be filtered by time, so they are kept
+		t, ok := parseLineTime(line)
+		if ok && !opts.Since.IsZero() && t.Before(opts.Since) {
+			return nil
+		}
+		return emit(Entry{Time: t, Instance: opts.Instance, Message: line})
+	}
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	var partial string
+	for {
+		chunk, err := reader.ReadString('\n')
+		offset += int64(len(chunk))
+		if err == nil {
+			if err := handle(strings.TrimRight(partial+chunk, "\r\n")); err != nil {
+				return err
+			}
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			return fmt.Errorf("failed to read log file: %w", err)
+		}
+		// Keep an incomplete last line until the rest of it is written
+		partial += chunk
+		if !opts.Follow {
+			if partial != "" {
+				return handle(partial)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pollInterval):
+		}
+		// Start again from the beginning if the file was truncated (e.g. by logrotate)
+		if info, err := f.Stat(); err == nil && info.Size() < offset {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			offset = 0
+			partial = ""
+		}
+		reader.Reset(f)
+	}
+}
+
+// journaldSource reads the journal of the runtime's systemd unit using journalctl
+type journaldSource struct {
+	unit string
+}
+
+func (s *journaldSource) Read(ctx context.Context, opts Options, emit func(Entry) error) error {
+	args := []string{"--unit", s.unit, "--output", "json", "--no-pager"}
+	if !opts.Since.IsZero() {
+		args = append(args, "--since", opts.Since.Local().Format(time.DateTime))
+	}
+	if opts.Follow {
+		args = append(args, "--follow")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := exec.CommandContext(ctx, "journalctl", args...)
+	c.Stderr = os.Stderr
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return fmt.Errorf("failed to run journalctl: %w", err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry, ok := parseJournalLine(scanner.Bytes())
+		if !ok || !opts.Match(entry.Message) {
+			continue
+		}
+		entry.Instance = opts.Instance
+		if err := emit(entry); err != nil {
+			return err
+		}
+	}
+	if err := c.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("journalctl failed: %w", err)
+	}
+	return nil
+}
+
+// parseJournalLine decodes a line of "journalctl --output json"
+func parseJournalLine(line []byte) (Entry, bool) {
+	var record struct {
+		Message   json.RawMessage `json:"MESSAGE"`
+		Timestamp string          `json:"__REALTIME_TIMESTAMP"`
+	}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return Entry{}, false
+	}
+	var entry Entry
+	// MESSAGE is a string, or an array of bytes if it is not valid UTF-8
+	if err := json.Unmarshal(record.Message, &entry.Message); err != nil {
+		var raw []byte
+		var ints []int
+		if err := json.Unmarshal(record.Message, &ints); err != nil {
+			return Entry{}, false
+		}
+		for _, b := range ints {
+			raw = append(raw, byte(b))
+		}
+		entry.Message = string(raw)
+	}
+	if usec, err := strconv.ParseInt(record.Timestamp, 10, 64); err == nil {
+		entry.Time = time.UnixMicro(usec)
+	}
+	return entry, true
+}
+
+// mqttSource reads the debug messages which the runtime publishes over MQTT. Messages are
+// only received while subscribed, so the source always follows until it is cancelled.
+type mqttSource struct {
+	cfg   *config.Config
+	topic string
+}
+
+func (s *mqttSource) Read(ctx context.Context, opts Options, emit func(Entry) error) error {
+	settings, err := tedge.LoadMQTTSettings(s.cfg)
+	if err != nil {
+		return err
+	}
+	client, err := settings.Connect(fmt.Sprintf("tedge-oscar-logs-%d", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	entries := make(chan Entry, 100)
+	err = client.Subscribe(s.topic, func(msg mqtt.Message) {
+		message := string(msg.Payload)
+		if !opts.Match(msg.Topic) && !opts.Match(message) {
+			return
+		}
+		select {
+		case entries <- Entry{Time: time.Now(), Instance: opts.Instance, Message: message}:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case entry := <-entries:
+			if err := emit(entry); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package logs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+func TestMatcher(t *testing.T) {
+	match := Matcher("/etc/tedge/flows/counter1.toml")
+	tests := map[string]bool{
+		"loading /etc/tedge/flows/counter1.toml":   true,
+		"flow counter1.toml: processed 3 messages": true,
+		"loading /etc/tedge/flows/mycounter1.toml": false,
+		"loading counter10.toml":                   false,
+		"counter1.toml":                            true,
+		"loaded counter1.toml.":                    true,
+		"loading counter1.tomlx":                   false,
+		"loading counter1.toml.bak":                false,
+		"loading counter1.toml_old and other.toml": false,
+	}
+	for line, want := range tests {
+		if got := match(line); got != want {
+			t.Errorf("match(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.log")
+	content := "2025-01-01T10:00:00Z INFO loaded counter1.toml\n" +
+		"2025-01-01T11:00:00Z INFO loaded counter2.toml\n" +
+		"2025-01-01T12:00:00Z ERROR counter1.toml: script failed\n" +
+		"no timestamp counter1.toml"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewSource(&config.Config{Logs: config.LogsConfig{Source: SourceFile, File: path}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	err = source.Read(context.Background(), Options{
+		Instance: "counter1",
+		Match:    Matcher("counter1.toml"),
+		Since:    time.Date(2025, 1, 1, 10, 30, 0, 0, time.UTC),
+	}, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	if entries[0].Message != "2025-01-01T12:00:00Z ERROR counter1.toml: script failed" || entries[0].Time.Hour() != 12 {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+	if entries[1].Message != "no timestamp counter1.toml" || !entries[1].Time.IsZero() {
+		t.Errorf("unexpected entry: %+v", entries[1])
+	}
+}
+
+func TestParseJournalLine(t *testing.T) {
+	entry, ok := parseJournalLine([]byte(`{"MESSAGE":"loaded counter1.toml","__REALTIME_TIMESTAMP":"1735725600000000"}`))
+	if !ok || entry.Message != "loaded counter1.toml" || !entry.Time.Equal(time.Unix(1735725600, 0)) {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	entry, ok = parseJournalLine([]byte(`{"MESSAGE":[104,105]}`))
+	if !ok || entry.Message != "hi" {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+}
@@ -0,0 +1,131 @@
+// Package mqtt is a small wrapper around the paho MQTT client for talking to the
+// thin-edge.io MQTT broker.
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultTimeout is used for connecting, publishing and subscribing if Options.Timeout is not set
+const DefaultTimeout = 10 * time.Second
+
+// Options describes how to connect to the broker
+type Options struct {
+	// Broker is the broker URL, e.g. tcp://127.0.0.1:1883 or ssl://127.0.0.1:8883
+	Broker    string
+	ClientID  string
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// OnConnect is called on every (re)connect, e.g. to restore subscriptions
+	OnConnect func(c *Client)
+}
+
+// Message is a message received on a subscription
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+// Handler is called for each message received on a subscription
+type Handler func(msg Message)
+
+// Client is a connection to an MQTT broker
+type Client struct {
+	client  paho.Client
+	timeout time.Duration
+}
+
+// Connect opens a connection to the broker
+func Connect(opts Options) (*Client, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	c := &Client{timeout: timeout}
+	clientOpts := paho.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetCleanSession(true).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(true).
+		SetOrderMatters(false)
+	if opts.TLSConfig != nil {
+		clientOpts.SetTLSConfig(opts.TLSConfig)
+	}
+	if opts.OnConnect != nil {
+		clientOpts.SetOnConnectHandler(func(paho.Client) {
+			opts.OnConnect(c)
+		})
+	}
+	c.client = paho.NewClient(clientOpts)
+	if err := wait(c.client.Connect(), timeout); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker %s: %w", opts.Broker, err)
+	}
+	return c, nil
+}
+
+// Publish sends a message with QoS 1 and waits for the broker to acknowledge it
+func (c *Client) Publish(topic string, payload []byte, retained bool) error {
+	if err := wait(c.client.Publish(topic, 1, retained, payload), c.timeout); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Subscribe registers a handler for the topic filter with QoS 1
+func (c *Client) Subscribe(filter string, handler Handler) error {
+	token := c.client.Subscribe(filter, 1, func(_ paho.Client, m paho.Message) {
+		handler(Message{Topic: m.Topic(), Payload: m.Payload(), Retained: m.Retained()})
+	})
+	if err := wait(token, c.timeout); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", filter, err)
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription of the topic filter
+func (c *Client) Unsubscribe(filter string) error {
+	if err := wait(c.client.Unsubscribe(filter), c.timeout); err != nil {
+		return fmt.Errorf("failed to unsubscribe from %s: %w", filter, err)
+	}
+	return nil
+}
+
+// Close disconnects from the broker, giving in-flight messages a short time to complete
+func (c *Client) Close() {
+	c.client.Disconnect(250)
+}
+
+func wait(token paho.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return token.Error()
+}
+
+// MatchTopic reports whether the topic matches the filter, which may contain the
+// single level (+) and multi level (#) wildcards
+func MatchTopic(filter string, topic string) bool {
+	return matchLevels(strings.Split(filter, "/"), strings.Split(topic, "/"))
+}
+
+func matchLevels(filter []string, topic []string) bool {
+	for i, level := range filter {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if level != "+" && level != topic[i] {
+			return false
+		}
+	}
+	return len(filter) == len(topic)
+}
@@ -0,0 +1,238 @@
+// Package mqtttest provides a minimal in-process MQTT 3.1.1 broker for tests. It supports
+// QoS 0/1 publishing, retained messages and wildcard subscriptions, which is enough to
+// stand in for the thin-edge.io broker.
+package mqtttest
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+)
+
+// Broker is a minimal MQTT broker listening on a random local port
+type Broker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	conns    map[*conn]struct{}
+	retained map[string][]byte
+	// published records every message received by the broker, in order
+	published []mqtt.Message
+	changed   chan struct{}
+}
+
+type conn struct {
+	net.Conn
+	writeMu sync.Mutex
+	filters map[string]struct{}
+}
+
+// Start starts a broker on 127.0.0.1 with a random port
+func Start() (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		listener: listener,
+		conns:    map[*conn]struct{}{},
+		retained: map[string][]byte{},
+		changed:  make(chan struct{}),
+	}
+	go b.serve()
+	return b, nil
+}
+
+// URL returns the broker URL, e.g. tcp://127.0.0.1:12345
+func (b *Broker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Addr returns the host and port of the broker
+func (b *Broker) Addr() (string, int) {
+	addr := b.listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// Close stops the broker and closes all client connections
+func (b *Broker) Close() {
+	_ = b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		_ = c.Close()
+	}
+}
+
+// Disconnect closes all client connections, e.g. to test reconnects
+func (b *Broker) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		_ = c.Close()
+	}
+}
+
+// Retained returns the retained message of a topic
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+// Published returns a copy of all messages received by the broker
+func (b *Broker) Published() []mqtt.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqtt.Message(nil), b.published...)
+}
+
+// WaitFor waits until a message matching the topic filter is published and returns the
+// first such message, or false if no message arrived within the timeout
+func (b *Broker) WaitFor(filter string, timeout time.Duration) (mqtt.Message, bool) {
+	deadline := time.After(timeout)
+	for {
+		b.mu.Lock()
+		for _, msg := range b.published {
+			if mqtt.MatchTopic(filter, msg.Topic) {
+				b.mu.Unlock()
+				return msg, true
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return mqtt.Message{}, false
+		}
+	}
+}
+
+// Publish sends a message to all matching subscribers, as if it was published by a client
+func (b *Broker) Publish(topic string, payload []byte, retained bool) {
+	b.handlePublish(topic, payload, retained)
+}
+
+func (b *Broker) serve() {
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc, filters: map[string]struct{}{}}
+		b.mu.Lock()
+		b.conns[c] = struct{}{}
+		b.mu.Unlock()
+		go b.handle(c)
+	}
+}
+
+func (b *Broker) handle(c *conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+		_ = c.Close()
+	}()
+	for {
+		cp, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = packets.Accepted
+			c.write(ack)
+		case *packets.PublishPacket:
+			b.handlePublish(p.TopicName, p.Payload, p.Retain)
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.write(ack)
+			}
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			b.mu.Lock()
+			for i, filter := range p.Topics {
+				c.filters[filter] = struct{}{}
+				ack.ReturnCodes = append(ack.ReturnCodes, min(p.Qoss[i], 1))
+			}
+			var retained []*packets.PublishPacket
+			for topic, payload := range b.retained {
+				for _, filter := range p.Topics {
+					if mqtt.MatchTopic(filter, topic) {
+						retained = append(retained, newPublish(topic, payload, true))
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			c.write(ack)
+			for _, msg := range retained {
+				c.write(msg)
+			}
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, filter := range p.Topics {
+				delete(c.filters, filter)
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			c.write(ack)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *Broker) handlePublish(topic string, payload []byte, retained bool) {
+	b.mu.Lock()
+	if retained {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	b.published = append(b.published, mqtt.Message{Topic: topic, Payload: payload, Retained: retained})
+	close(b.changed)
+	b.changed = make(chan struct{})
+	var subscribers []*conn
+	for c := range b.conns {
+		for filter := range c.filters {
+			if mqtt.MatchTopic(filter, topic) {
+				subscribers = append(subscribers, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range subscribers {
+		// Messages are forwarded with QoS 0, so no acknowledgement is expected
+		c.write(newPublish(topic, payload, false))
+	}
+}
+
+func newPublish(topic string, payload []byte, retained bool) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Retain = retained
+	return p
+}
+
+func (c *conn) write(p packets.ControlPacket) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = p.Write(c.Conn)
+}
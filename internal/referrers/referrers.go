@@ -0,0 +1,304 @@
+// Package referrers attaches artifacts (SBOM, changelog, README, test results, ...) to flow
+// images and fetches them back. An attached artifact is a manifest whose subject is the
+// manifest of the flow image, so it is listed by the OCI referrers API of the registry.
+package referrers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+
+	"github.com/thin-edge/tedge-oscar/internal/imagepush"
+	"github.com/thin-edge/tedge-oscar/internal/signature"
+)
+
+// ChangelogArtifactType is the artifact type of changelogs attached to a flow image
+const ChangelogArtifactType = "application/vnd.tedge.flow.changelog.v1"
+
+// Kinds of attached artifacts
+const (
+	KindSignature = "signature"
+	KindSBOM      = "sbom"
+	KindChangelog = "changelog"
+	KindOther     = "other"
+)
+
+// sbomArtifactTypes are the artifact types of the common SBOM formats
+var sbomArtifactTypes = map[string]bool{
+	"application/spdx+json":          true,
+	"text/spdx":                      true,
+	"application/vnd.cyclonedx+json": true,
+	"application/vnd.cyclonedx+xml":  true,
+	"application/vnd.syft+json":      true,
+}
+
+// maxChangelogSize is the maximum size of a changelog shown by Inspect
+const maxChangelogSize = 64 * 1024
+
+// File is a file of an image or attached artifact
+type File struct {
+	Name      string        `json:"name"`
+	MediaType string        `json:"mediaType"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+}
+
+// Artifact is an artifact attached to an image
+type Artifact struct {
+	Digest       digest.Digest     `json:"digest"`
+	ArtifactType string            `json:"artifactType"`
+	Kind         string            `json:"kind"`
+	Created      string            `json:"created,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Files        []File            `json:"files"`
+}
+
+// kindOf classifies an artifact by its artifact type, or by the names of its files
+func kindOf(artifactType string, files []File) string {
+	switch {
+	case artifactType == signature.ArtifactType:
+		return KindSignature
+	case sbomArtifactTypes[artifactType]:
+		return KindSBOM
+	case artifactType == ChangelogArtifactType:
+		return KindChangelog
+	}
+	for _, f := range files {
+		if strings.HasPrefix(strings.ToUpper(f.Name), "CHANGELOG") {
+			return KindChangelog
+		}
+	}
+	return KindOther
+}
+
+// filesOf returns the files of the layers of a manifest
+func filesOf(layers []ocispec.Descriptor) []File {
+	files := make([]File, 0, len(layers))
+	for _, layer := range layers {
+		files = append(files, File{
+			Name:      layer.Annotations[ocispec.AnnotationTitle],
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		})
+	}
+	return files
+}
+
+// Attach pushes the files as an artifact of the given type which refers to the subject
+// manifest. The files are stored under their base name, so the names must be unique.
+func Attach(ctx context.Context, target oras.Target, subject ocispec.Descriptor, artifactType string, files []string, annotations map[string]string) (ocispec.Descriptor, error) {
+	if artifactType == "" {
+		return ocispec.Descriptor{}, errors.New("an artifact type is required")
+	}
+	if len(files) == 0 {
+		return ocispec.Descriptor{}, errors.New("no files to attach")
+	}
+	names := map[string]string{}
+	layers := make([]ocispec.Descriptor, 0, len(files))
+	for _, f := range files {
+		name := filepath.Base(f)
+		if other, ok := names[name]; ok {
+			return ocispec.Descriptor{}, fmt.Errorf("files %s and %s have the same name %s", other, f, name)
+		}
+		names[name] = f
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to read file %s: %w", f, err)
+		}
+		layer := ocispec.Descriptor{
+			MediaType:   imagepush.MediaTypeOf(f),
+			Digest:      digest.FromBytes(data),
+			Size:        int64(len(data)),
+			Annotations: map[string]string{ocispec.AnnotationTitle: name},
+		}
+		if err := target.Push(ctx, layer, bytes.NewReader(data)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to push file %s: %w", f, err)
+		}
+		layers = append(layers, layer)
+	}
+	manifestAnnotations := map[string]string{ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339)}
+	for k, v := range annotations {
+		if v != "" {
+			manifestAnnotations[k] = v
+		}
+	}
+	desc, err := oras.PackManifest(ctx, target, oras.PackManifestVersion1_1, artifactType, oras.PackManifestOptions{
+		Subject:             &subject,
+		Layers:              layers,
+		ManifestAnnotations: manifestAnnotations,
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to push artifact: %w", err)
+	}
+	return desc, nil
+}
+
+// List returns the artifacts attached to the subject manifest, optionally filtered by
+// artifact type, sorted by creation time
+func List(ctx context.Context, store content.ReadOnlyGraphStorage, subject ocispec.Descriptor, artifactType string) ([]Artifact, error) {
+	descs, err := registry.Referrers(ctx, store, subject, artifactType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	artifacts := make([]Artifact, 0, len(descs))
+	for _, desc := range descs {
+		manifest, err := fetchManifest(ctx, store, desc)
+		if err != nil {
+			return nil, err
+		}
+		a := Artifact{
+			Digest:       desc.Digest,
+			ArtifactType: manifest.ArtifactType,
+			Created:      manifest.Annotations[ocispec.AnnotationCreated],
+			Annotations:  manifest.Annotations,
+			Files:        filesOf(manifest.Layers),
+		}
+		if a.ArtifactType == "" {
+			a.ArtifactType = manifest.Config.MediaType
+		}
+		a.Kind = kindOf(a.ArtifactType, a.Files)
+		artifacts = append(artifacts, a)
+	}
+	sort.SliceStable(artifacts, func(i, j int) bool { return artifacts[i].Created < artifacts[j].Created })
+	return artifacts, nil
+}
+
+// Pull writes the files of the attached artifact to dir. Only the titled layers are written,
+// not the image the artifact refers to.
+func Pull(ctx context.Context, src content.ReadOnlyStorage, a Artifact, dir string) error {
+	for _, f := range a.Files {
+		if f.Name == "" {
+			continue
+		}
+		if !filepath.IsLocal(f.Name) {
+			return fmt.Errorf("artifact %s has a file with invalid name %q", a.Digest, f.Name)
+		}
+		data, err := content.FetchAll(ctx, src, ocispec.Descriptor{MediaType: f.MediaType, Digest: f.Digest, Size: f.Size})
+		if err != nil {
+			return fmt.Errorf("failed to fetch file %s of artifact %s: %w", f.Name, a.Digest, err)
+		}
+		path := filepath.Join(dir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return fmt.Errorf("failed to write file %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Image is the description of a flow image and of the artifacts attached to it
+type Image struct {
+	Reference    string            `json:"reference"`
+	Digest       digest.Digest     `json:"digest"`
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Files        []File            `json:"files,omitempty"`
+	// Variants are the manifests of a multi-variant image (an image index)
+	Variants  []ImageVariant `json:"variants,omitempty"`
+	Referrers []Artifact     `json:"referrers"`
+	// Changelog is the content of the latest attached changelog
+	Changelog string `json:"changelog,omitempty"`
+}
+
+// ImageVariant is a manifest of a multi-variant image
+type ImageVariant struct {
+	Digest digest.Digest `json:"digest"`
+	// Annotations are the annotations of the manifest in the index, i.e. its requirements
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Files       []File            `json:"files"`
+}
+
+// Artifacts returns the attached artifacts of the given kind
+func (img *Image) Artifacts(kind string) []Artifact {
+	var artifacts []Artifact
+	for _, a := range img.Referrers {
+		if a.Kind == kind {
+			artifacts = append(artifacts, a)
+		}
+	}
+	return artifacts
+}
+
+// Inspect describes the image manifest desc and its attached artifacts
+func Inspect(ctx context.Context, store content.ReadOnlyGraphStorage, imageRef string, desc ocispec.Descriptor) (*Image, error) {
+	data, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	img := &Image{Reference: imageRef, Digest: desc.Digest, MediaType: desc.MediaType}
+	if desc.MediaType == ocispec.MediaTypeImageIndex {
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("invalid image index of %s: %w", imageRef, err)
+		}
+		img.ArtifactType, img.Annotations = index.ArtifactType, index.Annotations
+		for _, m := range index.Manifests {
+			manifest, err := fetchManifest(ctx, store, m)
+			if err != nil {
+				return nil, err
+			}
+			img.Variants = append(img.Variants, ImageVariant{Digest: m.Digest, Annotations: m.Annotations, Files: filesOf(manifest.Layers)})
+		}
+	} else {
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest of %s: %w", imageRef, err)
+		}
+		img.ArtifactType, img.Annotations, img.Files = manifest.ArtifactType, manifest.Annotations, filesOf(manifest.Layers)
+	}
+	if img.Referrers, err = List(ctx, store, desc, ""); err != nil {
+		return nil, err
+	}
+	if changelogs := img.Artifacts(KindChangelog); len(changelogs) > 0 {
+		if img.Changelog, err = fetchChangelog(ctx, store, changelogs[len(changelogs)-1]); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+func fetchManifest(ctx context.Context, store content.Fetcher, desc ocispec.Descriptor) (ocispec.Manifest, error) {
+	var manifest ocispec.Manifest
+	data, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to fetch manifest %s: %w", desc.Digest, err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest %s: %w", desc.Digest, err)
+	}
+	return manifest, nil
+}
+
+// fetchChangelog returns the content of the first file of a changelog artifact
+func fetchChangelog(ctx context.Context, store content.ReadOnlyStorage, a Artifact) (string, error) {
+	if len(a.Files) == 0 {
+		return "", nil
+	}
+	f := a.Files[0]
+	if f.Size > maxChangelogSize {
+		return fmt.Sprintf("(changelog %s is too large to show, %d bytes)", f.Name, f.Size), nil
+	}
+	data, err := content.FetchAll(ctx, store, ocispec.Descriptor{MediaType: f.MediaType, Digest: f.Digest, Size: f.Size})
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch changelog %s: %w", f.Name, err)
+	}
+	return string(data), nil
+}
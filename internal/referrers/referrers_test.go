@@ -0,0 +1,69 @@
+package referrers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestAttachAndInspect(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	store := memory.New()
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/vnd.tedge.flow.v1","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`)
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+	if err := store.Push(ctx, subject, strings.NewReader(string(manifest))); err != nil {
+		t.Fatal(err)
+	}
+
+	sbom := filepath.Join(dir, "sbom.json")
+	changelog := filepath.Join(dir, "CHANGELOG.md")
+	if err := os.WriteFile(sbom, []byte(`{"spdxVersion":"SPDX-2.3"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(changelog, []byte("## 1.0\n- first release\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Attach(ctx, store, subject, "application/spdx+json", []string{sbom}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Attach(ctx, store, subject, "text/markdown", []string{changelog}, map[string]string{ocispec.AnnotationCreated: "2026-01-01T00:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Attach(ctx, store, subject, "text/plain", []string{sbom, filepath.Join(dir, "sub", "sbom.json")}, nil); err == nil {
+		t.Error("expected files with the same name to be rejected")
+	}
+
+	sboms, err := List(ctx, store, subject, "application/spdx+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sboms) != 1 || sboms[0].Kind != KindSBOM || sboms[0].Files[0].Name != "sbom.json" {
+		t.Fatalf("unexpected SBOM artifacts %+v", sboms)
+	}
+
+	img, err := Inspect(ctx, store, "example.com/flow:1.0", subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Referrers) != 2 || img.ArtifactType != "application/vnd.tedge.flow.v1" {
+		t.Errorf("unexpected image %+v", img)
+	}
+	if img.Changelog != "## 1.0\n- first release\n" {
+		t.Errorf("expected the changelog to be detected by its file name, got %q", img.Changelog)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := Pull(ctx, store, sboms[0], out); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(out, "sbom.json")); err != nil || !strings.Contains(string(data), "SPDX-2.3") {
+		t.Errorf("expected the SBOM to be pulled, got %q %v", data, err)
+	}
+}
@@ -0,0 +1,111 @@
+package registryauth
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limitRateOverride is the --limit-rate of the command line, which overrides limit_rate
+var limitRateOverride int64 = -1
+
+// SetLimitRate overrides the limit_rate of the config, in bytes per second. 0 disables the
+// limit and a negative rate uses the config.
+func SetLimitRate(bytesPerSecond int64) {
+	limitRateOverride = bytesPerSecond
+}
+
+var (
+	limitersMu sync.Mutex
+	// limiters are shared by all the repositories, so the limit applies to the whole process
+	limiters = map[int64]*rateLimiter{}
+)
+
+// sharedLimiter returns the limiter of the given rate
+func sharedLimiter(rate int64) *rateLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[rate]
+	if !ok {
+		l = &rateLimiter{rate: rate}
+		limiters[rate] = l
+	}
+	return l
+}
+
+// rateLimiter is a token bucket which allows a burst of one second of transfer
+type rateLimiter struct {
+	rate int64
+	mu   sync.Mutex
+	// next is when the bytes transferred so far are paid off
+	next time.Time
+}
+
+// chunk is the maximum number of bytes read at once, to keep the transfer smooth
+func (l *rateLimiter) chunk() int {
+	return int(min(32*1024, max(l.rate/10, 1)))
+}
+
+// wait blocks until n more bytes may be transferred
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimitedBody throttles the reads of a request or response body
+type rateLimitedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	if len(p) > b.limiter.chunk() {
+		p = p[:b.limiter.chunk()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.limiter.wait(b.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// rateLimitedTransport throttles the uploads and downloads of the base transport
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (rt rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = &rateLimitedBody{ReadCloser: req.Body, ctx: req.Context(), limiter: rt.limiter}
+	}
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &rateLimitedBody{ReadCloser: resp.Body, ctx: req.Context(), limiter: rt.limiter}
+	return resp, nil
+}
@@ -0,0 +1,43 @@
+package registryauth
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedTransport(t *testing.T) {
+	const rate = 100 * 1024
+	data := bytes.Repeat([]byte("x"), rate)
+	var uploaded int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploaded = len(body)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: rateLimitedTransport{http.DefaultTransport, &rateLimiter{rate: rate}}}
+	start := time.Now()
+	resp, err := client.Post(server.URL, "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if uploaded != len(data) || len(downloaded) != len(data) {
+		t.Fatalf("transferred %d/%d bytes, expected %d", uploaded, len(downloaded), len(data))
+	}
+	// 2 seconds worth of traffic, of which the first second is a burst
+	if elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("transfer took %s, expected about 1s", elapsed)
+	}
+}
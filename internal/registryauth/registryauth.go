@@ -9,6 +9,10 @@ import (
 	"os"
 	"strings"
 
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/retry"
+
 	"github.com/thin-edge/tedge-oscar/internal/config"
 )
 
@@ -81,6 +85,10 @@ func GetAuthenticatedClient(cfg *config.Config, repoRef, scope string) (*http.Cl
 		username = cred.Username
 		password = cred.Password
 	}
+	base, err := Transport(cfg, reg)
+	if err != nil {
+		return nil, "", "", "", err
+	}
 	token := ""
 	if reg == "ghcr.io" && username != "" && password != "" {
 		if scope == "" {
@@ -91,7 +99,7 @@ func GetAuthenticatedClient(cfg *config.Config, repoRef, scope string) (*http.Cl
 		req, err := http.NewRequest("GET", tokenURL, nil)
 		if err == nil {
 			req.SetBasicAuth(username, password)
-			resp, err := http.DefaultClient.Do(req)
+			resp, err := (&http.Client{Transport: base}).Do(req)
 			if err == nil && resp.StatusCode == 200 {
 				defer resp.Body.Close()
 				type tokenResp struct {
@@ -105,15 +113,61 @@ func GetAuthenticatedClient(cfg *config.Config, repoRef, scope string) (*http.Cl
 		}
 	}
 	if token != "" {
-		base := http.DefaultTransport
 		return &http.Client{
 			Transport: roundTripperWithBearerToken{base, token},
 		}, username, password, token, nil
 	} else if username != "" && password != "" {
-		base := http.DefaultTransport
 		return &http.Client{
 			Transport: roundTripperWithBasicAuth{base, username, password},
 		}, username, password, "", nil
 	}
 	return nil, "", "", "", nil
 }
+
+// SplitRef splits an image reference into the repository and the tag or digest
+func SplitRef(imageRef string) (string, string, error) {
+	repoRef, ref := imageRef, ""
+	if i := strings.LastIndex(imageRef, "@"); i > strings.LastIndex(imageRef, "/") {
+		repoRef = imageRef[:i]
+		ref = imageRef[i+1:]
+	} else if i := strings.LastIndex(imageRef, ":"); i > strings.LastIndex(imageRef, "/") {
+		repoRef = imageRef[:i]
+		ref = imageRef[i+1:]
+	}
+	if repoRef == imageRef || ref == "" {
+		return "", "", fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
+	}
+	return repoRef, ref, nil
+}
+
+// NewRepository returns the remote repository repoRef, using the credentials of its registry.
+// If push is set, the ghcr.io token allows pushing to the repository.
+func NewRepository(cfg *config.Config, repoRef string, push bool) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(repoRef)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository: %w", err)
+	}
+	scope := ""
+	if push && strings.HasPrefix(repoRef, "ghcr.io/") {
+		scope = "repository:" + strings.TrimPrefix(repoRef, "ghcr.io/") + ":push,pull"
+	}
+	client, _, _, _, err := GetAuthenticatedClient(cfg, repoRef, scope)
+	if err != nil {
+		return nil, fmt.Errorf("auth error: %w", err)
+	}
+	if client != nil {
+		repo.Client = client
+	} else {
+		// Anonymous access, like auth.DefaultClient but over the configured transport
+		base, err := Transport(cfg, repo.Reference.Registry)
+		if err != nil {
+			return nil, err
+		}
+		repo.Client = &auth.Client{
+			Client: &http.Client{Transport: retry.NewTransport(base)},
+			Header: http.Header{"User-Agent": {"oras-go"}},
+			Cache:  auth.NewCache(),
+		}
+	}
+	return repo, nil
+}
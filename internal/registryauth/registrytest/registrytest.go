@@ -0,0 +1,173 @@
+// Package registrytest provides a minimal in-memory OCI registry for tests. It serves the
+// read-only part of the distribution API (tags, manifests and blobs) over TLS, which is
+// enough to stand in for a registry when pulling and checking for updates.
+package registrytest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var trustOnce sync.Once
+
+// Registry is an in-memory registry listening on a random local port
+type Registry struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// tags maps the repositories to their tags and the digests of the tagged manifests
+	tags      map[string]map[string]digest.Digest
+	manifests map[digest.Digest][]byte
+	blobs     map[digest.Digest][]byte
+	// requests records the method and path of every request, in order
+	requests []string
+}
+
+// Start starts a registry. http.DefaultTransport is changed to trust the certificate of the
+// test servers, so the registry can be used through the regular registry clients.
+func Start() *Registry {
+	r := &Registry{
+		tags:      map[string]map[string]digest.Digest{},
+		manifests: map[digest.Digest][]byte{},
+		blobs:     map[digest.Digest][]byte{},
+	}
+	r.server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	trustOnce.Do(func() {
+		// All httptest TLS servers share the same certificate
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: r.server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+		http.DefaultTransport = transport
+	})
+	return r
+}
+
+// Host returns the host and port of the registry, e.g. 127.0.0.1:12345
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "https://")
+}
+
+// Close stops the registry
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Push stores an image with the given files (path and content) as layers in repo and tags
+// it. An existing tag is moved. It returns the digest of the manifest.
+func (r *Registry) Push(repo, tag string, files map[string]string) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	manifest := ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.tedge.flow.v1",
+		Config:       ocispec.DescriptorEmptyJSON,
+		Layers:       []ocispec.Descriptor{},
+	}
+	r.blobs[ocispec.DescriptorEmptyJSON.Digest] = ocispec.DescriptorEmptyJSON.Data
+	for _, path := range paths {
+		data := []byte(files[path])
+		dgst := digest.FromBytes(data)
+		r.blobs[dgst] = data
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+			MediaType:   "application/octet-stream",
+			Digest:      dgst,
+			Size:        int64(len(data)),
+			Annotations: map[string]string{ocispec.AnnotationTitle: path},
+		})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		panic(err)
+	}
+	dgst := digest.FromBytes(data)
+	r.manifests[dgst] = data
+	if r.tags[repo] == nil {
+		r.tags[repo] = map[string]digest.Digest{}
+	}
+	r.tags[repo][tag] = dgst
+	return dgst
+}
+
+// Requests returns the number of requests with the method whose path contains substr
+func (r *Registry) Requests(method, substr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, req := range r.requests {
+		m, path, _ := strings.Cut(req, " ")
+		if m == method && strings.Contains(path, substr) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" || path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	switch {
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		tags := []string{}
+		for tag := range r.tags[repo] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": tags})
+	case strings.Contains(path, "/manifests/"):
+		repo, ref, _ := strings.Cut(path, "/manifests/")
+		dgst, ok := r.tags[repo][ref]
+		if !ok {
+			dgst = digest.Digest(ref)
+		}
+		data, ok := r.manifests[dgst]
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		r.write(w, req, ocispec.MediaTypeImageManifest, dgst, data)
+	case strings.Contains(path, "/blobs/"):
+		_, ref, _ := strings.Cut(path, "/blobs/")
+		data, ok := r.blobs[digest.Digest(ref)]
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		r.write(w, req, "application/octet-stream", digest.Digest(ref), data)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported path %s", req.URL.Path), http.StatusNotFound)
+	}
+}
+
+func (r *Registry) write(w http.ResponseWriter, req *http.Request, mediaType string, dgst digest.Digest, data []byte) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,154 @@
+package registryauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+// Defaults of the transport settings
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultMaxIdleConns   = http.DefaultMaxIdleConnsPerHost
+)
+
+var (
+	transportsMu sync.Mutex
+	// transports are shared by the requests with the same settings, to reuse their connections
+	transports = map[config.HTTPConfig]*http.Transport{}
+)
+
+// Transport returns the transport for the traffic to host (a registry, or the server of a
+// tarball), configured by the [http] section of the config and the overrides of the registry,
+// and throttled to the limit_rate of the config (or --limit-rate)
+func Transport(cfg *config.Config, host string) (http.RoundTripper, error) {
+	settings := cfg.GetHTTPConfig(host)
+	base, err := sharedTransport(settings)
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = base
+	if settings.UserAgent != "" {
+		rt = userAgentTransport{rt, settings.UserAgent}
+	}
+	rate := limitRateOverride
+	if rate < 0 {
+		if rate, err = cfg.GetLimitRate(); err != nil {
+			return nil, err
+		}
+	}
+	if rate > 0 {
+		rt = rateLimitedTransport{rt, sharedLimiter(rate)}
+	}
+	return rt, nil
+}
+
+// NewHTTPClient returns a client for the traffic to host, see Transport
+func NewHTTPClient(cfg *config.Config, host string) (*http.Client, error) {
+	rt, err := Transport(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+func sharedTransport(settings config.HTTPConfig) (*http.Transport, error) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if t, ok := transports[settings]; ok {
+		return t, nil
+	}
+	t, err := newTransport(settings)
+	if err != nil {
+		return nil, err
+	}
+	transports[settings] = t
+	return t, nil
+}
+
+// newTransport returns a transport like http.DefaultTransport with the given settings
+func newTransport(settings config.HTTPConfig) (*http.Transport, error) {
+	connectTimeout := DefaultConnectTimeout
+	if settings.ConnectTimeout != "" {
+		var err error
+		if connectTimeout, err = time.ParseDuration(settings.ConnectTimeout); err != nil {
+			return nil, fmt.Errorf("invalid http.connect_timeout: %w", err)
+		}
+	}
+	var readTimeout time.Duration
+	if settings.ReadTimeout != "" {
+		var err error
+		if readTimeout, err = time.ParseDuration(settings.ReadTimeout); err != nil {
+			return nil, fmt.Errorf("invalid http.read_timeout: %w", err)
+		}
+	}
+	if settings.MaxIdleConns < 0 {
+		return nil, fmt.Errorf("invalid http.max_idle_conns: %d", settings.MaxIdleConns)
+	}
+	maxIdleConns := DefaultMaxIdleConns
+	if settings.MaxIdleConns > 0 {
+		maxIdleConns = settings.MaxIdleConns
+	}
+	proxy := httpproxy.FromEnvironment()
+	if settings.HTTPSProxy != "" {
+		if _, err := url.Parse(settings.HTTPSProxy); err != nil {
+			return nil, fmt.Errorf("invalid http.https_proxy: %w", err)
+		}
+		proxy.HTTPSProxy = settings.HTTPSProxy
+	}
+	if settings.NoProxy != "" {
+		proxy.NoProxy = settings.NoProxy
+	}
+	proxyFunc := proxy.ProxyFunc()
+
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || readTimeout == 0 {
+			return conn, err
+		}
+		return &readTimeoutConn{Conn: conn, timeout: readTimeout}, nil
+	}
+	t.TLSHandshakeTimeout = min(t.TLSHandshakeTimeout, connectTimeout)
+	t.MaxIdleConnsPerHost = maxIdleConns
+	t.MaxIdleConns = max(t.MaxIdleConns, maxIdleConns)
+	return t, nil
+}
+
+// readTimeoutConn fails a read when no data is received within the timeout, so a stalled
+// download is detected (and retried) without limiting the duration of the whole download
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *readTimeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// userAgentTransport replaces the User-Agent header of the requests
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (rt userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", rt.userAgent)
+	return rt.base.RoundTrip(req)
+}
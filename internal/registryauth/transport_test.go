@@ -0,0 +1,77 @@
+package registryauth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+func TestTransportProxy(t *testing.T) {
+	tr, err := newTransport(config.HTTPConfig{HTTPSProxy: "http://proxy.example.com:3128", NoProxy: ".internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{
+		"https://ghcr.io/v2/":                "http://proxy.example.com:3128",
+		"https://registry.internal:5000/v2/": "",
+	} {
+		req, _ := http.NewRequest("GET", target, nil)
+		proxy, err := tr.Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != want {
+			t.Errorf("proxy of %s = %q, expected %q", target, got, want)
+		}
+	}
+}
+
+func TestTransportRegistryOverrides(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.UserAgent()))
+		if r.URL.Path == "/stall" {
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Second)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	cfg := &config.Config{
+		HTTP: config.HTTPConfig{UserAgent: "tedge-oscar"},
+		Registries: []config.RegistryCredential{
+			{Registry: host, HTTP: config.HTTPConfig{ReadTimeout: "200ms"}},
+		},
+	}
+
+	client, err := NewHTTPClient(cfg, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "tedge-oscar" {
+		t.Errorf("got user agent %q, expected the one of the [http] section", body)
+	}
+
+	resp, err = client.Get(server.URL + "/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("expected the stalled download to time out")
+	}
+}
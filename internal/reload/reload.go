@@ -0,0 +1,295 @@
+// Package reload notifies the flows runtime after an instance was changed in the deploy_dir
+// and optionally waits for the runtime to confirm that it picked up the change.
+package reload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+	"github.com/thin-edge/tedge-oscar/internal/tedge"
+)
+
+// Types of hooks
+const (
+	TypeCommand = "command"
+	TypeMQTT    = "mqtt"
+	TypeSystemd = "systemd"
+)
+
+// DefaultTimeout is used if reload.timeout is not set
+const DefaultTimeout = 10 * time.Second
+
+// Actions which change an instance
+const (
+	ActionDeploy  = "deploy"
+	ActionRemove  = "remove"
+	ActionEnable  = "enable"
+	ActionDisable = "disable"
+)
+
+// Change describes what happened to an instance
+type Change struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	// Path is the instance file
+	Path string `json:"path"`
+}
+
+// Loaded reports whether the runtime should have the instance loaded after the change
+func (c Change) Loaded() bool {
+	return c.Action == ActionDeploy || c.Action == ActionEnable
+}
+
+// Configured reports whether a hook or a confirmation is configured
+func Configured(cfg *config.Config) bool {
+	return cfg.Reload.Type != "" || cfg.Reload.ConfirmTopic != ""
+}
+
+// Run runs the configured hook and, if reload.confirm_topic is set, waits for the runtime to
+// confirm the change. It does nothing if no hook is configured.
+func Run(cfg *config.Config, change Change, w io.Writer) error {
+	rc := cfg.Reload
+	if !Configured(cfg) {
+		return nil
+	}
+	timeout := DefaultTimeout
+	if rc.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(rc.Timeout); err != nil {
+			return fmt.Errorf("invalid reload.timeout: %w", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var client *mqtt.Client
+	if rc.Type == TypeMQTT || rc.ConfirmTopic != "" {
+		settings, err := tedge.LoadMQTTSettings(cfg)
+		if err != nil {
+			return err
+		}
+		client, err = settings.Connect(fmt.Sprintf("tedge-oscar-reload-%d", os.Getpid()))
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+
+	// Subscribe before triggering the reload so the confirmation can't be missed. The result
+	// is nil once the change is confirmed, or the error reported by the runtime.
+	var confirmed chan error
+	if rc.ConfirmTopic != "" {
+		confirmed = make(chan error, 1)
+		var once sync.Once
+		err := client.Subscribe(rc.ConfirmTopic, func(msg mqtt.Message) {
+			// A retained message was published before the change, so it can't confirm it
+			if msg.Retained {
+				return
+			}
+			var result error
+			switch current, reason := instanceState(msg.Payload, change); {
+			case current == stateFailed && change.Loaded():
+				result = fmt.Errorf("the flows runtime failed to load instance %s: %s", change.Name, reason)
+			case current == stateLoaded && change.Loaded(), current == stateNotLoaded && !change.Loaded():
+			default:
+				return
+			}
+			once.Do(func() { confirmed <- result })
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	switch rc.Type {
+	case "":
+	case TypeCommand:
+		if err := runCommand(ctx, rc.Command, change, w); err != nil {
+			return err
+		}
+	case TypeMQTT:
+		if rc.Topic == "" {
+			return fmt.Errorf("reload.topic is required for the mqtt reload hook")
+		}
+		payload, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if err := client.Publish(rc.Topic, payload, false); err != nil {
+			return err
+		}
+	case TypeSystemd:
+		if err := reloadUnit(ctx, rc.Unit); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown reload.type %q, expected one of: %s, %s, %s", rc.Type, TypeCommand, TypeMQTT, TypeSystemd)
+	}
+
+	if confirmed != nil {
+		select {
+		case err := <-confirmed:
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "The flows runtime confirmed the %s of instance %s\n", change.Action, change.Name)
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s waiting for the flows runtime to confirm the %s of instance %s on %s", timeout, change.Action, change.Name, rc.ConfirmTopic)
+		}
+	}
+	return nil
+}
+
+// runCommand runs the shell command with the details of the change in the environment
+func runCommand(ctx context.Context, command string, change Change, w io.Writer) error {
+	if command == "" {
+		return fmt.Errorf("reload.command is required for the command reload hook")
+	}
+	c := exec.CommandContext(ctx, "sh", "-c", command)
+	c.Env = append(os.Environ(),
+		"TEDGE_OSCAR_ACTION="+change.Action,
+		"TEDGE_OSCAR_INSTANCE="+change.Name,
+		"TEDGE_OSCAR_INSTANCE_PATH="+change.Path,
+	)
+	c.Stdout = w
+	c.Stderr = w
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("reload command timed out: %w", ctx.Err())
+		}
+		return fmt.Errorf("reload command failed: %w", err)
+	}
+	return nil
+}
+
+// reloadUnit reloads (or restarts) the systemd unit and waits for it to be active again
+func reloadUnit(ctx context.Context, unit string) error {
+	if unit == "" {
+		return fmt.Errorf("reload.unit is required for the systemd reload hook")
+	}
+	if out, err := exec.CommandContext(ctx, "systemctl", "reload-or-restart", unit).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to reload %s: %w: %s", unit, err, strings.TrimSpace(string(out)))
+	}
+	for {
+		if err := exec.CommandContext(ctx, "systemctl", "is-active", "--quiet", unit).Run(); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s is not active after the reload", unit)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// state is what a status message of the runtime tells about an instance
+type state int
+
+const (
+	// stateUnknown is reported by messages which are about other instances
+	stateUnknown state = iota
+	stateLoaded
+	stateNotLoaded
+	stateFailed
+)
+
+// Statuses of an instance which mean that it failed to load, or that it is not loaded
+var (
+	failedStatuses    = map[string]bool{"error": true, "failed": true, "failure": true}
+	notLoadedStatuses = map[string]bool{"removed": true, "unloaded": true, "stopped": true, "disabled": true}
+)
+
+// instanceState parses a JSON status message of the runtime for the state of the instance,
+// which is identified by its name or the path (or file name) of its file. The message is
+// either:
+//   - a list of the loaded instances: ["a.toml", ...] or {"flows": ["a.toml", ...]}
+//   - a map of the instances to their status: {"flows": {"a.toml": "loaded", ...}}
+//   - the status of one instance: {"flow": "a.toml", "status": "error", "error": "..."}
+//
+// A status is a string or an object with a "status" and an "error" field. Instances missing
+// from a list or a map are not loaded. For failures, the error of the runtime is returned.
+func instanceState(payload []byte, change Change) (state, string) {
+	candidates := map[string]bool{change.Name: true}
+	if change.Path != "" {
+		candidates[change.Path] = true
+		candidates[filepath.Base(change.Path)] = true
+	}
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return stateUnknown, ""
+	}
+	if m, ok := v.(map[string]any); ok {
+		if flows, ok := m["flows"]; ok {
+			v = flows
+		} else {
+			for _, key := range []string{"flow", "instance", "name"} {
+				if name, ok := m[key].(string); ok {
+					if !candidates[name] {
+						return stateUnknown, ""
+					}
+					return statusState(m)
+				}
+			}
+			return stateUnknown, ""
+		}
+	}
+	switch v := v.(type) {
+	case []any:
+		for _, item := range v {
+			switch item := item.(type) {
+			case string:
+				if candidates[item] {
+					return stateLoaded, ""
+				}
+			case map[string]any:
+				for _, key := range []string{"flow", "instance", "name"} {
+					if name, ok := item[key].(string); ok && candidates[name] {
+						return statusState(item)
+					}
+				}
+			}
+		}
+		return stateNotLoaded, ""
+	case map[string]any:
+		for name, status := range v {
+			if candidates[name] {
+				return statusState(status)
+			}
+		}
+		return stateNotLoaded, ""
+	}
+	return stateUnknown, ""
+}
+
+// statusState returns the state of a status string or of an object with a status and an error
+func statusState(v any) (state, string) {
+	var status, reason string
+	switch v := v.(type) {
+	case string:
+		status = v
+	case map[string]any:
+		status, _ = v["status"].(string)
+		reason, _ = v["error"].(string)
+	}
+	status = strings.ToLower(status)
+	switch {
+	case reason != "" || failedStatuses[status]:
+		if reason == "" {
+			reason = status
+		}
+		return stateFailed, reason
+	case notLoadedStatuses[status]:
+		return stateNotLoaded, ""
+	}
+	return stateLoaded, ""
+}
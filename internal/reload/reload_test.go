@@ -0,0 +1,129 @@
+package reload
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt/mqtttest"
+)
+
+func TestCommandHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	cfg := &config.Config{Reload: config.ReloadConfig{
+		Type:    TypeCommand,
+		Command: `echo "$TEDGE_OSCAR_ACTION $TEDGE_OSCAR_INSTANCE" > ` + out,
+	}}
+	if err := Run(cfg, Change{Action: ActionDeploy, Name: "counter1"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "deploy counter1\n" {
+		t.Errorf("unexpected command output: %q", data)
+	}
+
+	cfg.Reload.Command = "exit 1"
+	if err := Run(cfg, Change{Action: ActionDeploy, Name: "counter1"}, io.Discard); err == nil {
+		t.Error("expected a failing command to return an error")
+	}
+}
+
+func TestMQTTHookWithConfirmation(t *testing.T) {
+	t.Setenv("TEDGE_CONFIG_DIR", t.TempDir())
+	broker, err := mqtttest.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	host, port := broker.Addr()
+	cfg := &config.Config{
+		MQTT: config.MQTTConfig{Host: host, Port: port},
+		Reload: config.ReloadConfig{
+			Type:         TypeMQTT,
+			Topic:        "te/device/main/service/tedge-flows/cmd/reload",
+			ConfirmTopic: "te/device/main/service/tedge-flows/status/flows",
+			Timeout:      "2s",
+		},
+	}
+
+	// Stand-in for the runtime, which reports the loaded flows after each reload
+	runtime, err := mqtt.Connect(mqtt.Options{Broker: broker.URL(), ClientID: "runtime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Close()
+	var status atomic.Value
+	status.Store(`{"flows":["counter1.toml"]}`)
+	err = runtime.Subscribe(cfg.Reload.Topic, func(msg mqtt.Message) {
+		go func() {
+			_ = runtime.Publish(cfg.Reload.ConfirmTopic, []byte(status.Load().(string)), false)
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change := Change{Action: ActionDeploy, Name: "counter1", Path: "/etc/tedge/flows/counter1.toml"}
+	if err := Run(cfg, change, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := broker.WaitFor(cfg.Reload.Topic, 0); !ok {
+		t.Error("expected a reload message")
+	}
+
+	// The runtime still reports the instance as loaded, so the removal is never confirmed
+	cfg.Reload.Timeout = "200ms"
+	change.Action = ActionRemove
+	if err := Run(cfg, change, io.Discard); err == nil {
+		t.Error("expected the removal to time out without a confirmation")
+	}
+	// The status of another instance doesn't confirm the removal
+	status.Store(`{"flow":"other.toml","status":"loaded"}`)
+	if err := Run(cfg, change, io.Discard); err == nil {
+		t.Error("expected the removal to time out without a confirmation")
+	}
+
+	// The runtime reports that it failed to load the instance
+	status.Store(`{"flow":"counter1.toml","status":"error","error":"SyntaxError: Unexpected token"}`)
+	change.Action = ActionDeploy
+	if err := Run(cfg, change, io.Discard); err == nil || !strings.Contains(err.Error(), "SyntaxError") {
+		t.Errorf("expected the failure of the runtime to be reported, got %v", err)
+	}
+}
+
+func TestInstanceState(t *testing.T) {
+	change := Change{Action: ActionDeploy, Name: "counter1", Path: "/etc/tedge/flows/counter1.toml"}
+	tests := []struct {
+		payload string
+		want    state
+	}{
+		{`["counter1.toml", "other.toml"]`, stateLoaded},
+		{`{"flows":["/etc/tedge/flows/counter1.toml"]}`, stateLoaded},
+		{`{"flows":["other.toml"]}`, stateNotLoaded},
+		{`{"flows":[]}`, stateNotLoaded},
+		{`{"flows":{"counter1":"running"}}`, stateLoaded},
+		{`{"flows":{"counter1.toml":{"status":"error","error":"no such file"}}}`, stateFailed},
+		{`{"flows":{"other.toml":"loaded"}}`, stateNotLoaded},
+		{`{"flows":[{"name":"counter1","status":"failed"}]}`, stateFailed},
+		{`{"flow":"counter1.toml","status":"loaded"}`, stateLoaded},
+		{`{"flow":"counter1.toml","status":"removed"}`, stateNotLoaded},
+		{`{"flow":"counter1.toml","error":"SyntaxError"}`, stateFailed},
+		// Messages about other instances, or in another format, tell nothing
+		{`{"flow":"other.toml","status":"error"}`, stateUnknown},
+		{`{"status":"up"}`, stateUnknown},
+		{`counter1.toml loaded`, stateUnknown},
+	}
+	for _, tt := range tests {
+		if got, _ := instanceState([]byte(tt.payload), change); got != tt.want {
+			t.Errorf("instanceState(%s) = %d, want %d", tt.payload, got, tt.want)
+		}
+	}
+}
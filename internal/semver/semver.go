@@ -0,0 +1,252 @@
+// Package semver parses semantic versions and version constraints, e.g. ">=1.5, <2" or
+// "^1.2 || ~0.9". Versions may omit the minor and patch numbers ("1.5") and have a "v" prefix.
+package semver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version
+type Version struct {
+	Major, Minor, Patch int
+	// Pre is the pre-release, e.g. rc.1 for 1.0.0-rc.1
+	Pre string
+	// Original is the string the version was parsed from
+	Original string
+}
+
+var versionRegexp = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// Parse parses a version. Missing minor and patch numbers are 0 and build metadata is ignored.
+func Parse(s string) (Version, error) {
+	m := versionRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	v := Version{Pre: m[4], Original: s}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or greater than o, following the
+// semantic versioning precedence rules
+func (v Version) Compare(o Version) int {
+	for _, d := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if d[0] != d[1] {
+			return cmpInt(d[0], d[1])
+		}
+	}
+	return comparePre(v.Pre, o.Pre)
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// comparePre compares pre-releases: a version without pre-release is greater, numeric
+// identifiers are compared numerically and lower than alphanumeric ones
+func comparePre(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return cmpInt(an, bn)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmpInt(len(as), len(bs))
+}
+
+// Constraint is a set of alternative version ranges
+type Constraint struct {
+	original     string
+	alternatives [][]comparator
+}
+
+// comparator is one condition of a range, e.g. >=1.5.0
+type comparator struct {
+	check func(Version) bool
+	// pre is set if the comparator has a pre-release version, which allows pre-releases to match
+	pre bool
+}
+
+var termRegexp = regexp.MustCompile(`(!=|==|>=|<=|=|>|<|~|\^)?\s*(v?[0-9xX*][0-9A-Za-z.*+-]*)`)
+
+// ParseConstraint parses a constraint: alternatives separated by "||", each a list of
+// conditions separated by commas or spaces which must all match. The operators are =, !=,
+// >, >=, <, <=, ~ (same minor version) and ^ (same major version). Partial versions and the
+// x and * wildcards match all versions they cover, e.g. "1.5" or "1.5.x" is >=1.5.0, <1.6.0.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{original: s}
+	invalid := fmt.Errorf("invalid version constraint %q", s)
+	for _, alt := range strings.Split(s, "||") {
+		var comparators []comparator
+		pos := 0
+		for _, m := range termRegexp.FindAllStringSubmatchIndex(alt, -1) {
+			if strings.Trim(alt[pos:m[0]], " ,") != "" {
+				return Constraint{}, invalid
+			}
+			op := ""
+			if m[2] >= 0 {
+				op = alt[m[2]:m[3]]
+			}
+			comp, err := newComparator(op, alt[m[4]:m[5]])
+			if err != nil {
+				return Constraint{}, fmt.Errorf("invalid version constraint %q: %w", s, err)
+			}
+			comparators = append(comparators, comp)
+			pos = m[1]
+		}
+		if strings.Trim(alt[pos:], " ,") != "" || len(comparators) == 0 {
+			return Constraint{}, invalid
+		}
+		c.alternatives = append(c.alternatives, comparators)
+	}
+	return c, nil
+}
+
+func (c Constraint) String() string {
+	return c.original
+}
+
+// Check reports whether v matches one of the alternatives. Pre-releases only match an
+// alternative which has a condition with a pre-release.
+func (c Constraint) Check(v Version) bool {
+	for _, comparators := range c.alternatives {
+		match := true
+		allowPre := v.Pre == ""
+		for _, comp := range comparators {
+			match = match && comp.check(v)
+			allowPre = allowPre || comp.pre
+		}
+		if match && allowPre {
+			return true
+		}
+	}
+	return false
+}
+
+// newComparator returns the condition of an operator and a version, which may be partial
+func newComparator(op string, value string) (comparator, error) {
+	value = strings.TrimPrefix(value, "v")
+	value, _, _ = strings.Cut(value, "+")
+	value, pre, _ := strings.Cut(value, "-")
+	var parts [3]int
+	n := 0
+	for _, p := range strings.Split(value, ".") {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		if n == 3 {
+			return comparator{}, fmt.Errorf("invalid version %q", value)
+		}
+		num, err := strconv.Atoi(p)
+		if err != nil {
+			return comparator{}, fmt.Errorf("invalid version %q", value)
+		}
+		parts[n] = num
+		n++
+	}
+	if pre != "" && n < 3 {
+		return comparator{}, fmt.Errorf("invalid version %q", value)
+	}
+	low := Version{Major: parts[0], Minor: parts[1], Patch: parts[2], Pre: pre}
+	// high is the first version which is not covered by a partial version
+	high := Version{Major: parts[0] + 1}
+	switch n {
+	case 0:
+		return comparator{check: func(Version) bool { return true }}, nil
+	case 2:
+		high = Version{Major: parts[0], Minor: parts[1] + 1}
+	case 3:
+		high = Version{Major: parts[0], Minor: parts[1], Patch: parts[2] + 1}
+	}
+	ge := func(v Version) bool { return v.Compare(low) >= 0 }
+	lt := func(v Version) bool { return v.Compare(high) < 0 }
+	comp := comparator{pre: pre != ""}
+	switch op {
+	case "", "=", "==":
+		if n == 3 {
+			comp.check = func(v Version) bool { return v.Compare(low) == 0 }
+		} else {
+			comp.check = func(v Version) bool { return ge(v) && lt(v) }
+		}
+	case "!=":
+		if n == 3 {
+			comp.check = func(v Version) bool { return v.Compare(low) != 0 }
+		} else {
+			comp.check = func(v Version) bool { return !ge(v) || !lt(v) }
+		}
+	case ">":
+		if n == 3 {
+			comp.check = func(v Version) bool { return v.Compare(low) > 0 }
+		} else {
+			comp.check = func(v Version) bool { return !lt(v) }
+		}
+	case ">=":
+		comp.check = ge
+	case "<":
+		comp.check = func(v Version) bool { return v.Compare(low) < 0 }
+	case "<=":
+		if n == 3 {
+			comp.check = func(v Version) bool { return v.Compare(low) <= 0 }
+		} else {
+			comp.check = lt
+		}
+	case "~":
+		if n >= 2 {
+			high = Version{Major: parts[0], Minor: parts[1] + 1}
+		}
+		comp.check = func(v Version) bool { return ge(v) && lt(v) }
+	case "^":
+		switch {
+		case parts[0] > 0 || n == 1:
+			high = Version{Major: parts[0] + 1}
+		case parts[1] > 0 || n == 2:
+			high = Version{Minor: parts[1] + 1}
+		default:
+			high = Version{Patch: parts[2] + 1}
+		}
+		comp.check = func(v Version) bool { return ge(v) && lt(v) }
+	}
+	return comp, nil
+}
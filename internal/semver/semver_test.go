@@ -0,0 +1,66 @@
+package semver
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	ordered := []string{"0.9", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "v1.0.0", "1.2", "1.10.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, err := Parse(ordered[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parse(ordered[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Compare(b) != -1 || b.Compare(a) != 1 {
+			t.Errorf("expected %s < %s", a, b)
+		}
+	}
+	if _, err := Parse("latest"); err == nil {
+		t.Error("expected an error for an invalid version")
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		others     []string
+	}{
+		{">=1.5", []string{"1.5.0", "1.6", "2.0.0"}, []string{"1.4.9", "1.6.0-rc.1"}},
+		{">= 1.5, <2", []string{"1.5.0", "1.99.0"}, []string{"2.0.0", "1.4.0"}},
+		{"1.5", []string{"1.5.0", "1.5.9"}, []string{"1.6.0", "1.4.0"}},
+		{"1.x", []string{"1.0.0", "1.9.9"}, []string{"2.0.0"}},
+		{"~1.5.2", []string{"1.5.2", "1.5.9"}, []string{"1.6.0", "1.5.1"}},
+		{"^1.2", []string{"1.2.0", "1.9.0"}, []string{"2.0.0", "1.1.0"}},
+		{"^0.3.1", []string{"0.3.1", "0.3.9"}, []string{"0.4.0"}},
+		{">1.5", []string{"1.6.0"}, []string{"1.5.9"}},
+		{"<=1.5", []string{"1.5.9", "1.0.0"}, []string{"1.6.0"}},
+		{"!=1.5.1", []string{"1.5.0", "1.5.2"}, []string{"1.5.1"}},
+		{"<1.0 || >=2.0", []string{"0.9.0", "2.1.0"}, []string{"1.0.0"}},
+		{">=1.0.0-rc.1", []string{"1.0.0-rc.2", "1.0.0"}, []string{"1.0.0-alpha"}},
+		{"*", []string{"0.1.0", "3.0.0"}, []string{"3.0.0-rc.1"}},
+	}
+	for _, tt := range tests {
+		c, err := ParseConstraint(tt.constraint)
+		if err != nil {
+			t.Fatalf("ParseConstraint(%q): %v", tt.constraint, err)
+		}
+		for _, s := range tt.matches {
+			if v, _ := Parse(s); !c.Check(v) {
+				t.Errorf("expected %s to match %q", s, tt.constraint)
+			}
+		}
+		for _, s := range tt.others {
+			if v, _ := Parse(s); c.Check(v) {
+				t.Errorf("expected %s to not match %q", s, tt.constraint)
+			}
+		}
+	}
+	for _, invalid := range []string{"", ">=", "latest", ">=1.5 foo", "1.2.3.4", "1.2-rc.1"} {
+		if _, err := ParseConstraint(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
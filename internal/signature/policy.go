@@ -0,0 +1,174 @@
+package signature
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+)
+
+// RecordFile is the file in an image folder which records the verified signatures
+const RecordFile = "signature.json"
+
+// Policy returns the trust policy of the repository, i.e. the policy with the longest scope
+// which is equal to the repository or one of its parent namespaces. The "*" scope matches
+// all repositories. It returns nil if no policy covers the repository.
+func Policy(cfg *config.Config, repoRef string) *config.TrustPolicy {
+	var match *config.TrustPolicy
+	best := -1
+	for i, p := range cfg.Trust.Policies {
+		scope := strings.TrimSuffix(p.Scope, "/")
+		specificity := len(scope)
+		if scope == "*" {
+			specificity = 0
+		} else if scope != repoRef && !strings.HasPrefix(repoRef, scope+"/") {
+			continue
+		}
+		if specificity > best {
+			match, best = &cfg.Trust.Policies[i], specificity
+		}
+	}
+	return match
+}
+
+// TrustedKeys returns the keys of which one must have signed the images of the repository.
+// It returns no keys if the images don't need to be signed, and an error if the trust
+// policy is enforced but doesn't cover the repository.
+func TrustedKeys(cfg *config.Config, repoRef string) ([]crypto.PublicKey, error) {
+	policy := Policy(cfg, repoRef)
+	if policy == nil {
+		if cfg.Trust.Enforce {
+			return nil, fmt.Errorf("image %s is not covered by a trust policy", repoRef)
+		}
+		return nil, nil
+	}
+	return LoadPublicKeys(policy.Keys)
+}
+
+// Record is the proof that an image was verified when it was pulled. It is stored in the
+// image folder, so the image can be verified again (offline) before it is deployed.
+type Record struct {
+	Digest digest.Digest `json:"digest"`
+	// Manifest is the manifest of the image as stored in the registry
+	Manifest   []byte      `json:"manifest"`
+	Signatures []Signature `json:"signatures"`
+	// Variant is the manifest which was pulled if the signed manifest is an image index
+	Variant []byte `json:"variant,omitempty"`
+}
+
+// Save writes the record to the image folder dir
+func (r *Record) Save(dir string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, RecordFile), data, 0644)
+}
+
+// VerifyRemote checks the signatures of the manifest desc in the repository against the
+// trust policy. It returns the record to save in the image folder, or nil if the image
+// doesn't need to be signed.
+func VerifyRemote(ctx context.Context, cfg *config.Config, store content.ReadOnlyGraphStorage, repoRef string, desc ocispec.Descriptor) (*Record, error) {
+	keys, err := TrustedKeys(cfg, repoRef)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	sigs, err := Fetch(ctx, store, desc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Verify(sigs, keys, desc.Digest); err != nil {
+		return nil, fmt.Errorf("signature verification of %s failed: %w", repoRef, err)
+	}
+	manifest, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	return &Record{Digest: desc.Digest, Manifest: manifest, Signatures: sigs}, nil
+}
+
+// VerifyImage checks the locally stored image imageRef in dir against the trust policy: the
+// recorded signatures must be valid for the recorded manifest, and the files of the image
+// must match the layers of the manifest. Files of archive layers are only verified on pull.
+func VerifyImage(cfg *config.Config, imageRef string, dir string) error {
+	repoRef, _, err := registryauth.SplitRef(imageRef)
+	if err != nil {
+		repoRef = imageRef
+	}
+	keys, err := TrustedKeys(cfg, repoRef)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, RecordFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("image %s has no verified signature, pull it from the registry to verify it", imageRef)
+		}
+		return err
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("invalid signature record of %s: %w", imageRef, err)
+	}
+	if digest.FromBytes(record.Manifest) != record.Digest {
+		return fmt.Errorf("signature record of %s does not match its manifest", imageRef)
+	}
+	if _, err := Verify(record.Signatures, keys, record.Digest); err != nil {
+		return fmt.Errorf("signature verification of %s failed: %w", imageRef, err)
+	}
+	data = record.Manifest
+	if len(record.Variant) > 0 {
+		var index ocispec.Index
+		if err := json.Unmarshal(record.Manifest, &index); err != nil {
+			return fmt.Errorf("invalid image index of %s: %w", imageRef, err)
+		}
+		d := digest.FromBytes(record.Variant)
+		if !slices.ContainsFunc(index.Manifests, func(m ocispec.Descriptor) bool { return m.Digest == d }) {
+			return fmt.Errorf("variant %s of %s is not part of the signed image index", d, imageRef)
+		}
+		data = record.Variant
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("invalid manifest of %s: %w", imageRef, err)
+	}
+	for _, layer := range manifest.Layers {
+		name := layer.Annotations[ocispec.AnnotationTitle]
+		if name == "" {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := verifyFile(path, layer.Digest); err != nil {
+			return fmt.Errorf("file %s of image %s was modified after it was verified: %w", name, imageRef, err)
+		}
+	}
+	return nil
+}
+
+// verifyFile checks that the content of the file matches the digest
+func verifyFile(path string, expected digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	actual, err := expected.Algorithm().FromReader(f)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("digest %s does not match %s", actual, expected)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package signature signs flow images and verifies their signatures. Signatures are stored as
+// OCI referrers of the signed manifest, in the format of cosign (simple signing payload with
+// the signature in the dev.cosignproject.cosign/signature annotation), so they can also be
+// verified with "cosign verify --key".
+package signature
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+)
+
+const (
+	// ArtifactType is the artifact type of signature manifests
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// PayloadMediaType is the media type of the signed payload
+	PayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// AnnotationSignature is the layer annotation holding the base64 encoded signature
+	AnnotationSignature = "dev.cosignproject.cosign/signature"
+	// payloadType is the type of the simple signing payload
+	payloadType = "cosign container image signature"
+)
+
+// Signature is a signed payload
+type Signature struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// Payload is the simple signing payload, which binds a signature to a manifest digest
+type Payload struct {
+	Critical PayloadCritical   `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+type PayloadCritical struct {
+	Identity PayloadIdentity `json:"identity"`
+	Image    PayloadImage    `json:"image"`
+	Type     string          `json:"type"`
+}
+
+type PayloadIdentity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+type PayloadImage struct {
+	DockerManifestDigest string `json:"docker-manifest-digest"`
+}
+
+// NewPayload returns the payload signing the manifest with the digest in repository repoRef
+func NewPayload(repoRef string, d digest.Digest) ([]byte, error) {
+	return json.Marshal(Payload{
+		Critical: PayloadCritical{
+			Identity: PayloadIdentity{DockerReference: repoRef},
+			Image:    PayloadImage{DockerManifestDigest: d.String()},
+			Type:     payloadType,
+		},
+	})
+}
+
+// LoadPrivateKey reads an unencrypted PEM private key (PKCS#8, EC or RSA)
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key %s in %s, expected an unencrypted PEM private key", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T in %s", key, path)
+	}
+	return signer, nil
+}
+
+// LoadPublicKey reads a PEM public key or certificate
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+		}
+		return key, nil
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %s: %w", path, err)
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported public key %s in %s, expected a PEM public key or certificate", block.Type, path)
+}
+
+// LoadPublicKeys reads all keys of paths
+func LoadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := LoadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+// Sign signs the payload. ECDSA and RSA keys sign the SHA-256 digest of the payload,
+// Ed25519 keys the payload itself.
+func Sign(key crypto.Signer, payload []byte) (Signature, error) {
+	var sig []byte
+	var err error
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return Signature{}, fmt.Errorf("failed to sign: %w", err)
+	}
+	return Signature{Payload: payload, Signature: sig}, nil
+}
+
+// VerifyKey checks that the signature was created by the private key of key
+func (s Signature) VerifyKey(key crypto.PublicKey) error {
+	hash := sha256.Sum256(s.Payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(k, hash[:], s.Signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], s.Signature) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(k, s.Payload, s.Signature) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	return errors.New("invalid signature")
+}
+
+// Digest returns the manifest digest signed by the payload
+func (s Signature) Digest() (digest.Digest, error) {
+	var payload Payload
+	if err := json.Unmarshal(s.Payload, &payload); err != nil {
+		return "", fmt.Errorf("invalid signature payload: %w", err)
+	}
+	if payload.Critical.Type != payloadType {
+		return "", fmt.Errorf("unsupported signature payload type %q", payload.Critical.Type)
+	}
+	return digest.Parse(payload.Critical.Image.DockerManifestDigest)
+}
+
+// Verify returns the first signature of the manifest d which was created by one of the keys
+func Verify(sigs []Signature, keys []crypto.PublicKey, d digest.Digest) (*Signature, error) {
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("image %s is not signed", d)
+	}
+	for i, sig := range sigs {
+		if signed, err := sig.Digest(); err != nil || signed != d {
+			continue
+		}
+		for _, key := range keys {
+			if sig.VerifyKey(key) == nil {
+				return &sigs[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("image %s has no valid signature of a trusted key", d)
+}
+
+// Push stores the signature as a referrer of the subject manifest
+func Push(ctx context.Context, target oras.Target, subject ocispec.Descriptor, sig Signature) (ocispec.Descriptor, error) {
+	layer := ocispec.Descriptor{
+		MediaType:   PayloadMediaType,
+		Digest:      digest.FromBytes(sig.Payload),
+		Size:        int64(len(sig.Payload)),
+		Annotations: map[string]string{AnnotationSignature: base64.StdEncoding.EncodeToString(sig.Signature)},
+	}
+	if err := target.Push(ctx, layer, bytes.NewReader(sig.Payload)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to push signature payload: %w", err)
+	}
+	desc, err := oras.PackManifest(ctx, target, oras.PackManifestVersion1_1, ArtifactType, oras.PackManifestOptions{
+		Subject:             &subject,
+		Layers:              []ocispec.Descriptor{layer},
+		ManifestAnnotations: map[string]string{ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339)},
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to push signature: %w", err)
+	}
+	return desc, nil
+}
+
+// Fetch returns the signatures stored as referrers of the subject manifest
+func Fetch(ctx context.Context, store content.ReadOnlyGraphStorage, subject ocispec.Descriptor) ([]Signature, error) {
+	referrers, err := registry.Referrers(ctx, store, subject, ArtifactType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list signatures: %w", err)
+	}
+	var sigs []Signature
+	for _, referrer := range referrers {
+		data, err := content.FetchAll(ctx, store, referrer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch signature %s: %w", referrer.Digest, err)
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			continue
+		}
+		for _, layer := range manifest.Layers {
+			encoded, ok := layer.Annotations[AnnotationSignature]
+			if layer.MediaType != PayloadMediaType || !ok {
+				continue
+			}
+			sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+			if err != nil {
+				continue
+			}
+			payload, err := content.FetchAll(ctx, store, layer)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch signature payload %s: %w", layer.Digest, err)
+			}
+			sigs = append(sigs, Signature{Payload: payload, Signature: sig})
+		}
+	}
+	return sigs, nil
+}
@@ -0,0 +1,196 @@
+package signature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+// writeKeys writes the private and public key as PEM files and returns their paths
+func writeKeys(t *testing.T, dir string, name string, key crypto.Signer) (string, string) {
+	t.Helper()
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath := filepath.Join(dir, name+".key")
+	publicPath := filepath.Join(dir, name+".pub")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privatePath, publicPath
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, otherPub := writeKeys(t, dir, "other", otherKey)
+
+	ctx := context.Background()
+	store := memory.New()
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`)
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+	if err := store.Push(ctx, subject, strings.NewReader(string(manifest))); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecKey, "rsa": rsaKey, "ed25519": edKey} {
+		t.Run(name, func(t *testing.T) {
+			privatePath, publicPath := writeKeys(t, dir, name, key)
+			signer, err := LoadPrivateKey(privatePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := NewPayload("example.com/flow", subject.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := Sign(signer, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Push(ctx, store, subject, sig); err != nil {
+				t.Fatal(err)
+			}
+			sigs, err := Fetch(ctx, store, subject)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := LoadPublicKeys([]string{publicPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(sigs, keys, subject.Digest); err != nil {
+				t.Errorf("expected a valid signature: %v", err)
+			}
+			if _, err := Verify(sigs, keys, digest.FromString("other")); err == nil {
+				t.Error("expected the signature to be bound to the manifest digest")
+			}
+			others, err := LoadPublicKeys([]string{otherPub})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(sigs, others, subject.Digest); err == nil {
+				t.Error("expected the signature to be rejected for an untrusted key")
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	cfg := &config.Config{Trust: config.TrustConfig{Policies: []config.TrustPolicy{
+		{Scope: "*"},
+		{Scope: "ghcr.io/thin-edge"},
+		{Scope: "ghcr.io/thin-edge/flows/"},
+	}}}
+	tests := map[string]string{
+		"ghcr.io/thin-edge/counter":        "ghcr.io/thin-edge",
+		"ghcr.io/thin-edge/flows/counter":  "ghcr.io/thin-edge/flows/",
+		"ghcr.io/thin-edge-other/counter":  "*",
+		"registry.example.com/flows/count": "*",
+	}
+	for repo, want := range tests {
+		if got := Policy(cfg, repo); got == nil || got.Scope != want {
+			t.Errorf("Policy(%s) = %v, want scope %s", repo, got, want)
+		}
+	}
+	cfg.Trust.Policies = cfg.Trust.Policies[1:]
+	cfg.Trust.Enforce = true
+	if _, err := TrustedKeys(cfg, "registry.example.com/flows/count"); err == nil {
+		t.Error("expected an error for a repository without policy")
+	}
+	if keys, err := TrustedKeys(cfg, "ghcr.io/thin-edge/counter"); err != nil || len(keys) != 0 {
+		t.Errorf("expected a policy without keys to not require signatures, got %v %v", keys, err)
+	}
+}
+
+func TestVerifyImage(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	privatePath, publicPath := writeKeys(t, dir, "flows", key)
+	cfg := &config.Config{Trust: config.TrustConfig{Policies: []config.TrustPolicy{{Scope: "example.com", Keys: []string{publicPath}}}}}
+
+	imageDir := filepath.Join(dir, "flow:1.0")
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyImage(cfg, "example.com/flow:1.0", imageDir); err == nil {
+		t.Error("expected an image without signature record to be rejected")
+	}
+
+	// Pack an image with one file and record its signature
+	ctx := context.Background()
+	store := memory.New()
+	flow := []byte("[[steps]]\n")
+	layer := ocispec.Descriptor{
+		MediaType:   "application/toml",
+		Digest:      digest.FromBytes(flow),
+		Size:        int64(len(flow)),
+		Annotations: map[string]string{ocispec.AnnotationTitle: "flow.toml"},
+	}
+	if err := store.Push(ctx, layer, strings.NewReader(string(flow))); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "application/vnd.tedge.flow.v1", oras.PackManifestOptions{Layers: []ocispec.Descriptor{layer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := LoadPrivateKey(privatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := NewPayload("example.com/flow", desc.Digest)
+	sig, err := Sign(signer, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(ctx, store, desc, sig); err != nil {
+		t.Fatal(err)
+	}
+	record, err := VerifyRemote(ctx, cfg, store, "example.com/flow", desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := record.Save(imageDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "flow.toml"), flow, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyImage(cfg, "example.com/flow:1.0", imageDir); err != nil {
+		t.Errorf("expected the image to be verified: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "flow.toml"), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyImage(cfg, "example.com/flow:1.0", imageDir); err == nil || !strings.Contains(err.Error(), "modified") {
+		t.Errorf("expected a modified file to be rejected, got %v", err)
+	}
+}
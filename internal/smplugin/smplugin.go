@@ -0,0 +1,223 @@
+// Package smplugin implements the thin-edge.io software management plugin contract
+// for flow images and flow instances.
+//
+// See https://thin-edge.github.io/thin-edge.io/extend/software-management/
+package smplugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/images"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+)
+
+// Exit codes defined by the software management plugin contract
+const (
+	ExitOK      = 0
+	ExitUsage   = 1
+	ExitFailure = 2
+	ExitRetry   = 3
+)
+
+// Module is a software module passed to install or remove
+type Module struct {
+	Name    string
+	Version string
+	File    string
+}
+
+// Plugin is a software management plugin. Install and Remove expect the caller to
+// hold the relevant locks.
+type Plugin interface {
+	// Dirs returns the directories modified by the plugin, in locking order
+	Dirs() []string
+	// List writes the installed modules to w, one "name\tversion" line per module
+	List(w io.Writer) error
+	Install(m Module) error
+	Remove(m Module) error
+}
+
+// New returns the plugin for the given module type: images or instances
+func New(kind string, cfg *config.Config, log io.Writer) (Plugin, error) {
+	switch kind {
+	case "images":
+		return &imagesPlugin{cfg: cfg, log: log}, nil
+	case "instances":
+		return &instancesPlugin{cfg: cfg, log: log}, nil
+	}
+	return nil, fmt.Errorf("unknown plugin type: %s", kind)
+}
+
+// ExitCode maps an error to the exit code of the plugin contract. Errors which are likely
+// to be temporary (e.g. another process holding the lock) are reported as retryable.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	if errors.Is(err, filelock.ErrTimeout) {
+		return ExitRetry
+	}
+	return ExitFailure
+}
+
+// tag returns the tag of a module version, which may be given as a full image reference
+func tag(version string) string {
+	if i := strings.LastIndex(version, ":"); i > strings.LastIndex(version, "/") {
+		return version[i+1:]
+	}
+	return version
+}
+
+func writeModule(w io.Writer, name string, version string) {
+	if version == "" || version == images.Unknown {
+		fmt.Fprintln(w, name)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%s\n", name, version)
+}
+
+// imagesPlugin manages flow images (tedge-flow-image), where the module name is the
+// image repository and the version is the tag
+type imagesPlugin struct {
+	cfg *config.Config
+	log io.Writer
+}
+
+func (p *imagesPlugin) Dirs() []string {
+	return []string{p.cfg.ImageDir}
+}
+
+func (p *imagesPlugin) List(w io.Writer) error {
+	items, err := images.List(p.cfg.ImageDir)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		writeModule(w, item.Name, item.Version)
+	}
+	return nil
+}
+
+func (p *imagesPlugin) imagePath(m Module) (string, error) {
+	name, err := artifact.ParseName(m.Name, true)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(p.cfg.ImageDir, name+":"+tag(m.Version)), nil
+}
+
+func (p *imagesPlugin) Install(m Module) error {
+	if m.Version == "" && m.File == "" {
+		return fmt.Errorf("a module version is required to pull a flow image")
+	}
+	outputDir, err := p.imagePath(m)
+	if err != nil {
+		return err
+	}
+	if m.File != "" {
+		fmt.Fprintf(p.log, "Installing from file: %s\n", m.File)
+		return imagepull.LoadTarballImage(p.cfg, m.File, outputDir)
+	}
+	imageRef := m.Name + ":" + tag(m.Version)
+	fmt.Fprintf(p.log, "Pulling flow image: %s\n", imageRef)
+	return imagepull.PullImage(p.cfg, imageRef, outputDir, imagepull.Options{})
+}
+
+func (p *imagesPlugin) Remove(m Module) error {
+	if m.Version == "" {
+		return fmt.Errorf("a module version is required to remove a flow image")
+	}
+	outputDir, err := p.imagePath(m)
+	if err != nil {
+		return err
+	}
+	return removeAll(outputDir, p.log)
+}
+
+func removeAll(dir string, log io.Writer) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		fmt.Fprintf(log, "Image folder %s does not exist locally, skipping removal.\n", filepath.Base(dir))
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove image directory: %w", err)
+	}
+	fmt.Fprintf(log, "Image folder %s removed (%s)\n", filepath.Base(dir), dir)
+	return nil
+}
+
+// instancesPlugin manages flow instances (tedge-flows), where the module name is the
+// instance name and the version is the image reference
+type instancesPlugin struct {
+	cfg *config.Config
+	log io.Writer
+}
+
+func (p *instancesPlugin) Dirs() []string {
+	// The image may need to be pulled, so lock both directories (always image_dir first)
+	return []string{p.cfg.ImageDir, p.cfg.GetDeployDir()}
+}
+
+func (p *instancesPlugin) List(w io.Writer) error {
+	entries, err := instance.List(p.cfg.GetDeployDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		version := ""
+		if data, err := instance.Read(entry.Path); err == nil {
+			version = data.Metadata.Image
+			if version == "" && len(data.Steps) > 0 {
+				// Fallback to the image version for instances deployed by older versions
+				version = images.Read(filepath.Dir(filepath.Dir(data.Steps[0].Script))).Version
+			}
+		}
+		writeModule(w, entry.Name, version)
+	}
+	return nil
+}
+
+func (p *instancesPlugin) Install(m Module) error {
+	if m.Version == "" {
+		return fmt.Errorf("the module version must be set to the image reference of the flow")
+	}
+	if m.File != "" {
+		imagePath, err := instance.ImagePath(p.cfg, m.Version)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.log, "Installing from file: %s\n", m.File)
+		if err := imagepull.LoadTarballImage(p.cfg, m.File, imagePath); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(p.log, "Deploying instance. name=%s, image=%s\n", m.Name, m.Version)
+	_, err := instance.Deploy(p.cfg, instance.DeployOptions{
+		Name:  m.Name,
+		Image: m.Version,
+	}, p.log)
+	return err
+}
+
+func (p *instancesPlugin) Remove(m Module) error {
+	if _, err := os.Stat(p.cfg.GetDeployDir()); os.IsNotExist(err) {
+		return nil
+	}
+	removed, err := instance.Remove(p.cfg.GetDeployDir(), m.Name)
+	for _, path := range removed {
+		fmt.Fprintf(p.log, "Instance %s removed (%s)\n", m.Name, path)
+	}
+	return err
+}
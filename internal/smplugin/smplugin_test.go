@@ -0,0 +1,239 @@
+package smplugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth/registrytest"
+)
+
+func TestTag(t *testing.T) {
+	tests := map[string]string{
+		"1.0":                              "1.0",
+		"ghcr.io/thin-edge/counter:1.0":    "1.0",
+		"localhost:5000/thin-edge/counter": "localhost:5000/thin-edge/counter",
+	}
+	for input, want := range tests {
+		if got := tag(input); got != want {
+			t.Errorf("tag(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code := ExitCode(nil); code != ExitOK {
+		t.Errorf("expected %d, got %d", ExitOK, code)
+	}
+	if code := ExitCode(io.EOF); code != ExitFailure {
+		t.Errorf("expected %d, got %d", ExitFailure, code)
+	}
+	if code := ExitCode(filelock.ErrTimeout); code != ExitRetry {
+		t.Errorf("expected %d, got %d", ExitRetry, code)
+	}
+}
+
+func TestInstancesPlugin(t *testing.T) {
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.ImageDir, "counter:1.0", "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.ImageDir, "counter:1.0", "dist", "main.mjs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, err := New("instances", cfg, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Install(Module{Name: "counter1", Version: "ghcr.io/thin-edge/counter:1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := plugin.List(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "counter1\tghcr.io/thin-edge/counter:1.0\n" {
+		t.Errorf("unexpected list output: %q", got)
+	}
+	if err := plugin.Remove(Module{Name: "counter1"}); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := plugin.List(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no modules after remove, got: %q", out.String())
+	}
+}
+
+func TestUpdateListRollback(t *testing.T) {
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.ImageDir, "counter:1.0", "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.ImageDir, "counter:1.0", "dist", "main.mjs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// An image without an entrypoint can't be deployed
+	if err := os.MkdirAll(filepath.Join(cfg.ImageDir, "broken:1.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, err := New("instances", cfg, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Install(Module{Name: "a", Version: "counter:1.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := ParseUpdateList(bytes.NewBufferString("remove\ta\t\t\ninstall\tb\tcounter:1.0\t\ninstall\tc\tbroken:1.0\t\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.(BatchPlugin).UpdateList(actions); err == nil {
+		t.Fatal("expected update-list to fail")
+	}
+
+	var out bytes.Buffer
+	if err := plugin.List(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "a\tcounter:1.0\n" {
+		t.Errorf("expected the batch to be rolled back, got: %q", got)
+	}
+}
+
+func TestUpdateListRollbackLoadedImage(t *testing.T) {
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	script := filepath.Join(cfg.ImageDir, "counter:1.0", "dist", "main.mjs")
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// An image without an entrypoint can't be deployed
+	if err := os.MkdirAll(filepath.Join(cfg.ImageDir, "broken:1.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tarball := filepath.Join(root, "counter.tar")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dist/main.mjs", Size: 3, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tarball, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, err := New("instances", cfg, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Install(Module{Name: "a", Version: "counter:1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	actions, err := ParseUpdateList(bytes.NewBufferString("install\tb\tcounter:1.0\t" + tarball + "\ninstall\tc\tbroken:1.0\t\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.(BatchPlugin).UpdateList(actions); err == nil {
+		t.Fatal("expected update-list to fail")
+	}
+
+	// The image of instance a is restored
+	data, err := os.ReadFile(script)
+	if err != nil {
+		t.Fatalf("image used by instance a was removed: %v", err)
+	}
+	if string(data) != "old" {
+		t.Errorf("expected the previous image to be restored, got: %q", data)
+	}
+	entries, err := os.ReadDir(cfg.ImageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected no leftover folders in the image_dir, got %d entries", len(entries))
+	}
+}
+
+func TestUpdateListVersionRange(t *testing.T) {
+	reg := registrytest.Start()
+	defer reg.Close()
+	for _, version := range []string{"1.2.0", "1.2.3", "1.3.0"} {
+		reg.Push("thin-edge/counter", version, map[string]string{"dist/main.mjs": "// " + version})
+	}
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	plugin, err := New("instances", cfg, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := reg.Host() + "/thin-edge/counter"
+	actions, err := ParseUpdateList(bytes.NewBufferString("install\ta\t" + repo + ":~1.2\t\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.(BatchPlugin).UpdateList(actions); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := plugin.List(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "a\t"+repo+":1.2.3\n" {
+		t.Errorf("expected the range to be resolved, got: %q", got)
+	}
+	current, err := instance.Read(filepath.Join(cfg.DeployDir, "a.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Metadata.VersionRange != "~1.2" {
+		t.Errorf("expected the version range to be recorded, got %q", current.Metadata.VersionRange)
+	}
+}
+
+func TestParseUpdateList(t *testing.T) {
+	if _, err := ParseUpdateList(bytes.NewBufferString("upgrade\ta\t1.0\n")); err == nil {
+		t.Error("expected error for unsupported action")
+	}
+	actions, err := ParseUpdateList(bytes.NewBufferString("install\ta\tghcr.io/x/counter:1.0\t/tmp/a.tar\n\nremove\tb\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 2 || actions[0].Module.File != "/tmp/a.tar" || actions[1].Action != ActionRemove || actions[1].Module.Name != "b" {
+		t.Errorf("unexpected actions: %+v", actions)
+	}
+}
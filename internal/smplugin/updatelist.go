@@ -0,0 +1,236 @@
+package smplugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+)
+
+const (
+	ActionInstall = "install"
+	ActionRemove  = "remove"
+)
+
+// UpdateAction is a single line of the update-list input
+type UpdateAction struct {
+	Action string
+	Module Module
+}
+
+// BatchPlugin is implemented by plugins which support the update-list command
+type BatchPlugin interface {
+	UpdateList(actions []UpdateAction) error
+}
+
+// ParseUpdateList reads the update-list input, where each line has the tab separated
+// fields: action, module name, version (optional) and file path (optional)
+func ParseUpdateList(r io.Reader) ([]UpdateAction, error) {
+	var actions []UpdateAction
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		for len(fields) < 4 {
+			fields = append(fields, "")
+		}
+		action := UpdateAction{
+			Action: strings.TrimSpace(fields[0]),
+			Module: Module{
+				Name:    strings.TrimSpace(fields[1]),
+				Version: strings.TrimSpace(fields[2]),
+				File:    strings.TrimSpace(fields[3]),
+			},
+		}
+		if action.Action != ActionInstall && action.Action != ActionRemove {
+			return nil, fmt.Errorf("line %d: unsupported action %q", lineNum, action.Action)
+		}
+		if action.Module.Name == "" {
+			return nil, fmt.Errorf("line %d: module name is required", lineNum)
+		}
+		actions = append(actions, action)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read update list: %w", err)
+	}
+	return actions, nil
+}
+
+// UpdateList applies a batch of installs and removes. All images are pulled (or loaded)
+// first, then the instances are swapped. If any step fails, the instance files which were
+// already changed are restored, images pulled by the batch are removed and images replaced
+// by the batch are restored.
+func (p *instancesPlugin) UpdateList(actions []UpdateAction) (err error) {
+	deployDir := p.cfg.GetDeployDir()
+	if err := os.MkdirAll(deployDir, 0755); err != nil {
+		return err
+	}
+
+	// Stage 1: make all images available locally. Version ranges are resolved to a tag, which
+	// the instance is deployed with. Images loaded from a file over an existing image folder
+	// are swapped in, keeping the previous folder to restore it on failure.
+	resolved := make([]imagepull.Resolved, len(actions))
+	var pulled []string
+	replaced := map[string]string{}
+	defer func() {
+		for imagePath, backupPath := range replaced {
+			if err != nil {
+				_ = os.RemoveAll(imagePath)
+				_ = os.Rename(backupPath, imagePath)
+			} else {
+				_ = os.RemoveAll(backupPath)
+			}
+		}
+		if err != nil {
+			for _, imagePath := range pulled {
+				_ = os.RemoveAll(imagePath)
+			}
+		}
+	}()
+	for i, action := range actions {
+		if action.Action != ActionInstall {
+			continue
+		}
+		m := action.Module
+		if m.Version == "" {
+			return fmt.Errorf("%s: the module version must be set to the image reference of the flow", m.Name)
+		}
+		if resolved[i], err = imagepull.ResolveImageRef(p.cfg, m.Version); err != nil {
+			return fmt.Errorf("failed to prepare image %s for %s: %w", m.Version, m.Name, err)
+		}
+		if resolved[i].Range != "" {
+			fmt.Fprintf(p.log, "Version range %s resolved to %s (%s)\n", resolved[i].Range, resolved[i].Tag, resolved[i].Digest)
+		}
+		m.Version = resolved[i].ImageRef
+		imagePath, err := instance.ImagePath(p.cfg, m.Version)
+		if err != nil {
+			return err
+		}
+		_, statErr := os.Stat(imagePath)
+		exists := statErr == nil
+		if exists && m.File == "" {
+			continue
+		}
+		if m.File == "" {
+			fmt.Fprintf(p.log, "Pulling flow image: %s\n", m.Version)
+			if err := imagepull.PullImage(p.cfg, m.Version, imagePath, imagepull.Options{}); err != nil {
+				return fmt.Errorf("failed to prepare image %s for %s: %w", m.Version, m.Name, err)
+			}
+			pulled = append(pulled, imagePath)
+			continue
+		}
+		fmt.Fprintf(p.log, "Loading flow image from file: %s\n", m.File)
+		if !exists {
+			if err := imagepull.LoadTarballImage(p.cfg, m.File, imagePath); err != nil {
+				return fmt.Errorf("failed to prepare image %s for %s: %w", m.Version, m.Name, err)
+			}
+			pulled = append(pulled, imagePath)
+			continue
+		}
+		if _, ok := replaced[imagePath]; ok {
+			// Already replaced by an earlier action of the batch, so keep the first backup
+			if err := imagepull.LoadTarballImage(p.cfg, m.File, imagePath); err != nil {
+				return fmt.Errorf("failed to prepare image %s for %s: %w", m.Version, m.Name, err)
+			}
+			continue
+		}
+		base := filepath.Base(imagePath)
+		pendingPath := filepath.Join(filepath.Dir(imagePath), "."+base+".update")
+		backupPath := filepath.Join(filepath.Dir(imagePath), "."+base+".rollback")
+		if err := imagepull.LoadTarballImage(p.cfg, m.File, pendingPath); err != nil {
+			_ = os.RemoveAll(pendingPath)
+			return fmt.Errorf("failed to prepare image %s for %s: %w", m.Version, m.Name, err)
+		}
+		_ = os.RemoveAll(backupPath)
+		if err := os.Rename(imagePath, backupPath); err != nil {
+			_ = os.RemoveAll(pendingPath)
+			return fmt.Errorf("failed to move image %s aside: %w", m.Version, err)
+		}
+		replaced[imagePath] = backupPath
+		if err := os.Rename(pendingPath, imagePath); err != nil {
+			return fmt.Errorf("failed to replace image %s: %w", m.Version, err)
+		}
+	}
+
+	// Stage 2: swap the instances, keeping a snapshot of every file which is touched
+	snapshots := map[string]map[string][]byte{}
+	for i, action := range actions {
+		m := action.Module
+		if _, ok := snapshots[m.Name]; !ok {
+			snapshot, err := snapshotInstance(deployDir, m.Name)
+			if err != nil {
+				return err
+			}
+			snapshots[m.Name] = snapshot
+		}
+		var actionErr error
+		switch action.Action {
+		case ActionInstall:
+			opts := instance.DeployOptions{Name: m.Name, Image: resolved[i].ImageRef, VersionRange: resolved[i].Range}
+			fmt.Fprintf(p.log, "Deploying instance. name=%s, image=%s\n", m.Name, opts.Image)
+			_, actionErr = instance.Deploy(p.cfg, opts, p.log)
+		case ActionRemove:
+			fmt.Fprintf(p.log, "Removing instance. name=%s\n", m.Name)
+			_, actionErr = instance.Remove(deployDir, m.Name)
+		}
+		if actionErr != nil {
+			actionErr = fmt.Errorf("failed to %s %s: %w", action.Action, m.Name, actionErr)
+			if rollbackErr := restoreInstances(deployDir, snapshots); rollbackErr != nil {
+				return errors.Join(actionErr, fmt.Errorf("rollback failed: %w", rollbackErr))
+			}
+			fmt.Fprintf(p.log, "Rolled back %d instance(s)\n", len(snapshots))
+			return actionErr
+		}
+	}
+	return nil
+}
+
+// snapshotInstance returns the contents of the enabled and disabled files of an instance
+func snapshotInstance(deployDir string, name string) (map[string][]byte, error) {
+	snapshot := map[string][]byte{}
+	for _, enabled := range []bool{true, false} {
+		path := filepath.Join(deployDir, instance.FileName(name, enabled))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read instance %s: %w", name, err)
+		}
+		snapshot[path] = data
+	}
+	return snapshot, nil
+}
+
+// restoreInstances puts the instance files back to the state captured in the snapshots
+func restoreInstances(deployDir string, snapshots map[string]map[string][]byte) error {
+	var errs []error
+	for name, snapshot := range snapshots {
+		if _, err := instance.Remove(deployDir, name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for path, data := range snapshot {
+			err := fsutil.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			})
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,102 @@
+// Package status describes the flow instances and images of a device, which is published
+// to the thin-edge.io twin so the cloud can see which flows run on the device.
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/images"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+)
+
+// TwinFragment is the name of the twin (inventory) fragment, published to
+// <topic_root>/<device_topic_id>/twin/flows
+const TwinFragment = "flows"
+
+// Instance describes a deployed flow instance
+type Instance struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Image is the image reference the instance was deployed from
+	Image   string `json:"image,omitempty"`
+	Version string `json:"version,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// Image describes a flow image in the image_dir
+type Image struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// Status is the twin fragment describing all instances and images
+type Status struct {
+	Instances []Instance `json:"instances"`
+	Images    []Image    `json:"images"`
+}
+
+// Collect reads the current instances and images. The caller should hold at least a
+// shared lock on the image_dir and deploy_dir.
+func Collect(cfg *config.Config) (*Status, error) {
+	s := &Status{
+		Instances: []Instance{},
+		Images:    []Image{},
+	}
+	imageList, err := images.List(cfg.ImageDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	for _, img := range imageList {
+		s.Images = append(s.Images, Image{
+			Name:    img.Name,
+			Version: known(img.Version),
+			Digest:  known(img.Digest),
+		})
+	}
+
+	entries, err := instance.List(cfg.GetDeployDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	for _, entry := range entries {
+		item := Instance{
+			Name:   entry.Name,
+			Status: entry.Status(),
+		}
+		if data, err := instance.Read(entry.Path); err == nil {
+			item.Image = data.Metadata.Image
+			if len(data.Steps) > 0 && data.Steps[0].Script != "" {
+				img := images.Read(filepath.Dir(filepath.Dir(data.Steps[0].Script)))
+				if item.Image == "" {
+					item.Image = img.Name
+				}
+				item.Version = known(img.Version)
+				item.Digest = known(img.Digest)
+			}
+		}
+		s.Instances = append(s.Instances, item)
+	}
+	return s, nil
+}
+
+func known(value string) string {
+	if value == images.Unknown {
+		return ""
+	}
+	return value
+}
+
+// Publish sends the status as a retained message to the topic
+func Publish(client *mqtt.Client, topic string, s *Status) error {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return client.Publish(topic, payload, true)
+}
@@ -0,0 +1,75 @@
+package status
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt/mqtttest"
+)
+
+func TestCollectAndPublish(t *testing.T) {
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	imageDir := filepath.Join(cfg.ImageDir, "counter:1.0")
+	if err := os.MkdirAll(filepath.Join(imageDir, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "dist", "main.mjs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"config":{"digest":"sha256:abc"},"annotations":{"org.opencontainers.image.version":"1.0"}}`
+	if err := os.WriteFile(filepath.Join(imageDir, "manifest.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.Deploy(cfg, instance.DeployOptions{Name: "counter1", Image: "ghcr.io/thin-edge/counter:1.0"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Collect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Instance{Name: "counter1", Status: instance.StatusEnabled, Image: "ghcr.io/thin-edge/counter:1.0", Version: "1.0", Digest: "sha256:abc"}
+	if len(s.Instances) != 1 || s.Instances[0] != want {
+		t.Fatalf("unexpected instances: %+v", s.Instances)
+	}
+	if len(s.Images) != 1 || s.Images[0] != (Image{Name: "counter", Version: "1.0", Digest: "sha256:abc"}) {
+		t.Fatalf("unexpected images: %+v", s.Images)
+	}
+
+	broker, err := mqtttest.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client, err := mqtt.Connect(mqtt.Options{Broker: broker.URL(), ClientID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	topic := "te/device/main///twin/flows"
+	if err := Publish(client, topic, s); err != nil {
+		t.Fatal(err)
+	}
+	payload, ok := broker.Retained(topic)
+	if !ok {
+		t.Fatalf("expected a retained message on %s", topic)
+	}
+	var got Status
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Instances) != 1 || got.Instances[0] != want {
+		t.Errorf("unexpected published instances: %+v", got.Instances)
+	}
+}
@@ -0,0 +1,168 @@
+// Package tedge reads the thin-edge.io settings (tedge.toml) which tedge-oscar needs to
+// talk to the local MQTT broker.
+package tedge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/mqtt"
+)
+
+// Defaults used by thin-edge.io when the values are not set in tedge.toml
+const (
+	DefaultHost          = "127.0.0.1"
+	DefaultPort          = 1883
+	DefaultTopicRoot     = "te"
+	DefaultDeviceTopicID = "device/main//"
+)
+
+// tedgeConfig is the subset of tedge.toml used by tedge-oscar
+type tedgeConfig struct {
+	MQTT struct {
+		TopicRoot     string `toml:"topic_root"`
+		DeviceTopicID string `toml:"device_topic_id"`
+		Client        struct {
+			Host string `toml:"host"`
+			Port int    `toml:"port"`
+			Auth struct {
+				CAFile   string `toml:"ca_file"`
+				CertFile string `toml:"cert_file"`
+				KeyFile  string `toml:"key_file"`
+			} `toml:"auth"`
+		} `toml:"client"`
+	} `toml:"mqtt"`
+}
+
+// MQTTSettings describes how to reach the thin-edge.io MQTT broker and where the
+// device's topics are
+type MQTTSettings struct {
+	Host          string
+	Port          int
+	TopicRoot     string
+	DeviceTopicID string
+	CAFile        string
+	CertFile      string
+	KeyFile       string
+}
+
+// ConfigDir returns the tedge config dir (TEDGE_CONFIG_DIR, defaults to /etc/tedge)
+func ConfigDir() string {
+	if dir := os.Getenv("TEDGE_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	return "/etc/tedge"
+}
+
+// Version returns the installed thin-edge.io version, as reported by "tedge --version"
+// (e.g. "tedge 1.5.0"). It returns an error if tedge is not installed.
+func Version() (string, error) {
+	out, err := exec.Command("tedge", "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the tedge version: %w", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("failed to get the tedge version: empty output")
+	}
+	return fields[len(fields)-1], nil
+}
+
+// LoadMQTTSettings reads the MQTT settings from tedge.toml in the tedge config dir and
+// applies the overrides from the [mqtt] section of the tedge-oscar config.
+// A missing tedge.toml is not an error, the thin-edge.io defaults are used instead.
+func LoadMQTTSettings(cfg *config.Config) (MQTTSettings, error) {
+	settings := MQTTSettings{
+		Host:          DefaultHost,
+		Port:          DefaultPort,
+		TopicRoot:     DefaultTopicRoot,
+		DeviceTopicID: DefaultDeviceTopicID,
+	}
+	path := filepath.Join(ConfigDir(), "tedge.toml")
+	var tc tedgeConfig
+	if _, err := toml.DecodeFile(path, &tc); err != nil && !os.IsNotExist(err) {
+		return settings, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	overrideString(&settings.Host, tc.MQTT.Client.Host)
+	overrideInt(&settings.Port, tc.MQTT.Client.Port)
+	overrideString(&settings.TopicRoot, tc.MQTT.TopicRoot)
+	overrideString(&settings.DeviceTopicID, tc.MQTT.DeviceTopicID)
+	overrideString(&settings.CAFile, tc.MQTT.Client.Auth.CAFile)
+	overrideString(&settings.CertFile, tc.MQTT.Client.Auth.CertFile)
+	overrideString(&settings.KeyFile, tc.MQTT.Client.Auth.KeyFile)
+
+	if cfg != nil {
+		overrideString(&settings.Host, cfg.MQTT.Host)
+		overrideInt(&settings.Port, cfg.MQTT.Port)
+		overrideString(&settings.TopicRoot, cfg.MQTT.TopicRoot)
+		overrideString(&settings.DeviceTopicID, cfg.MQTT.DeviceTopicID)
+	}
+	return settings, nil
+}
+
+func overrideString(dst *string, value string) {
+	if value != "" {
+		*dst = value
+	}
+}
+
+func overrideInt(dst *int, value int) {
+	if value != 0 {
+		*dst = value
+	}
+}
+
+// Topic returns the topic of a channel of the device, e.g. Topic("twin", "flows")
+// returns te/device/main///twin/flows
+func (s MQTTSettings) Topic(channel ...string) string {
+	return strings.Join(append([]string{s.TopicRoot, s.DeviceTopicID}, channel...), "/")
+}
+
+// ClientOptions returns the options to connect to the broker. TLS is used when a CA file
+// is configured, with client certificate authentication if a certificate is set.
+func (s MQTTSettings) ClientOptions(clientID string) (mqtt.Options, error) {
+	opts := mqtt.Options{
+		Broker:   "tcp://" + net.JoinHostPort(s.Host, strconv.Itoa(s.Port)),
+		ClientID: clientID,
+	}
+	if s.CAFile == "" {
+		return opts, nil
+	}
+	caCert, err := os.ReadFile(s.CAFile)
+	if err != nil {
+		return opts, fmt.Errorf("failed to read MQTT CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return opts, fmt.Errorf("no certificates found in MQTT CA file: %s", s.CAFile)
+	}
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if s.CertFile != "" && s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return opts, fmt.Errorf("failed to load MQTT client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	opts.Broker = "ssl://" + net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	opts.TLSConfig = tlsConfig
+	return opts, nil
+}
+
+// Connect connects to the thin-edge.io MQTT broker
+func (s MQTTSettings) Connect(clientID string) (*mqtt.Client, error) {
+	opts, err := s.ClientOptions(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return mqtt.Connect(opts)
+}
@@ -0,0 +1,183 @@
+// Package variant selects the variant of a multi-variant flow image which matches the device.
+// A multi-variant image is an OCI image index, whose manifests are annotated with their
+// requirements: io.thin-edge.flow.runtime is a version constraint on the thin-edge.io version
+// (e.g. ">=1.5"), and any other io.thin-edge.flow.<label> annotation must be equal to the
+// platform label of the config (e.g. io.thin-edge.flow.device-class=gateway).
+package variant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/semver"
+	"github.com/thin-edge/tedge-oscar/internal/tedge"
+)
+
+const (
+	// AnnotationPrefix is the prefix of the requirement annotations of a variant
+	AnnotationPrefix = "io.thin-edge.flow."
+	// AnnotationRuntime is the version constraint on the thin-edge.io version
+	AnnotationRuntime = AnnotationPrefix + "runtime"
+)
+
+// Facts describe the device which pulls an image
+type Facts struct {
+	// RuntimeVersion is the thin-edge.io version, empty if unknown
+	RuntimeVersion string
+	// Labels are the platform labels of the config
+	Labels map[string]string
+}
+
+// LocalFacts returns the facts of this device: the thin-edge.io version (from the config, or
+// detected with "tedge --version") and the platform labels of the config
+func LocalFacts(cfg *config.Config) Facts {
+	facts := Facts{RuntimeVersion: cfg.Platform.TedgeVersion, Labels: cfg.Platform.Labels}
+	if facts.RuntimeVersion == "" {
+		if v, err := tedge.Version(); err == nil {
+			facts.RuntimeVersion = v
+		}
+	}
+	return facts
+}
+
+func (f Facts) String() string {
+	runtime := f.RuntimeVersion
+	if runtime == "" {
+		runtime = "unknown"
+	}
+	parts := []string{"runtime=" + runtime}
+	for _, name := range sortedKeys(f.Labels) {
+		parts = append(parts, name+"="+f.Labels[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Requirements returns the requirement annotations, keyed by their name without prefix
+func Requirements(annotations map[string]string) map[string]string {
+	reqs := map[string]string{}
+	for k, v := range annotations {
+		if name, ok := strings.CutPrefix(k, AnnotationPrefix); ok && name != "" {
+			reqs[name] = v
+		}
+	}
+	return reqs
+}
+
+// Describe returns the requirements as "runtime=>=1.5, device-class=gateway", or "default"
+// for a variant without requirements
+func Describe(annotations map[string]string) string {
+	reqs := Requirements(annotations)
+	if len(reqs) == 0 {
+		return "default"
+	}
+	parts := make([]string, 0, len(reqs))
+	for _, name := range sortedKeys(reqs) {
+		parts = append(parts, name+"="+reqs[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Matches reports whether the facts meet all requirements of the annotations. It returns an
+// error if the runtime requirement is not a valid version constraint.
+func (f Facts) Matches(annotations map[string]string) (bool, error) {
+	for name, value := range Requirements(annotations) {
+		if name != "runtime" {
+			if f.Labels[name] != value {
+				return false, nil
+			}
+			continue
+		}
+		constraint, err := semver.ParseConstraint(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s annotation: %w", AnnotationRuntime, err)
+		}
+		v, err := semver.Parse(f.RuntimeVersion)
+		if err != nil || !constraint.Check(v) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Select returns the manifest of the index which matches the facts. If several manifests
+// match, the one with the most requirements wins, then the first one of the index.
+func Select(index ocispec.Index, facts Facts) (ocispec.Descriptor, error) {
+	best := -1
+	for i, m := range index.Manifests {
+		ok, err := facts.Matches(m.Annotations)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("variant %s: %w", m.Digest, err)
+		}
+		if ok && (best == -1 || len(Requirements(m.Annotations)) > len(Requirements(index.Manifests[best].Annotations))) {
+			best = i
+		}
+	}
+	if best == -1 {
+		variants := make([]string, 0, len(index.Manifests))
+		for _, m := range index.Manifests {
+			variants = append(variants, "["+Describe(m.Annotations)+"]")
+		}
+		return ocispec.Descriptor{}, fmt.Errorf("no variant matches this device (%s), available variants: %s", facts, strings.Join(variants, " "))
+	}
+	return index.Manifests[best], nil
+}
+
+// Resolve fetches the index desc and returns its manifest which matches the facts
+func Resolve(ctx context.Context, store content.Fetcher, desc ocispec.Descriptor, facts Facts) (ocispec.Descriptor, error) {
+	data, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to fetch image index: %w", err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid image index: %w", err)
+	}
+	return Select(index, facts)
+}
+
+// ParseSpec parses a variant given as dir[:name=value[;name=value...]], e.g.
+// "build/legacy:runtime=<1.5;device-class=gateway". Names without a dot are prefixed with
+// AnnotationPrefix. It returns the directory and the requirement annotations.
+func ParseSpec(spec string) (string, map[string]string, error) {
+	dir, reqs, _ := strings.Cut(spec, ":")
+	if dir == "" {
+		return "", nil, fmt.Errorf("invalid variant %q, expected dir[:name=value;...]", spec)
+	}
+	annotations := map[string]string{}
+	for _, req := range strings.Split(reqs, ";") {
+		if strings.TrimSpace(req) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(req, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return "", nil, fmt.Errorf("invalid variant requirement %q, expected name=value", req)
+		}
+		if !strings.Contains(name, ".") {
+			name = AnnotationPrefix + name
+		}
+		if name == AnnotationRuntime {
+			if _, err := semver.ParseConstraint(value); err != nil {
+				return "", nil, err
+			}
+		}
+		annotations[name] = value
+	}
+	return dir, annotations, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
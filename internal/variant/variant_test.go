@@ -0,0 +1,62 @@
+package variant
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSelect(t *testing.T) {
+	index := ocispec.Index{Manifests: []ocispec.Descriptor{
+		{Digest: digest.FromString("legacy"), Annotations: map[string]string{AnnotationRuntime: "<1.5"}},
+		{Digest: digest.FromString("current"), Annotations: map[string]string{AnnotationRuntime: ">=1.5"}},
+		{Digest: digest.FromString("gateway"), Annotations: map[string]string{AnnotationRuntime: ">=1.5", AnnotationPrefix + "device-class": "gateway"}},
+	}}
+	tests := []struct {
+		facts Facts
+		want  string
+	}{
+		{Facts{RuntimeVersion: "1.4.2"}, "legacy"},
+		{Facts{RuntimeVersion: "1.5.0"}, "current"},
+		{Facts{RuntimeVersion: "1.6.0", Labels: map[string]string{"device-class": "gateway"}}, "gateway"},
+		{Facts{RuntimeVersion: "1.6.0", Labels: map[string]string{"device-class": "sensor"}}, "current"},
+	}
+	for _, tt := range tests {
+		got, err := Select(index, tt.facts)
+		if err != nil {
+			t.Fatalf("Select(%s): %v", tt.facts, err)
+		}
+		if got.Digest != digest.FromString(tt.want) {
+			t.Errorf("Select(%s) = %s, want the %s variant", tt.facts, got.Digest, tt.want)
+		}
+	}
+	if _, err := Select(index, Facts{}); err == nil {
+		t.Error("expected no variant to match an unknown runtime version")
+	}
+	index.Manifests = append(index.Manifests, ocispec.Descriptor{Digest: digest.FromString("default")})
+	if got, err := Select(index, Facts{}); err != nil || got.Digest != digest.FromString("default") {
+		t.Errorf("expected the variant without requirements as fallback, got %s %v", got.Digest, err)
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	dir, annotations, err := ParseSpec("build/legacy:runtime=>=1.2, <1.5;device-class=gateway;org.example.tier=edge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		AnnotationRuntime:                 ">=1.2, <1.5",
+		AnnotationPrefix + "device-class": "gateway",
+		"org.example.tier":                "edge",
+	}
+	if dir != "build/legacy" || !reflect.DeepEqual(annotations, want) {
+		t.Errorf("got %s %v", dir, annotations)
+	}
+	for _, invalid := range []string{"", ":runtime=1.5", "build:runtime", "build:runtime=latest"} {
+		if _, _, err := ParseSpec(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
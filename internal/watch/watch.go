@@ -0,0 +1,481 @@
+// Package watch periodically checks the registries for newer images of the instances which
+// have an update policy, and upgrades them unattended. An upgrade is rolled back if the flows
+// runtime does not confirm it (see the reload package), and the rolled back version is not
+// retried until the watcher is restarted.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/filelock"
+	"github.com/thin-edge/tedge-oscar/internal/fsutil"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/reload"
+	"github.com/thin-edge/tedge-oscar/internal/semver"
+	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
+)
+
+// Update policies of an instance
+const (
+	// PolicyNone never updates the instance, which is the default
+	PolicyNone = "none"
+	// PolicyPatch updates to the latest patch release of the current minor version
+	PolicyPatch = "patch"
+	// PolicyMinor updates to the latest minor or patch release of the current major version
+	PolicyMinor = "minor"
+	// PolicyDigest follows a moving tag, e.g. latest, by pulling it again when it changes
+	PolicyDigest = "digest"
+)
+
+// Policies are the valid update policies
+var Policies = []string{PolicyNone, PolicyPatch, PolicyMinor, PolicyDigest}
+
+// DefaultInterval is used if watch.interval is not set
+const DefaultInterval = time.Hour
+
+// DefaultJitter is used if watch.jitter is not set
+const DefaultJitter = 0.1
+
+// ValidatePolicy returns an error if policy is not one of Policies. An empty policy is valid.
+func ValidatePolicy(policy string) error {
+	if policy != "" && !slices.Contains(Policies, policy) {
+		return fmt.Errorf("invalid update policy %q, expected one of: %s", policy, strings.Join(Policies, ", "))
+	}
+	return nil
+}
+
+// PolicyRange returns the range of versions the patch and minor policies allow for an image
+// with the tag, e.g. ">=1.2.3, <1.3.0" for the patch policy and 1.2.3
+func PolicyRange(policy string, tag string) (string, error) {
+	v, err := semver.Parse(tag)
+	if err != nil {
+		return "", fmt.Errorf("the %s update policy requires a semantic version tag: %w", policy, err)
+	}
+	switch policy {
+	case PolicyPatch:
+		return fmt.Sprintf(">=%s, <%d.%d.0", v, v.Major, v.Minor+1), nil
+	case PolicyMinor:
+		return fmt.Sprintf(">=%s, <%d.0.0", v, v.Major+1), nil
+	}
+	return "", fmt.Errorf("the %s update policy has no version range", policy)
+}
+
+// intersectRanges returns the range of the versions which are in both ranges. The policy
+// range has no alternatives, so it is added to each alternative of the other range.
+func intersectRanges(policyRange string, versionRange string) string {
+	alternatives := strings.Split(versionRange, "||")
+	for i, alt := range alternatives {
+		alternatives[i] = policyRange + ", " + strings.TrimSpace(alt)
+	}
+	return strings.Join(alternatives, " || ")
+}
+
+// Options configures the watcher
+type Options struct {
+	// Interval is the time between two checks, defaults to DefaultInterval
+	Interval time.Duration
+	// Jitter is the fraction of the interval by which each check is randomly moved
+	Jitter      float64
+	LockTimeout time.Duration
+	// Changed is called after instances were upgraded, e.g. to publish the flow status
+	Changed func()
+	// Log receives progress messages
+	Log io.Writer
+}
+
+// Watcher upgrades the instances according to their update policy
+type Watcher struct {
+	cfg  *config.Config
+	opts Options
+	// rolledBack are the images (or digests) which were rolled back, so they are not retried
+	rolledBack map[string]bool
+}
+
+// New creates a watcher
+func New(cfg *config.Config, opts Options) *Watcher {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Log == nil {
+		opts.Log = io.Discard
+	}
+	if opts.Changed == nil {
+		opts.Changed = func() {}
+	}
+	return &Watcher{cfg: cfg, opts: opts, rolledBack: map[string]bool{}}
+}
+
+// Run checks for updates until the context is cancelled. The first check is delayed randomly
+// by up to the jitter, so devices which are started at the same time don't query the
+// registries at once, and each following check is moved randomly by up to the jitter.
+func (w *Watcher) Run(ctx context.Context) error {
+	delay := time.Duration(rand.Float64() * w.opts.Jitter * float64(w.opts.Interval))
+	fmt.Fprintf(w.opts.Log, "Checking for updates every %s\n", w.opts.Interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if err := w.Check(); err != nil {
+			fmt.Fprintf(w.opts.Log, "Update check failed: %s\n", err)
+		}
+		delay = jittered(w.opts.Interval, w.opts.Jitter, rand.Float64())
+	}
+}
+
+// jittered moves interval by up to jitter (a fraction of the interval) for r in [0, 1)
+func jittered(interval time.Duration, jitter float64, r float64) time.Duration {
+	return time.Duration(float64(interval) * (1 + jitter*(2*r-1)))
+}
+
+// candidate is an instance with an update policy
+type candidate struct {
+	entry    instance.Entry
+	metadata flows.InstanceMetadata
+}
+
+// Check upgrades all instances with an update policy for which a newer image is available.
+// A failed upgrade of an instance is logged and doesn't stop the others.
+func (w *Watcher) Check() error {
+	candidates, err := w.candidates()
+	if err != nil {
+		return err
+	}
+	changed := false
+	// Instances following the same tag share its image folder, so they are updated together
+	digestGroups := map[string][]candidate{}
+	var digestImages []string
+	for _, c := range candidates {
+		if c.metadata.UpdatePolicy == PolicyDigest {
+			if _, ok := digestGroups[c.metadata.Image]; !ok {
+				digestImages = append(digestImages, c.metadata.Image)
+			}
+			digestGroups[c.metadata.Image] = append(digestGroups[c.metadata.Image], c)
+			continue
+		}
+		upgraded, err := w.upgrade(c)
+		if err != nil {
+			fmt.Fprintf(w.opts.Log, "Failed to update instance %s: %s\n", c.entry.Name, err)
+		}
+		changed = changed || upgraded
+	}
+	for _, image := range digestImages {
+		updated, err := w.updateDigest(image, digestGroups[image])
+		if err != nil {
+			fmt.Fprintf(w.opts.Log, "Failed to update image %s: %s\n", image, err)
+		}
+		changed = changed || updated
+	}
+	if changed {
+		w.opts.Changed()
+	}
+	return nil
+}
+
+// candidates returns the instances with an update policy other than none
+func (w *Watcher) candidates() ([]candidate, error) {
+	deployDir := w.cfg.GetDeployDir()
+	unlock, err := filelock.AcquireAll([]string{deployDir}, filelock.Shared, w.opts.LockTimeout, w.opts.Log)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	entries, err := instance.List(deployDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	var candidates []candidate
+	for _, entry := range entries {
+		current, err := instance.Read(entry.Path)
+		if err != nil {
+			fmt.Fprintf(w.opts.Log, "Skipping instance %s: %s\n", entry.Name, err)
+			continue
+		}
+		policy := current.Metadata.UpdatePolicy
+		if policy == "" || policy == PolicyNone || current.Metadata.Image == "" {
+			continue
+		}
+		if err := ValidatePolicy(policy); err != nil {
+			fmt.Fprintf(w.opts.Log, "Skipping instance %s: %s\n", entry.Name, err)
+			continue
+		}
+		candidates = append(candidates, candidate{entry: entry, metadata: current.Metadata})
+	}
+	return candidates, nil
+}
+
+// upgrade upgrades an instance with the patch or minor policy to the latest version within
+// the policy and the version range the instance was deployed with, if any. The image is
+// pulled without locking the image_dir and deploy_dir, and the previous instance file is
+// restored if the flows runtime does not confirm the upgrade.
+func (w *Watcher) upgrade(c candidate) (bool, error) {
+	_, tag, err := registryauth.SplitRef(c.metadata.Image)
+	if err != nil {
+		return false, err
+	}
+	versionRange, err := PolicyRange(c.metadata.UpdatePolicy, tag)
+	if err != nil {
+		return false, err
+	}
+	if c.metadata.VersionRange != "" {
+		versionRange = intersectRanges(versionRange, c.metadata.VersionRange)
+	}
+	resolved, upgrade, err := instance.LatestImage(w.cfg, c.metadata.Image, versionRange)
+	if err != nil || !upgrade {
+		return false, err
+	}
+	if w.rolledBack[resolved.ImageRef] {
+		return false, nil
+	}
+	fmt.Fprintf(w.opts.Log, "Updating instance %s from %s to %s (%s policy)\n", c.entry.Name, c.metadata.Image, resolved.ImageRef, c.metadata.UpdatePolicy)
+
+	imagePath, err := instance.ImagePath(w.cfg, resolved.ImageRef)
+	if err != nil {
+		return false, err
+	}
+	pendingPath := ""
+	if _, err := os.Stat(imagePath); err != nil {
+		if pendingPath, err = w.pull(resolved.ImageRef, imagePath); err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(pendingPath)
+	}
+
+	deployDir := w.cfg.GetDeployDir()
+	upgraded := false
+	err = w.withLock([]string{w.cfg.ImageDir, deployDir}, func() error {
+		// The image may have been pulled by another command in the meantime
+		if _, err := os.Stat(imagePath); pendingPath != "" && os.IsNotExist(err) {
+			if err := os.Rename(pendingPath, imagePath); err != nil {
+				return fmt.Errorf("failed to move image into place: %w", err)
+			}
+		}
+		// The instance may have been changed while the image was pulled
+		entry, err := instance.Find(deployDir, c.entry.Name)
+		if err != nil || entry == nil {
+			return err
+		}
+		current, err := instance.Read(entry.Path)
+		if err != nil {
+			return err
+		}
+		if current.Metadata.Image != c.metadata.Image || current.Metadata.UpdatePolicy != c.metadata.UpdatePolicy {
+			fmt.Fprintf(w.opts.Log, "Instance %s was changed in the meantime, skipping the update\n", entry.Name)
+			return nil
+		}
+		previous, err := os.ReadFile(entry.Path)
+		if err != nil {
+			return err
+		}
+		tomlPath, err := instance.Upgrade(w.cfg, *entry, resolved.ImageRef, current.Metadata.VersionRange, w.opts.Log)
+		if err != nil {
+			return err
+		}
+		upgraded = true
+		if !entry.Enabled {
+			return nil
+		}
+		change := reload.Change{Action: reload.ActionDeploy, Name: entry.Name, Path: tomlPath}
+		if err := reload.Run(w.cfg, change, w.opts.Log); err != nil {
+			fmt.Fprintf(w.opts.Log, "Rolling back instance %s to %s: %s\n", entry.Name, c.metadata.Image, err)
+			w.rolledBack[resolved.ImageRef] = true
+			err = fsutil.WriteFileAtomic(tomlPath, 0644, func(out io.Writer) error {
+				_, err := out.Write(previous)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to roll back: %w", err)
+			}
+			if err := reload.Run(w.cfg, change, w.opts.Log); err != nil {
+				return fmt.Errorf("the flows runtime did not confirm the rollback: %w", err)
+			}
+			return fmt.Errorf("rolled back to %s", c.metadata.Image)
+		}
+		fmt.Fprintf(w.opts.Log, "Instance %s updated to %s\n", entry.Name, resolved.ImageRef)
+		return nil
+	})
+	return upgraded, err
+}
+
+// updateDigest pulls the image again if its tag points to another digest than the pulled
+// one, and replaces the image folder of the instances. The previous folder is restored if the
+// flows runtime does not confirm the reload of the instances. The image folder is not
+// replaced while instances without the digest policy use it, as they didn't opt into updates.
+func (w *Watcher) updateDigest(imageRef string, candidates []candidate) (bool, error) {
+	repoRef, tag, err := registryauth.SplitRef(imageRef)
+	if err != nil {
+		return false, err
+	}
+	imagePath, err := instance.ImagePath(w.cfg, imageRef)
+	if err != nil {
+		return false, err
+	}
+	repo, err := registryauth.NewRepository(w.cfg, repoRef, false)
+	if err != nil {
+		return false, err
+	}
+	desc, err := repo.Resolve(context.Background(), tag)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve %s: %w", imageRef, err)
+	}
+	pulled := instance.PulledDigest(imagePath)
+	if pulled == desc.Digest.String() || w.rolledBack[desc.Digest.String()] {
+		return false, nil
+	}
+	deployDir := w.cfg.GetDeployDir()
+	unlock, err := filelock.AcquireAll([]string{deployDir}, filelock.Shared, w.opts.LockTimeout, w.opts.Log)
+	if err != nil {
+		return false, err
+	}
+	skip, err := w.pinnedBy(deployDir, imageRef, imagePath)
+	unlock()
+	if skip || err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w.opts.Log, "Updating image %s to %s (digest policy)\n", imageRef, desc.Digest)
+
+	pendingPath, err := w.pull(imageRef, imagePath)
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(pendingPath)
+	backupPath := filepath.Join(filepath.Dir(imagePath), "."+filepath.Base(imagePath)+".rollback")
+
+	updated := false
+	err = w.withLock([]string{w.cfg.ImageDir, deployDir}, func() error {
+		// An instance without the digest policy may have been deployed in the meantime
+		if skip, err := w.pinnedBy(deployDir, imageRef, imagePath); skip || err != nil {
+			return err
+		}
+		updated = true
+		if err := os.RemoveAll(backupPath); err != nil {
+			return err
+		}
+		if err := os.Rename(imagePath, backupPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(pendingPath, imagePath); err != nil {
+			_ = os.Rename(backupPath, imagePath)
+			return err
+		}
+		changes := w.reloadChanges(deployDir, candidates)
+		if err := w.reload(changes); err != nil {
+			fmt.Fprintf(w.opts.Log, "Rolling back image %s to %s: %s\n", imageRef, pulled, err)
+			w.rolledBack[desc.Digest.String()] = true
+			if err := os.RemoveAll(imagePath); err != nil {
+				return fmt.Errorf("failed to roll back: %w", err)
+			}
+			if err := os.Rename(backupPath, imagePath); err != nil {
+				return fmt.Errorf("failed to roll back: %w", err)
+			}
+			if err := w.reload(changes); err != nil {
+				return fmt.Errorf("the flows runtime did not confirm the rollback: %w", err)
+			}
+			return fmt.Errorf("rolled back to %s", pulled)
+		}
+		fmt.Fprintf(w.opts.Log, "Image %s updated to %s\n", imageRef, desc.Digest)
+		return os.RemoveAll(backupPath)
+	})
+	return updated && err == nil, err
+}
+
+// pull pulls the image of imagePath into a hidden folder next to it, which is ignored by
+// "images list", and returns the folder. The image_dir is not locked during the download,
+// so other commands are not blocked by a slow link; the caller moves the folder into place
+// while holding the lock. The layers are downloaded to a cache of the watcher, as the
+// BlobCacheDir is only used while holding the lock.
+func (w *Watcher) pull(imageRef string, imagePath string) (string, error) {
+	pendingPath := filepath.Join(filepath.Dir(imagePath), "."+filepath.Base(imagePath)+".watch")
+	opts := imagepull.Options{CacheDir: filepath.Join(w.cfg.ImageDir, ".watch.blobs")}
+	if err := imagepull.PullImage(w.cfg, imageRef, pendingPath, opts); err != nil {
+		os.RemoveAll(pendingPath)
+		return "", fmt.Errorf("failed to pull image: %w", err)
+	}
+	return pendingPath, nil
+}
+
+// pinnedBy reports whether instances without the digest policy use the image folder, in which
+// case the update of the image is skipped
+func (w *Watcher) pinnedBy(deployDir string, imageRef string, imagePath string) (bool, error) {
+	entries, err := instance.List(deployDir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to list instances: %w", err)
+	}
+	var pinned []string
+	for _, entry := range entries {
+		current, err := instance.Read(entry.Path)
+		if err != nil || current.Metadata.UpdatePolicy == PolicyDigest {
+			continue
+		}
+		if usesImage(w.cfg, current, imagePath) {
+			pinned = append(pinned, entry.Name)
+		}
+	}
+	if len(pinned) == 0 {
+		return false, nil
+	}
+	fmt.Fprintf(w.opts.Log, "Skipping update of image %s, it is also used by instances without the digest policy: %s\n", imageRef, strings.Join(pinned, ", "))
+	return true, nil
+}
+
+// usesImage reports whether an instance was deployed from the image in imagePath
+func usesImage(cfg *config.Config, current *flows.InstanceFile, imagePath string) bool {
+	if current.Metadata.Image != "" {
+		path, err := instance.ImagePath(cfg, current.Metadata.Image)
+		return err == nil && path == imagePath
+	}
+	// Instances deployed by older versions don't record the image
+	for _, step := range current.Steps {
+		if rel, err := filepath.Rel(imagePath, step.Script); err == nil && filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadChanges returns the reload changes of the enabled candidates which still exist
+func (w *Watcher) reloadChanges(deployDir string, candidates []candidate) []reload.Change {
+	var changes []reload.Change
+	for _, c := range candidates {
+		entry, err := instance.Find(deployDir, c.entry.Name)
+		if err != nil || entry == nil || !entry.Enabled {
+			continue
+		}
+		changes = append(changes, reload.Change{Action: reload.ActionDeploy, Name: entry.Name, Path: entry.Path})
+	}
+	return changes
+}
+
+func (w *Watcher) reload(changes []reload.Change) error {
+	for _, change := range changes {
+		if err := reload.Run(w.cfg, change, w.opts.Log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withLock runs fn while holding an exclusive lock on the directories
+func (w *Watcher) withLock(dirs []string, fn func() error) error {
+	unlock, err := filelock.AcquireAll(dirs, filelock.Exclusive, w.opts.LockTimeout, w.opts.Log)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
@@ -0,0 +1,224 @@
+package watch
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/instance"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth/registrytest"
+	"github.com/thin-edge/tedge-oscar/internal/semver"
+)
+
+// newTestWatcher returns a watcher whose reload hook fails if a deployed script contains
+// "broken", like a flows runtime which doesn't confirm a faulty flow
+func newTestWatcher(t *testing.T) (*config.Config, *Watcher, *bytes.Buffer, *int) {
+	t.Helper()
+	root := t.TempDir()
+	cfg := &config.Config{
+		ImageDir:  filepath.Join(root, "images"),
+		DeployDir: filepath.Join(root, "deploy"),
+	}
+	cfg.Reload = config.ReloadConfig{
+		Type:    "command",
+		Command: "! cat $(sed -n 's/^ *script *= *\"\\(.*\\)\"$/\\1/p' " + cfg.DeployDir + "/*.toml) | grep -q broken",
+	}
+	var log bytes.Buffer
+	changed := 0
+	w := New(cfg, Options{LockTimeout: time.Second, Changed: func() { changed++ }, Log: &log})
+	return cfg, w, &log, &changed
+}
+
+func deploy(t *testing.T, cfg *config.Config, name, image, policy string) {
+	t.Helper()
+	_, err := instance.Deploy(cfg, instance.DeployOptions{Name: name, Image: image, UpdatePolicy: policy}, io.Discard)
+	if err != nil {
+		t.Fatalf("failed to deploy %s: %s", name, err)
+	}
+}
+
+func check(t *testing.T, w *Watcher) {
+	t.Helper()
+	if err := w.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func instanceImage(t *testing.T, cfg *config.Config, name string) string {
+	t.Helper()
+	current, err := instance.Read(filepath.Join(cfg.DeployDir, name+".toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return current.Metadata.Image
+}
+
+func script(t *testing.T, cfg *config.Config, image string) string {
+	t.Helper()
+	imagePath, err := instance.ImagePath(cfg, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(imagePath, "dist", "main.mjs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func flow(content string) map[string]string {
+	return map[string]string{"dist/main.mjs": content}
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	reg := registrytest.Start()
+	defer reg.Close()
+	for _, version := range []string{"1.0.0", "1.0.1", "1.1.0"} {
+		reg.Push("thin-edge/counter", version, flow("// "+version))
+	}
+	cfg, w, log, changed := newTestWatcher(t)
+	image := reg.Host() + "/thin-edge/counter:"
+	deploy(t, cfg, "a", image+"1.0.0", PolicyPatch)
+	deploy(t, cfg, "b", image+"1.0.0", PolicyNone)
+	// The minor policy stays within the range the instance was deployed with
+	deploy(t, cfg, "c", image+"~1.0", PolicyMinor)
+
+	check(t, w)
+	if got := instanceImage(t, cfg, "a"); got != image+"1.0.1" {
+		t.Errorf("expected instance a to be upgraded within the patch policy, got %s", got)
+	}
+	if got := instanceImage(t, cfg, "b"); got != image+"1.0.0" {
+		t.Errorf("expected instance b to be left alone, got %s", got)
+	}
+	if got := instanceImage(t, cfg, "c"); got != image+"1.0.1" {
+		t.Errorf("expected instance c to stay within its version range, got %s", got)
+	}
+	if *changed != 1 {
+		t.Errorf("expected Changed to be called once, got %d", *changed)
+	}
+
+	// The runtime doesn't confirm the upgrade, which is rolled back and not retried
+	reg.Push("thin-edge/counter", "1.0.2", flow("// broken"))
+	check(t, w)
+	check(t, w)
+	if got := instanceImage(t, cfg, "a"); got != image+"1.0.1" {
+		t.Errorf("expected instance a to be rolled back, got %s", got)
+	}
+	if got := strings.Count(log.String(), "Rolling back instance a"); got != 1 {
+		t.Errorf("expected the upgrade to be rolled back once, got %d times:\n%s", got, log)
+	}
+}
+
+func TestCheckDigest(t *testing.T) {
+	reg := registrytest.Start()
+	defer reg.Close()
+	reg.Push("thin-edge/counter", "latest", flow("// a"))
+	cfg, w, log, changed := newTestWatcher(t)
+	image := reg.Host() + "/thin-edge/counter:latest"
+	deploy(t, cfg, "a", image, PolicyDigest)
+	deploy(t, cfg, "b", image, PolicyDigest)
+
+	reg.Push("thin-edge/counter", "latest", flow("// b"))
+	check(t, w)
+	if got := script(t, cfg, image); got != "// b" {
+		t.Errorf("expected the image to be updated, got %q", got)
+	}
+	if *changed != 1 {
+		t.Errorf("expected Changed to be called once, got %d", *changed)
+	}
+
+	// The runtime doesn't confirm the new image, which is rolled back and not retried
+	reg.Push("thin-edge/counter", "latest", flow("// broken"))
+	check(t, w)
+	check(t, w)
+	if got := script(t, cfg, image); got != "// b" {
+		t.Errorf("expected the image to be rolled back, got %q", got)
+	}
+	if got := strings.Count(log.String(), "Rolling back image"); got != 1 {
+		t.Errorf("expected the update to be rolled back once, got %d times:\n%s", got, log)
+	}
+
+	// Instances without the digest policy keep the image they were deployed with
+	deploy(t, cfg, "c", image, PolicyNone)
+	reg.Push("thin-edge/counter", "latest", flow("// c"))
+	check(t, w)
+	if got := script(t, cfg, image); got != "// b" {
+		t.Errorf("expected the image shared with instance c to be kept, got %q", got)
+	}
+	if !strings.Contains(log.String(), "also used by instances without the digest policy: c") {
+		t.Errorf("expected the skipped update to be logged:\n%s", log)
+	}
+	for _, suffix := range []string{".watch", ".rollback"} {
+		if _, err := os.Stat(filepath.Join(cfg.ImageDir, ".counter:latest"+suffix)); !os.IsNotExist(err) {
+			t.Errorf("expected the %s folder to be removed", suffix)
+		}
+	}
+}
+
+func TestPolicyRange(t *testing.T) {
+	tests := []struct {
+		policy, tag, want string
+	}{
+		{PolicyPatch, "1.2.3", ">=1.2.3, <1.3.0"},
+		{PolicyMinor, "v1.2", ">=1.2.0, <2.0.0"},
+		{PolicyPatch, "0.4.1-rc.1", ">=0.4.1-rc.1, <0.5.0"},
+	}
+	for _, tt := range tests {
+		got, err := PolicyRange(tt.policy, tt.tag)
+		if err != nil || got != tt.want {
+			t.Errorf("PolicyRange(%s, %s) = %q, %v, want %q", tt.policy, tt.tag, got, err, tt.want)
+		}
+	}
+	if _, err := PolicyRange(PolicyPatch, "latest"); err == nil {
+		t.Error("expected an error for a tag which is not a semantic version")
+	}
+	if err := ValidatePolicy("major"); err == nil {
+		t.Error("expected major to be an invalid policy")
+	}
+}
+
+func TestIntersectRanges(t *testing.T) {
+	tests := []struct {
+		versionRange string
+		version      string
+		want         bool
+	}{
+		{"~1.2", "1.2.9", true},
+		{"~1.2", "1.3.0", false},
+		{"1.2.x || 1.4.x", "1.4.1", true},
+		{"1.2.x || 1.4.x", "1.3.0", false},
+		{"1.2.x || 1.4.x", "1.2.0", false},
+	}
+	policyRange, err := PolicyRange(PolicyMinor, "1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		got := intersectRanges(policyRange, tt.versionRange)
+		constraint, err := semver.ParseConstraint(got)
+		if err != nil {
+			t.Fatalf("invalid range %q: %s", got, err)
+		}
+		v, _ := semver.Parse(tt.version)
+		if constraint.Check(v) != tt.want {
+			t.Errorf("%s in %q = %t, want %t", tt.version, got, !tt.want, tt.want)
+		}
+	}
+}
+
+func TestJittered(t *testing.T) {
+	if got := jittered(time.Hour, 0.1, 0); got != 54*time.Minute {
+		t.Errorf("got %s for the lowest jitter", got)
+	}
+	if got := jittered(time.Hour, 0.1, 0.5); got != time.Hour {
+		t.Errorf("got %s for the middle jitter", got)
+	}
+	if got := jittered(time.Hour, 0, 0.9); got != time.Hour {
+		t.Errorf("got %s without jitter", got)
+	}
+}
@@ -12,7 +12,18 @@ type InstanceInput struct {
 	MQTT InstanceInputMQTT `toml:"mqtt"`
 }
 
+// InstanceMetadata is the information tedge-oscar stores about the instance
+type InstanceMetadata struct {
+	Image     string `toml:"image"`
+	ManagedBy string `toml:"managed_by"`
+	// VersionRange is the range "instances upgrade --to-latest" upgrades the image within
+	VersionRange string `toml:"version_range"`
+	// UpdatePolicy is how "tedge-oscar watch" updates the instance: none, patch, minor or digest
+	UpdatePolicy string `toml:"update_policy"`
+}
+
 type InstanceFile struct {
-	Input InstanceInput  `toml:"input"`
-	Steps []InstanceStep `toml:"steps"`
+	Input    InstanceInput    `toml:"input"`
+	Steps    []InstanceStep   `toml:"steps"`
+	Metadata InstanceMetadata `toml:"tedge-oscar"`
 }